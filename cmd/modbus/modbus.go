@@ -6,7 +6,9 @@
 
 	"github.com/spf13/cobra"
 
+	"github.com/rancher/octopus-simulator/cmd/modbus/probe"
 	"github.com/rancher/octopus-simulator/cmd/modbus/rtu"
+	"github.com/rancher/octopus-simulator/cmd/modbus/snapshot"
 	"github.com/rancher/octopus-simulator/cmd/modbus/tcp"
 	"github.com/rancher/octopus-simulator/pkg/util/version/verflag"
 )
@@ -18,6 +20,8 @@
 var allCommands = []*cobra.Command{
 	tcp.NewCommand(),
 	rtu.NewCommand(),
+	snapshot.NewCommand(),
+	probe.NewCommand(),
 }
 
 func NewCommand() *cobra.Command {
@@ -0,0 +1,73 @@
+package options
+
+import (
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+type Options struct {
+	Protocol string
+	Server   string
+	SlaveID  uint8
+	Timeout  time.Duration
+	Parity   string
+	BaudRate int
+	DataBits int
+	StopBits int
+
+	Table     string
+	Address   uint16
+	Count     uint16
+	Type      string
+	ByteOrder string
+
+	Watch  time.Duration
+	Values []string
+}
+
+func (in *Options) Flags(fs *flag.FlagSet) {
+	fs.StringVarP(&in.Protocol, "protocol", "", in.Protocol, "Protocol to connect the server, select from [tcp, rtu, ascii, rtu-over-tcp]")
+	fs.StringVarP(&in.Server, "server", "", in.Server, "Address of the server, e.g. 127.0.0.1:5020 for tcp and rtu-over-tcp, /dev/ttyS001 for rtu and ascii")
+	fs.Uint8VarP(&in.SlaveID, "slave-id", "", in.SlaveID, "ID of the slave")
+	fs.DurationVarP(&in.Timeout, "timeout", "", in.Timeout, "Timeout of each request")
+	fs.StringVarP(&in.Parity, "parity", "p", in.Parity, "Parity of serial port: N - None, E - Even, O - Odd")
+	fs.IntVarP(&in.BaudRate, "baud-rate", "b", in.BaudRate, "Baud rate of serial port")
+	fs.IntVarP(&in.DataBits, "data-bits", "d", in.DataBits, "Data bits of serial port: 5, 6, 7 or 8")
+	fs.IntVarP(&in.StopBits, "stop-bits", "s", in.StopBits, "Stop bits of serial port: 1 or 2")
+	fs.StringVarP(&in.Table, "table", "t", in.Table, "Register table, select from [coils, discrete-inputs, holding-registers, input-registers]")
+	fs.Uint16VarP(&in.Address, "address", "a", in.Address, "Start address of the registers")
+	fs.Uint16VarP(&in.Count, "count", "c", in.Count, "Count of the values, or count of the registers for string type")
+	fs.StringVarP(&in.Type, "type", "", in.Type, "Data type of the register values, select from [uint16, int16, uint32, int32, uint64, int64, float32, float64, string, hex], ignored by coils and discrete inputs")
+	fs.StringVarP(&in.ByteOrder, "byte-order", "", in.ByteOrder, "Byte order of the register values, select from [ABCD, DCBA, BADC, CDAB]")
+	return
+}
+
+func (in *Options) ReadFlags(fs *flag.FlagSet) {
+	in.Flags(fs)
+	fs.DurationVarP(&in.Watch, "watch", "w", in.Watch, "Polling interval to watch the changes, e.g. 1s, reads once if zero")
+	return
+}
+
+func (in *Options) WriteFlags(fs *flag.FlagSet) {
+	in.Flags(fs)
+	fs.StringSliceVarP(&in.Values, "values", "", in.Values, "Values to write, e.g. 1,0,1 for coils, 297.15 for float32 holding registers")
+	return
+}
+
+func NewOptions() *Options {
+	return &Options{
+		Protocol:  "tcp",
+		Server:    "127.0.0.1:5020",
+		SlaveID:   1,
+		Timeout:   time.Second,
+		Parity:    "E",
+		BaudRate:  19200,
+		DataBits:  8,
+		StopBits:  1,
+		Table:     "holding-registers",
+		Count:     1,
+		Type:      "uint16",
+		ByteOrder: "ABCD",
+	}
+}
@@ -0,0 +1,68 @@
+package probe
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/rancher/octopus-simulator/cmd/modbus/probe/options"
+	"github.com/rancher/octopus-simulator/pkg/log"
+	"github.com/rancher/octopus-simulator/pkg/modbus"
+	"github.com/rancher/octopus-simulator/pkg/util/log/logflag"
+	"github.com/rancher/octopus-simulator/pkg/util/version/verflag"
+)
+
+const (
+	name        = "probe"
+	description = `Modbus client to read or write the registers of a server for debugging`
+)
+
+func NewCommand() *cobra.Command {
+	var c = &cobra.Command{
+		Use:  name,
+		Long: description,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			verflag.PrintAndExitIfRequested(name)
+
+			return cmd.Help()
+		},
+	}
+
+	c.AddCommand(newReadCommand(), newWriteCommand())
+	verflag.AddFlags(c.Flags())
+	return c
+}
+
+func newReadCommand() *cobra.Command {
+	var opts = options.NewOptions()
+
+	var c = &cobra.Command{
+		Use:  "read",
+		Long: "Read the registers, and print the changes if watching",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logflag.SetLogger(log.SetLogger)
+
+			return modbus.ProbeRead(opts)
+		},
+	}
+
+	opts.ReadFlags(c.Flags())
+	logflag.AddFlags(c.Flags())
+	return c
+}
+
+func newWriteCommand() *cobra.Command {
+	var opts = options.NewOptions()
+
+	var c = &cobra.Command{
+		Use:  "write",
+		Long: "Write the coils or the holding registers",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logflag.SetLogger(log.SetLogger)
+
+			return modbus.ProbeWrite(opts)
+		},
+	}
+
+	opts.WriteFlags(c.Flags())
+	logflag.AddFlags(c.Flags())
+	return c
+}
@@ -2,26 +2,49 @@
 
 import (
 	"strings"
+	"time"
 
 	flag "github.com/spf13/pflag"
 )
 
 type Options struct {
 	ID       uint8
+	Slaves   map[string]string
+	Device   string
+	Port     string
+	Link     string
 	Parity   string
 	BaudRate int
 	DataBits int
 	StopBits int
 	Interval int
+
+	AdminAddress string
+	InitialState string
+
+	Latency      time.Duration
+	CRCErrorRate float64
+	DropRate     float64
+	GarbageRate  float64
 }
 
 func (in *Options) Flags(fs *flag.FlagSet) {
 	fs.Uint8VarP(&in.ID, "id", "", in.ID, "ID of the Modbus worker")
+	fs.StringVarP(&in.Device, "device", "", in.Device, "Device model of the Modbus worker, select from [thermometer, energy-meter, vfd, plc-io]")
+	fs.StringToStringVarP(&in.Slaves, "slaves", "", in.Slaves, "Additional slaves on the same serial line, in the format of <id>=<device>, e.g. 2=energy-meter,3=vfd")
+	fs.StringVarP(&in.Port, "port", "", in.Port, "Path of the existing serial device to serve, a pseudo terminal pair is created if blank")
+	fs.StringVarP(&in.Link, "link", "", in.Link, "Path of the symbolic link to the client side of the created pseudo terminal pair, e.g. /dev/ttyS001")
 	fs.StringVarP(&in.Parity, "parity", "p", in.Parity, "Parity: N - None, E - Even, O - Odd (default E, the use of None parity requires 2 stop bits)")
 	fs.IntVarP(&in.BaudRate, "baud-rate", "b", in.BaudRate, "RTU baudRate of serial port")
 	fs.IntVarP(&in.DataBits, "data-bits", "d", in.DataBits, "Data bits: 5, 6, 7 or 8 (default 8)")
 	fs.IntVarP(&in.StopBits, "stop-bits", "s", in.StopBits, "Stop bits: 1 or 2 (default 1)")
 	fs.IntVarP(&in.Interval, "interval", "i", in.Interval, "Change cycle in seconds")
+	fs.StringVarP(&in.AdminAddress, "admin-address", "", in.AdminAddress, "Address of the admin endpoints for exporting and restoring the register snapshot, e.g. 127.0.0.1:5021, disabled if blank")
+	fs.StringVarP(&in.InitialState, "initial-state", "", in.InitialState, "Path of the register snapshot to restore before serving")
+	fs.DurationVarP(&in.Latency, "latency", "", in.Latency, "Latency before responding, in addition to the silent interval of 3.5 characters")
+	fs.Float64VarP(&in.CRCErrorRate, "crc-error-rate", "", in.CRCErrorRate, "Probability of corrupting the CRC of a response, between 0 and 1")
+	fs.Float64VarP(&in.DropRate, "drop-rate", "", in.DropRate, "Probability of dropping a byte from a response, between 0 and 1")
+	fs.Float64VarP(&in.GarbageRate, "garbage-rate", "", in.GarbageRate, "Probability of sending garbage bytes before a response, between 0 and 1")
 	return
 }
 
@@ -36,6 +59,7 @@ func (in *Options) Normalize() *Options {
 func NewOptions() *Options {
 	return &Options{
 		ID:       1,
+		Device:   "thermometer",
 		Parity:   "E",
 		BaudRate: 19200,
 		DataBits: 8,
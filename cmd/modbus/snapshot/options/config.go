@@ -0,0 +1,23 @@
+package options
+
+import (
+	flag "github.com/spf13/pflag"
+)
+
+type Options struct {
+	AdminAddress string
+	File         string
+}
+
+func (in *Options) Flags(fs *flag.FlagSet) {
+	fs.StringVarP(&in.AdminAddress, "admin-address", "a", in.AdminAddress, "Address of the admin endpoints of the Modbus simulator")
+	fs.StringVarP(&in.File, "file", "f", in.File, "Path of the snapshot file")
+	return
+}
+
+func NewOptions() *Options {
+	return &Options{
+		AdminAddress: "127.0.0.1:5021",
+		File:         "snapshot.json",
+	}
+}
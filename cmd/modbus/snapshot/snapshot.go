@@ -0,0 +1,53 @@
+package snapshot
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/rancher/octopus-simulator/cmd/modbus/snapshot/options"
+	"github.com/rancher/octopus-simulator/pkg/log"
+	"github.com/rancher/octopus-simulator/pkg/modbus"
+	"github.com/rancher/octopus-simulator/pkg/util/log/logflag"
+	"github.com/rancher/octopus-simulator/pkg/util/version/verflag"
+)
+
+const (
+	name        = "snapshot"
+	description = `Export or restore the register snapshot of a running Modbus simulator`
+)
+
+func NewCommand() *cobra.Command {
+	var c = &cobra.Command{
+		Use:  name,
+		Long: description,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			verflag.PrintAndExitIfRequested(name)
+
+			return cmd.Help()
+		},
+	}
+
+	c.AddCommand(
+		newSubCommand("dump", "Export the register snapshot into the file", modbus.DumpSnapshot),
+		newSubCommand("restore", "Restore the register snapshot from the file", modbus.RestoreSnapshot),
+	)
+	verflag.AddFlags(c.Flags())
+	return c
+}
+
+func newSubCommand(name, description string, run func(*options.Options) error) *cobra.Command {
+	var opts = options.NewOptions()
+
+	var c = &cobra.Command{
+		Use:  name,
+		Long: description,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logflag.SetLogger(log.SetLogger)
+
+			return run(opts)
+		},
+	}
+
+	opts.Flags(c.Flags())
+	logflag.AddFlags(c.Flags())
+	return c
+}
@@ -1,23 +1,57 @@
 package options
 
 import (
+	"time"
+
 	flag "github.com/spf13/pflag"
 )
 
 type Options struct {
 	ID       uint8
+	Device   string
 	Interval int
+
+	AdminAddress string
+	InitialState string
+
+	MaxConnections   int
+	ConnectionPolicy string
+	IdleTimeout      time.Duration
+	RateLimit        float64
+
+	TLSAddress      string
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+	Roles           map[string]string
+	GenerateCerts   string
 }
 
 func (in *Options) Flags(fs *flag.FlagSet) {
 	fs.Uint8VarP(&in.ID, "id", "", in.ID, "ID of the Modbus worker")
+	fs.StringVarP(&in.Device, "device", "", in.Device, "Device model of the Modbus worker, select from [thermometer, energy-meter, vfd, plc-io]")
 	fs.IntVarP(&in.Interval, "interval", "i", in.Interval, "Change cycle in seconds")
+	fs.StringVarP(&in.AdminAddress, "admin-address", "", in.AdminAddress, "Address of the admin endpoints for exporting and restoring the register snapshot, e.g. 127.0.0.1:5021, disabled if blank")
+	fs.StringVarP(&in.InitialState, "initial-state", "", in.InitialState, "Path of the register snapshot to restore before serving")
+	fs.IntVarP(&in.MaxConnections, "max-connections", "", in.MaxConnections, "Max concurrent connections, unlimited if zero")
+	fs.StringVarP(&in.ConnectionPolicy, "connection-policy", "", in.ConnectionPolicy, "Policy when reaching the max connections, select from [refuse, evict-oldest]")
+	fs.DurationVarP(&in.IdleTimeout, "idle-timeout", "", in.IdleTimeout, "Timeout to close the idle connections, e.g. 30s, disabled if zero")
+	fs.Float64VarP(&in.RateLimit, "rate-limit", "", in.RateLimit, "Max requests per second of each connection, the exceeded requests are responded with SlaveDeviceBusy exception, unlimited if zero")
+	fs.StringVarP(&in.TLSAddress, "tls-address", "", in.TLSAddress, "Address of the Modbus/TCP Security listener, e.g. 0.0.0.0:802, disabled if blank")
+	fs.StringVarP(&in.TLSCertFile, "tls-cert-file", "", in.TLSCertFile, "Path of the server certificate of the Modbus/TCP Security listener")
+	fs.StringVarP(&in.TLSKeyFile, "tls-key-file", "", in.TLSKeyFile, "Path of the server private key of the Modbus/TCP Security listener")
+	fs.StringVarP(&in.TLSClientCAFile, "tls-client-ca-file", "", in.TLSClientCAFile, "Path of the CA to verify the client certificates of the Modbus/TCP Security listener")
+	fs.StringToStringVarP(&in.Roles, "roles", "", in.Roles, "Permissions of the roles carried by the client certificates, select from [read, write, read-write], e.g. viewer=read,operator=read-write, all functions are allowed if blank")
+	fs.StringVarP(&in.GenerateCerts, "generate-certs", "", in.GenerateCerts, "Directory to generate the throwaway CA, server and client certificates into, which are used by the Modbus/TCP Security listener")
 	return
 }
 
 func NewOptions() *Options {
 	return &Options{
 		ID:       1,
+		Device:   "thermometer",
 		Interval: 10,
+
+		ConnectionPolicy: "refuse",
 	}
 }
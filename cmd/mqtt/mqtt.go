@@ -29,6 +29,7 @@ func NewCommand() *cobra.Command {
 		},
 	}
 
+	opts.Flags(c.Flags())
 	verflag.AddFlags(c.Flags())
 	logflag.AddFlags(c.Flags())
 	return c
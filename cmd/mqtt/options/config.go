@@ -1,20 +1,127 @@
 package options
 
 import (
+	"time"
+
 	flag "github.com/spf13/pflag"
 )
 
 type Options struct {
-	Interval int
+	Interval     int
+	AdminAddress string
+
+	Listen         []string
+	ServerCertFile string
+	ServerKeyFile  string
+	ClientCAFile   string
+	GenerateCerts  string
+
+	CredentialsFile string
+	PersistenceFile string
+	SysInterval     time.Duration
+
+	ChaosDisconnectInterval   time.Duration
+	ChaosDisconnectRandom     bool
+	ChaosRefusalInterval      time.Duration
+	ChaosRefusalDuration      time.Duration
+	ChaosAckDelay             time.Duration
+	ChaosAckDropRate          float64
+	ChaosDuplicateRate        float64
+	ChaosSubscribeFailureRate float64
+	ChaosIncludeMockers       bool
+
+	Broker                string
+	Username              string
+	Password              string
+	ClientIDPrefix        string
+	KeepAlive             time.Duration
+	MinReconnectDelay     time.Duration
+	MaxReconnectDelay     time.Duration
+	TLSCAFile             string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSInsecureSkipVerify bool
+
+	TopicPrefix     string
+	TopicSite       string
+	TopicTemplate   string
+	DiscoveryPrefix string
+	GetRequests     bool
+
+	KitchenDoorOpenDwell       time.Duration
+	KitchenDoorClosedDwell     time.Duration
+	KitchenDoorRandomDwell     bool
+	KitchenDoorForcedEntryRate float64
+
+	PayloadStyles         map[string]string
+	PayloadCodecs         map[string]string
+	ProtobufDescriptorSet string
+
+	Sparkplug           bool
+	SparkplugGroupID    string
+	SparkplugEdgeNodeID string
 }
 
 func (in *Options) Flags(fs *flag.FlagSet) {
 	fs.IntVarP(&in.Interval, "interval", "i", in.Interval, "Change cycle in seconds")
+	fs.StringVarP(&in.AdminAddress, "admin-address", "", in.AdminAddress, "Address of the admin endpoints for killing the connection of a device abruptly, e.g. 127.0.0.1:1884, disabled if blank")
+	fs.StringSliceVarP(&in.Listen, "listen", "", in.Listen, "Addresses of the embedded broker, select the schemes from [tcp, tls(mqtts), ws, wss], e.g. tcp://0.0.0.0:1883,mqtts://0.0.0.0:8883 (default tcp://<POD_IP>:1883)")
+	fs.StringVarP(&in.ServerCertFile, "server-cert-file", "", in.ServerCertFile, "Path of the server certificate of the embedded broker, required by tls and wss listeners")
+	fs.StringVarP(&in.ServerKeyFile, "server-key-file", "", in.ServerKeyFile, "Path of the server private key of the embedded broker, required by tls and wss listeners")
+	fs.StringVarP(&in.ClientCAFile, "client-ca-file", "", in.ClientCAFile, "Path of the CA to verify the client certificates, the secured listeners require the client certificates if specified")
+	fs.StringVarP(&in.GenerateCerts, "generate-certs", "", in.GenerateCerts, "Directory to generate the throwaway CA, server and client certificates into, which are used by the secured listeners and the mockers if not specified, the client certificates are still only required by --client-ca-file")
+	fs.StringVarP(&in.PersistenceFile, "persistence-file", "", in.PersistenceFile, "Path of the file to persist the retained messages and the sessions of clean-session=false clients of the embedded broker, which are restored at startup, kept in memory only if blank")
+	fs.DurationVarP(&in.SysInterval, "sys-interval", "", in.SysInterval, "Interval of publishing the statistics of the embedded broker to the $SYS/broker/... topics, disabled if 0")
+	fs.DurationVarP(&in.ChaosDisconnectInterval, "chaos-disconnect-interval", "", in.ChaosDisconnectInterval, "Interval of disconnecting all clients of the embedded broker abruptly, disabled if 0")
+	fs.BoolVarP(&in.ChaosDisconnectRandom, "chaos-disconnect-random", "", in.ChaosDisconnectRandom, "Disconnect a random client after a random duration up to twice the chaos-disconnect-interval instead")
+	fs.DurationVarP(&in.ChaosRefusalInterval, "chaos-refusal-interval", "", in.ChaosRefusalInterval, "Interval of the windows that the embedded broker refuses the new connections with CONNACK server unavailable, disabled if 0")
+	fs.DurationVarP(&in.ChaosRefusalDuration, "chaos-refusal-duration", "", in.ChaosRefusalDuration, "Duration of each connection refusal window")
+	fs.DurationVarP(&in.ChaosAckDelay, "chaos-ack-delay", "", in.ChaosAckDelay, "Maximum random delay of PUBACK and PUBREC sent by the embedded broker, disabled if 0")
+	fs.Float64VarP(&in.ChaosAckDropRate, "chaos-ack-drop-rate", "", in.ChaosAckDropRate, "Probability in [0, 1] of dropping PUBACK and PUBREC sent by the embedded broker")
+	fs.Float64VarP(&in.ChaosDuplicateRate, "chaos-duplicate-rate", "", in.ChaosDuplicateRate, "Probability in [0, 1] of delivering QoS 1/2 PUBLISH twice, the second one with the DUP flag")
+	fs.Float64VarP(&in.ChaosSubscribeFailureRate, "chaos-subscribe-failure-rate", "", in.ChaosSubscribeFailureRate, "Probability in [0, 1] of failing each subscription with the SUBACK failure code")
+	fs.BoolVarP(&in.ChaosIncludeMockers, "chaos-include-mockers", "", in.ChaosIncludeMockers, "Inject the chaos faults into the mockers as well, the clients of the client-id-prefix are spared by default")
+	fs.StringVarP(&in.CredentialsFile, "credentials-file", "", in.CredentialsFile, "Path of the JSON file of the users and their topic ACL rules, the embedded broker accepts all clients and topics if blank")
+	fs.StringVarP(&in.Broker, "broker", "", in.Broker, "URL of the external broker to attach the mockers to, e.g. tcp://127.0.0.1:1883 or tls://127.0.0.1:8883, the embedded broker is launched if blank")
+	fs.StringVarP(&in.Username, "username", "", in.Username, "Username of the mockers to connect the broker")
+	fs.StringVarP(&in.Password, "password", "", in.Password, "Password of the mockers to connect the broker")
+	fs.StringVarP(&in.ClientIDPrefix, "client-id-prefix", "", in.ClientIDPrefix, "Prefix of the client ID of each mocker")
+	fs.DurationVarP(&in.KeepAlive, "keepalive", "", in.KeepAlive, "Keepalive interval of the mockers")
+	fs.DurationVarP(&in.MinReconnectDelay, "min-reconnect-delay", "", in.MinReconnectDelay, "Minimum delay of the mockers to reconnect the broker once the connection is lost, which is doubled by each reconnecting up to the max-reconnect-delay")
+	fs.DurationVarP(&in.MaxReconnectDelay, "max-reconnect-delay", "", in.MaxReconnectDelay, "Maximum delay of the mockers to reconnect the broker")
+	fs.StringVarP(&in.TLSCAFile, "tls-ca-file", "", in.TLSCAFile, "Path of the CA to verify the broker certificate")
+	fs.StringVarP(&in.TLSCertFile, "tls-cert-file", "", in.TLSCertFile, "Path of the client certificate to present to the broker")
+	fs.StringVarP(&in.TLSKeyFile, "tls-key-file", "", in.TLSKeyFile, "Path of the client private key to present to the broker")
+	fs.BoolVarP(&in.TLSInsecureSkipVerify, "tls-insecure-skip-verify", "", in.TLSInsecureSkipVerify, "Skip verifying the broker certificate")
+	fs.StringVarP(&in.TopicPrefix, "topic-prefix", "", in.TopicPrefix, "Prefix of the device topics, which distinguishes the simulator instances sharing a broker")
+	fs.StringVarP(&in.TopicSite, "topic-site", "", in.TopicSite, "Site of the device topics")
+	fs.StringVarP(&in.TopicTemplate, "topic-template", "", in.TopicTemplate, "Go template of the device topics with the variables [.Prefix, .Site, .Area, .Device, .Kind, .Attribute], e.g. {{.Prefix}}/{{.Site}}/{{.Area}}/{{.Device}}/{{.Attribute}}/{{.Kind}}, the layouts of the devices are kept if blank")
+	fs.StringVarP(&in.DiscoveryPrefix, "discovery-prefix", "", in.DiscoveryPrefix, "Prefix of Home Assistant MQTT discovery topics, e.g. homeassistant, the mockers publish the retained discovery configs if not blank")
+	fs.BoolVarP(&in.GetRequests, "get-requests", "", in.GetRequests, "Make the devices answer the get requests published to their get topics with the current states")
+	fs.DurationVarP(&in.KitchenDoorOpenDwell, "kitchen-door-open-dwell", "", in.KitchenDoorOpenDwell, "Duration of the kitchen door staying open before closing, the door stays open until the state command if 0, e.g. 10s")
+	fs.DurationVarP(&in.KitchenDoorClosedDwell, "kitchen-door-closed-dwell", "", in.KitchenDoorClosedDwell, "Duration of the kitchen door staying closed before opening, the door stays closed until the state command if 0, e.g. 30s")
+	fs.BoolVarP(&in.KitchenDoorRandomDwell, "kitchen-door-random-dwell", "", in.KitchenDoorRandomDwell, "Keep the kitchen door open or closed for a random duration up to twice the dwell instead")
+	fs.Float64VarP(&in.KitchenDoorForcedEntryRate, "kitchen-door-forced-entry-rate", "", in.KitchenDoorForcedEntryRate, "Probability in [0, 1] of forcing the locked kitchen door open when it is due to open, the opening is refused otherwise")
+	fs.StringToStringVarP(&in.PayloadStyles, "payload-styles", "", in.PayloadStyles, "Payload styles of the lights, select the style from [legacy, flat, nested-json, attribute-list, document], e.g. kitchen-light=document,bedroom-light=flat, the lights keep their legacy layouts if blank")
+	fs.StringToStringVarP(&in.PayloadCodecs, "payload-codecs", "", in.PayloadCodecs, "Payload codecs of the devices for publishing the states and decoding the commands, select the codec from [text, json, cbor, msgpack, protobuf:<message>, base64[+<codec>]], e.g. kitchen-light=cbor,bedroom-light=protobuf:octopus.BedroomLight")
+	fs.StringVarP(&in.ProtobufDescriptorSet, "protobuf-descriptor-set", "", in.ProtobufDescriptorSet, "Path of the protobuf descriptor set generated by protoc --include_imports --descriptor_set_out, required by the protobuf codec")
+	fs.BoolVarP(&in.Sparkplug, "sparkplug", "", in.Sparkplug, "Mock a Sparkplug B edge node with the boiler and pump devices")
+	fs.StringVarP(&in.SparkplugGroupID, "sparkplug-group-id", "", in.SparkplugGroupID, "Group ID of the Sparkplug B edge node")
+	fs.StringVarP(&in.SparkplugEdgeNodeID, "sparkplug-edge-node-id", "", in.SparkplugEdgeNodeID, "Edge node ID of the Sparkplug B edge node")
 	return
 }
 
 func NewOptions() *Options {
 	return &Options{
-		Interval: 10,
+		Interval:          10,
+		ClientIDPrefix:    "octopus-simulator-",
+		KeepAlive:         30 * time.Second,
+		MinReconnectDelay: time.Second,
+		MaxReconnectDelay: 10 * time.Second,
+		TopicPrefix:       "cattle.io/octopus",
+		TopicSite:         "home",
+
+		SparkplugGroupID:    "octopus",
+		SparkplugEdgeNodeID: "simulator",
 	}
 }
@@ -49,6 +49,12 @@ func init() {
 				*(*interface{})(ptr) = i
 				return
 			}
+			// keeps the unsigned integers beyond int64 precisely
+			u, err := strconv.ParseUint(string(number), 10, 64)
+			if err == nil {
+				*(*interface{})(ptr) = u
+				return
+			}
 			f, err := strconv.ParseFloat(string(number), 64)
 			if err == nil {
 				*(*interface{})(ptr) = f
@@ -0,0 +1,126 @@
+package modbus
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/octopus-simulator/pkg/converter"
+	"github.com/rancher/octopus-simulator/pkg/log"
+)
+
+// serveAdmin serves the administration endpoints of the bus on the address:
+//
+//	GET /snapshot: captures the register space of all slaves as JSON.
+//	PUT /snapshot: restores the register space of the slaves from JSON.
+//	GET /sessions: lists the stats of the active sessions as JSON, only available if the sessions are given.
+func serveAdmin(address string, b bus, sessions http.Handler) (*http.Server, error) {
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			var data, err = converter.MarshalJSON(b.Snapshot())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(data)
+		case http.MethodPut:
+			var data, err = ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var ss snapshot
+			if err := converter.UnmarshalJSON(data, &ss); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := b.Restore(&ss); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Info("Restored snapshot")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+
+	if sessions != nil {
+		mux.Handle("/sessions", sessions)
+	}
+
+	var listener, err = net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start admin server")
+	}
+	var server = &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error(err, "Failed to serve admin requests")
+		}
+	}()
+	log.Info("Serving admin endpoints on " + address)
+	return server, nil
+}
+
+// adminURL completes the admin address as an URL of the path.
+func adminURL(address, path string) string {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	return strings.TrimSuffix(address, "/") + path
+}
+
+// getSnapshot fetches the snapshot from the admin endpoint.
+func getSnapshot(address string) (*snapshot, error) {
+	var resp, err = http.Get(adminURL(address, "/snapshot"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to request snapshot")
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read snapshot")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to request snapshot: %s, %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var ss snapshot
+	if err := converter.UnmarshalJSON(data, &ss); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal snapshot")
+	}
+	return &ss, nil
+}
+
+// putSnapshot sends the snapshot to the admin endpoint.
+func putSnapshot(address string, ss *snapshot) error {
+	var data, err = converter.MarshalJSON(ss)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal snapshot")
+	}
+	req, err := http.NewRequest(http.MethodPut, adminURL(address, "/snapshot"), bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "failed to create snapshot request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to restore snapshot")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		var msg, _ = ioutil.ReadAll(resp.Body)
+		return errors.Errorf("failed to restore snapshot: %s, %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
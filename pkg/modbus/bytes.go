@@ -0,0 +1,60 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+func convertInt8ToBytes(i int8) []byte {
+	var ret = make([]byte, 2)
+	binary.BigEndian.PutUint16(ret, uint16(i))
+	return ret
+}
+
+func convertUint16ToBytes(i uint16) []byte {
+	var ret = make([]byte, 2)
+	binary.BigEndian.PutUint16(ret, i)
+	return ret
+}
+
+func convertInt32ToBytes(i int32) []byte {
+	var ret = make([]byte, 4)
+	binary.BigEndian.PutUint32(ret, uint32(i))
+	return ret
+}
+
+func convertUint32ToBytes(i uint32) []byte {
+	var ret = make([]byte, 4)
+	binary.BigEndian.PutUint32(ret, i)
+	return ret
+}
+
+func convertUint64ToBytes(i uint64) []byte {
+	var ret = make([]byte, 8)
+	binary.BigEndian.PutUint64(ret, i)
+	return ret
+}
+
+func convertFloat32ToBytes(f float32) []byte {
+	var ret = make([]byte, 4)
+	binary.BigEndian.PutUint32(ret, math.Float32bits(f))
+	return ret
+}
+
+func convertFloat64ToBytes(f float64) []byte {
+	var ret = make([]byte, 8)
+	binary.BigEndian.PutUint64(ret, math.Float64bits(f))
+	return ret
+}
+
+func parseBytesToInt32(bs []byte) int32 {
+	return int32(binary.BigEndian.Uint32(bs))
+}
+
+func parseBytesToUint64(bs []byte) uint64 {
+	return binary.BigEndian.Uint64(bs)
+}
+
+func parseBytesToFloat32(bs []byte) float32 {
+	return math.Float32frombits(binary.BigEndian.Uint32(bs))
+}
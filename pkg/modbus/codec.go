@@ -0,0 +1,208 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// registerCodec converts the register values between the bytes and the strings by the data type and the byte order,
+// the bytes of a register are BigEndian on the wire, the byte order describes how the registers of a value are arranged,
+// e.g. the float32 value 0xAABBCCDD is arranged as AA BB CC DD in ABCD, and CC DD AA BB in CDAB.
+type registerCodec struct {
+	table     table
+	dataType  string
+	byteOrder string
+}
+
+func newRegisterCodec(t table, dataType, byteOrder string) *registerCodec {
+	return &registerCodec{
+		table:     t,
+		dataType:  dataType,
+		byteOrder: strings.ToUpper(byteOrder),
+	}
+}
+
+func (c *registerCodec) Validate() error {
+	if c.isBits() {
+		return nil
+	}
+	switch c.dataType {
+	case "uint16", "int16", "uint32", "int32", "uint64", "int64", "float32", "float64", "string", "hex":
+	default:
+		return errors.Errorf("unknown data type %s", c.dataType)
+	}
+	switch c.byteOrder {
+	case "ABCD", "DCBA", "BADC", "CDAB":
+	default:
+		return errors.Errorf("unknown byte order %s", c.byteOrder)
+	}
+	return nil
+}
+
+// Size returns the count of coils or registers occupied by a value.
+func (c *registerCodec) Size() uint16 {
+	switch c.dataType {
+	case "uint32", "int32", "float32":
+		if !c.isBits() {
+			return 2
+		}
+	case "uint64", "int64", "float64":
+		if !c.isBits() {
+			return 4
+		}
+	}
+	return 1
+}
+
+// Decode converts the read bytes into the count of values,
+// the string is decoded as a whole value with the trailing NULs trimmed.
+func (c *registerCodec) Decode(data []byte, count uint16) ([]string, error) {
+	if c.isBits() {
+		if len(data)*8 < int(count) {
+			return nil, errors.Errorf("failed to decode %d bits from %d bytes", count, len(data))
+		}
+		var values = make([]string, count)
+		for i := range values {
+			values[i] = strconv.FormatBool(data[i/8]&(1<<uint(i%8)) != 0)
+		}
+		return values, nil
+	}
+
+	var size = int(c.Size()) * 2
+	if len(data) < int(count)*size {
+		return nil, errors.Errorf("failed to decode %d values of %s from %d bytes", count, c.dataType, len(data))
+	}
+	if c.dataType == "string" {
+		var str = c.reorder(data[:int(count)*size])
+		return []string{strconv.Quote(strings.TrimRight(string(str), "\x00"))}, nil
+	}
+
+	var values = make([]string, count)
+	for i := range values {
+		var chunk = c.reorder(data[i*size : (i+1)*size])
+		switch c.dataType {
+		case "uint16":
+			values[i] = strconv.FormatUint(uint64(binary.BigEndian.Uint16(chunk)), 10)
+		case "int16":
+			values[i] = strconv.FormatInt(int64(int16(binary.BigEndian.Uint16(chunk))), 10)
+		case "hex":
+			values[i] = fmt.Sprintf("0x%04X", binary.BigEndian.Uint16(chunk))
+		case "uint32":
+			values[i] = strconv.FormatUint(uint64(binary.BigEndian.Uint32(chunk)), 10)
+		case "int32":
+			values[i] = strconv.FormatInt(int64(int32(binary.BigEndian.Uint32(chunk))), 10)
+		case "float32":
+			values[i] = strconv.FormatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(chunk))), 'g', -1, 32)
+		case "uint64":
+			values[i] = strconv.FormatUint(binary.BigEndian.Uint64(chunk), 10)
+		case "int64":
+			values[i] = strconv.FormatInt(int64(binary.BigEndian.Uint64(chunk)), 10)
+		case "float64":
+			values[i] = strconv.FormatFloat(math.Float64frombits(binary.BigEndian.Uint64(chunk)), 'g', -1, 64)
+		}
+	}
+	return values, nil
+}
+
+// Encode converts the values into the bytes to write, and returns the quantity of coils or registers,
+// the string is encoded from the values joined by comma, as the values flag splits the string on comma,
+// and padded with NUL to fill the last register.
+func (c *registerCodec) Encode(values []string) ([]byte, uint16, error) {
+	if c.isBits() {
+		var data = make([]byte, (len(values)+7)/8)
+		for i, v := range values {
+			var b, err = strconv.ParseBool(v)
+			if err != nil {
+				return nil, 0, errors.Wrapf(err, "failed to parse %s as boolean", v)
+			}
+			if b {
+				data[i/8] |= 1 << uint(i%8)
+			}
+		}
+		return data, uint16(len(values)), nil
+	}
+
+	if c.dataType == "string" {
+		var data = []byte(strings.Join(values, ","))
+		if len(data)%2 != 0 {
+			data = append(data, 0)
+		}
+		return c.reorder(data), uint16(len(data) / 2), nil
+	}
+
+	var size = int(c.Size()) * 2
+	var data = make([]byte, 0, len(values)*size)
+	for _, v := range values {
+		var chunk = make([]byte, size)
+		var err error
+		switch c.dataType {
+		case "uint16", "hex":
+			var u uint64
+			u, err = strconv.ParseUint(v, 0, 16)
+			binary.BigEndian.PutUint16(chunk, uint16(u))
+		case "int16":
+			var i int64
+			i, err = strconv.ParseInt(v, 0, 16)
+			binary.BigEndian.PutUint16(chunk, uint16(i))
+		case "uint32":
+			var u uint64
+			u, err = strconv.ParseUint(v, 0, 32)
+			binary.BigEndian.PutUint32(chunk, uint32(u))
+		case "int32":
+			var i int64
+			i, err = strconv.ParseInt(v, 0, 32)
+			binary.BigEndian.PutUint32(chunk, uint32(i))
+		case "float32":
+			var f float64
+			f, err = strconv.ParseFloat(v, 32)
+			binary.BigEndian.PutUint32(chunk, math.Float32bits(float32(f)))
+		case "uint64":
+			var u uint64
+			u, err = strconv.ParseUint(v, 0, 64)
+			binary.BigEndian.PutUint64(chunk, u)
+		case "int64":
+			var i int64
+			i, err = strconv.ParseInt(v, 0, 64)
+			binary.BigEndian.PutUint64(chunk, uint64(i))
+		case "float64":
+			var f float64
+			f, err = strconv.ParseFloat(v, 64)
+			binary.BigEndian.PutUint64(chunk, math.Float64bits(f))
+		}
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "failed to parse %s as %s", v, c.dataType)
+		}
+		data = append(data, c.reorder(chunk)...)
+	}
+	return data, uint16(len(data) / 2), nil
+}
+
+func (c *registerCodec) isBits() bool {
+	return c.table == coilsTable || c.table == discreteInputsTable
+}
+
+// reorder converts the bytes of a value between ABCD and the byte order,
+// the conversion is symmetric, so that it is used for both decoding and encoding.
+func (c *registerCodec) reorder(chunk []byte) []byte {
+	var ret = make([]byte, len(chunk))
+	copy(ret, chunk)
+
+	// swaps the bytes in each register
+	if c.byteOrder == "BADC" || c.byteOrder == "DCBA" {
+		for i := 0; i+1 < len(ret); i += 2 {
+			ret[i], ret[i+1] = ret[i+1], ret[i]
+		}
+	}
+	// reverses the registers, except the string which is a sequence of registers
+	if (c.byteOrder == "CDAB" || c.byteOrder == "DCBA") && c.dataType != "string" {
+		for i, j := 0, len(ret)-2; i < j; i, j = i+2, j-2 {
+			ret[i], ret[i+1], ret[j], ret[j+1] = ret[j], ret[j+1], ret[i], ret[i+1]
+		}
+	}
+	return ret
+}
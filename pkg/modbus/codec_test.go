@@ -0,0 +1,85 @@
+package modbus
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRegisterCodec(t *testing.T) {
+	var testCases = []struct {
+		name      string
+		coils     bool
+		dataType  string
+		byteOrder string
+		values    []string
+		data      []byte
+		quantity  uint16
+		// decoded is the values read back, it is the same as the written values if nil
+		decoded []string
+	}{
+		{name: "uint16 ABCD", dataType: "uint16", byteOrder: "ABCD", values: []string{"43707"}, data: []byte{0xaa, 0xbb}, quantity: 1},
+		{name: "uint16 DCBA", dataType: "uint16", byteOrder: "DCBA", values: []string{"43707"}, data: []byte{0xbb, 0xaa}, quantity: 1},
+		{name: "uint16 BADC", dataType: "uint16", byteOrder: "BADC", values: []string{"43707"}, data: []byte{0xbb, 0xaa}, quantity: 1},
+		{name: "uint16 CDAB", dataType: "uint16", byteOrder: "CDAB", values: []string{"43707"}, data: []byte{0xaa, 0xbb}, quantity: 1},
+		{name: "hex", dataType: "hex", byteOrder: "ABCD", values: []string{"0xAABB", "0x0001"}, data: []byte{0xaa, 0xbb, 0x00, 0x01}, quantity: 2},
+		{name: "int16", dataType: "int16", byteOrder: "ABCD", values: []string{"-2"}, data: []byte{0xff, 0xfe}, quantity: 1},
+		{name: "uint32 ABCD", dataType: "uint32", byteOrder: "ABCD", values: []string{"2864434397"}, data: []byte{0xaa, 0xbb, 0xcc, 0xdd}, quantity: 2},
+		{name: "uint32 DCBA", dataType: "uint32", byteOrder: "DCBA", values: []string{"2864434397"}, data: []byte{0xdd, 0xcc, 0xbb, 0xaa}, quantity: 2},
+		{name: "uint32 BADC", dataType: "uint32", byteOrder: "BADC", values: []string{"2864434397"}, data: []byte{0xbb, 0xaa, 0xdd, 0xcc}, quantity: 2},
+		{name: "uint32 CDAB", dataType: "uint32", byteOrder: "CDAB", values: []string{"2864434397"}, data: []byte{0xcc, 0xdd, 0xaa, 0xbb}, quantity: 2},
+		{name: "int32 CDAB", dataType: "int32", byteOrder: "CDAB", values: []string{"-2", "330"}, data: []byte{0xff, 0xfe, 0xff, 0xff, 0x01, 0x4a, 0x00, 0x00}, quantity: 4},
+		{name: "float32 ABCD", dataType: "float32", byteOrder: "ABCD", values: []string{"297.15"}, data: []byte{0x43, 0x94, 0x93, 0x33}, quantity: 2},
+		{name: "float32 CDAB", dataType: "float32", byteOrder: "CDAB", values: []string{"297.15"}, data: []byte{0x93, 0x33, 0x43, 0x94}, quantity: 2},
+		{name: "uint64 ABCD", dataType: "uint64", byteOrder: "ABCD", values: []string{"72623859790382856"}, data: []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}, quantity: 4},
+		{name: "uint64 DCBA", dataType: "uint64", byteOrder: "DCBA", values: []string{"72623859790382856"}, data: []byte{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}, quantity: 4},
+		{name: "uint64 BADC", dataType: "uint64", byteOrder: "BADC", values: []string{"72623859790382856"}, data: []byte{0x02, 0x01, 0x04, 0x03, 0x06, 0x05, 0x08, 0x07}, quantity: 4},
+		{name: "uint64 CDAB", dataType: "uint64", byteOrder: "CDAB", values: []string{"72623859790382856"}, data: []byte{0x07, 0x08, 0x05, 0x06, 0x03, 0x04, 0x01, 0x02}, quantity: 4},
+		{name: "int64 DCBA", dataType: "int64", byteOrder: "DCBA", values: []string{"-2"}, data: []byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, quantity: 4},
+		{name: "float64 ABCD", dataType: "float64", byteOrder: "ABCD", values: []string{"1.5"}, data: []byte{0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, quantity: 4},
+		{name: "string ABCD", dataType: "string", byteOrder: "ABCD", values: []string{"abc"}, data: []byte{'a', 'b', 'c', 0}, quantity: 2, decoded: []string{`"abc"`}},
+		{name: "string DCBA", dataType: "string", byteOrder: "DCBA", values: []string{"abc"}, data: []byte{'b', 'a', 0, 'c'}, quantity: 2, decoded: []string{`"abc"`}},
+		{name: "string BADC", dataType: "string", byteOrder: "BADC", values: []string{"abc"}, data: []byte{'b', 'a', 0, 'c'}, quantity: 2, decoded: []string{`"abc"`}},
+		{name: "string CDAB", dataType: "string", byteOrder: "CDAB", values: []string{"abc"}, data: []byte{'a', 'b', 'c', 0}, quantity: 2, decoded: []string{`"abc"`}},
+		{name: "string split on comma", dataType: "string", byteOrder: "ABCD", values: []string{"a", "b"}, data: []byte{'a', ',', 'b', 0}, quantity: 2, decoded: []string{`"a,b"`}},
+		{name: "coils", coils: true, values: []string{"1", "0", "1"}, data: []byte{0x05}, quantity: 3, decoded: []string{"true", "false", "true"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var table = holdingRegistersTable
+			if tc.coils {
+				table = coilsTable
+			}
+			var c = newRegisterCodec(table, tc.dataType, tc.byteOrder)
+			if err := c.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			var data, quantity, err = c.Encode(tc.values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, tc.data) || quantity != tc.quantity {
+				t.Errorf("expected % x of quantity %d, but got % x of quantity %d", tc.data, tc.quantity, data, quantity)
+			}
+
+			// the string is decoded as a whole value from the registers
+			var count = uint16(len(tc.values))
+			if tc.dataType == "string" || tc.coils {
+				count = tc.quantity
+			}
+			var expected = tc.decoded
+			if expected == nil {
+				expected = tc.values
+			}
+			decoded, err := c.Decode(tc.data, count)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, expected) {
+				t.Errorf("expected %v, but got %v", expected, decoded)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package modbus
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// device is the model of a simulated Modbus device, which mocks the points of the slave.
+type device interface {
+	io.Closer
+	Mock(interval time.Duration) error
+}
+
+type deviceFactory func(s *slave, stop <-chan struct{}) device
+
+var deviceFactories = map[string]deviceFactory{
+	"thermometer": func(s *slave, stop <-chan struct{}) device {
+		return mockThermometer(s, stop)
+	},
+	"energy-meter": func(s *slave, stop <-chan struct{}) device {
+		return mockEnergyMeter(s, stop)
+	},
+	"vfd": func(s *slave, stop <-chan struct{}) device {
+		return mockVFD(s, stop)
+	},
+	"plc-io": func(s *slave, stop <-chan struct{}) device {
+		return mockPLCIO(s, stop)
+	},
+}
+
+type devices []device
+
+func (in devices) Close() error {
+	for _, d := range in {
+		if d != nil {
+			_ = d.Close()
+		}
+	}
+	return nil
+}
+
+func (in devices) Mock(interval time.Duration) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, d := range in {
+		if d != nil {
+			wg.Add(1)
+			go func(d device) {
+				defer wg.Done()
+				_ = d.Mock(interval)
+			}(d)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package modbus
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/tbrandon/mbserver"
+
+	"github.com/rancher/octopus-simulator/pkg/critical"
+	"github.com/rancher/octopus-simulator/pkg/log"
+)
+
+func mockEnergyMeter(slave *slave, stop <-chan struct{}) *energyMeter {
+	var ctx, ctxCancel = context.WithCancel(critical.Context(stop))
+
+	var in = &energyMeter{
+		log:       log.WithName("energy_meter").WithValues("slave", slave.id),
+		slave:     slave,
+		ctx:       ctx,
+		ctxCancel: ctxCancel,
+		currents:  [3]float64{1.5, 1.2, 1.8},
+	}
+
+	// resets the energy counters when writing coils register 0
+	slave.Handle(coilsTable, 0, 1, in.handleReset)
+	// validates current transformer ratio when writing holding register 0
+	slave.Handle(holdingRegistersTable, 0, 1, in.handleCTRatio)
+	// reloads energy and phase currents after restoring
+	slave.HandleRestore(in.handleRestore)
+
+	slave.Update(func(tx *transaction) {
+		// defaults current transformer ratio is 1
+		tx.Set(holdingRegistersTable, 0, 1)
+
+		// defaults manufacturer is Rancher Octopus Fake Factory
+		tx.SetBytes(holdingRegistersTable, 1, []byte("Rancher Octopus Fake Factory"))
+	})
+	return in
+}
+
+type energyMeter struct {
+	log       logr.Logger
+	slave     *slave
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
+	// the followings are guarded by the lock of slave
+	energy   float64 // accumulated active energy in Wh
+	currents [3]float64
+}
+
+func (in *energyMeter) Close() error {
+	if in.ctxCancel != nil {
+		in.ctxCancel()
+	}
+	return nil
+}
+
+func (in *energyMeter) Mock(interval time.Duration) error {
+	var last = time.Now()
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		in.slave.Update(func(tx *transaction) {
+			var now = time.Now()
+			var elapsed = now.Sub(last)
+			last = now
+
+			// gets current transformer ratio
+			var ratio = float64(tx.Get(holdingRegistersTable, 0, 1)[0])
+
+			// mocks phase voltages, unit is volt, range is [225V, 235V)
+			var power float64
+			for phase := 0; phase < 3; phase++ {
+				var voltage = rand.Float64()*10 + 225
+				tx.SetBytes(inputRegistersTable, uint16(phase*2), convertFloat32ToBytes(float32(voltage)))
+
+				// mocks phase currents by random walk, the secondary side is in [0.5A, 5A]
+				var secondary = in.currents[phase] + rand.Float64()*0.4 - 0.2
+				if secondary < 0.5 {
+					secondary = 0.5
+				} else if secondary > 5 {
+					secondary = 5
+				}
+				in.currents[phase] = secondary
+				var current = secondary * ratio
+				tx.SetBytes(inputRegistersTable, uint16(6+phase*2), convertFloat32ToBytes(float32(current)))
+
+				// the power factor is 0.95
+				power += voltage * current * 0.95
+				in.log.Info(fmt.Sprintf("Mocked L%d as %.2fV, %.2fA", phase+1, voltage, current))
+			}
+
+			// mocks total active power, unit is kW
+			tx.SetBytes(inputRegistersTable, 12, convertFloat32ToBytes(float32(power/1000)))
+			in.log.Info(fmt.Sprintf("Mocked total active power as %.3fkW", power/1000))
+
+			// mocks frequency, unit is Hz, range is [49.95Hz, 50.05Hz)
+			var frequency = rand.Float64()*0.1 + 49.95
+			tx.SetBytes(inputRegistersTable, 14, convertFloat32ToBytes(float32(frequency)))
+
+			// accumulates active energy
+			in.energy += power * elapsed.Hours()
+			tx.SetBytes(inputRegistersTable, 16, convertUint32ToBytes(uint32(in.energy/1000)))
+			tx.SetBytes(inputRegistersTable, 18, convertUint64ToBytes(uint64(in.energy)))
+			in.log.Info(fmt.Sprintf("Mocked total active energy as %.3fkWh", in.energy/1000))
+		})
+
+		select {
+		case <-in.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (in *energyMeter) handleRestore(tx *transaction) {
+	in.energy = float64(parseBytesToUint64(tx.GetBytes(inputRegistersTable, 18, 4)))
+
+	// the phase currents are recorded at the primary side
+	var ratio = float64(tx.Get(holdingRegistersTable, 0, 1)[0])
+	if ratio < 1 {
+		return
+	}
+	for phase := 0; phase < 3; phase++ {
+		var current = float64(parseBytesToFloat32(tx.GetBytes(inputRegistersTable, uint16(6+phase*2), 2)))
+		if current > 0 {
+			in.currents[phase] = current / ratio
+		}
+	}
+}
+
+func (in *energyMeter) handleReset(tx *transaction, values []uint16) *mbserver.Exception {
+	if values[0] != 1 {
+		return nil
+	}
+
+	in.energy = 0
+	tx.SetBytes(inputRegistersTable, 16, convertUint32ToBytes(0))
+	tx.SetBytes(inputRegistersTable, 18, convertUint64ToBytes(0))
+	// the reset coil returns to false after resetting
+	tx.Set(coilsTable, 0, 0)
+	in.log.Info("Reset total active energy")
+	return nil
+}
+
+func (in *energyMeter) handleCTRatio(_ *transaction, values []uint16) *mbserver.Exception {
+	if values[0] < 1 || values[0] > 1000 {
+		in.log.Info(fmt.Sprintf("Rejected current transformer ratio as %d", values[0]))
+		return &mbserver.IllegalDataValue
+	}
+	in.log.Info(fmt.Sprintf("Configured current transformer ratio as %d", values[0]))
+	return nil
+}
@@ -1,76 +1,207 @@
 package modbus
 
 import (
-	stdlog "log"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"time"
 
-	"github.com/goburrow/modbus"
 	"github.com/goburrow/serial"
 	"github.com/pkg/errors"
-	"github.com/tbrandon/mbserver"
 
 	rtu "github.com/rancher/octopus-simulator/cmd/modbus/rtu/options"
+	snapshotopts "github.com/rancher/octopus-simulator/cmd/modbus/snapshot/options"
 	tcp "github.com/rancher/octopus-simulator/cmd/modbus/tcp/options"
 	"github.com/rancher/octopus-simulator/pkg/log"
-	"github.com/rancher/octopus-simulator/pkg/util/log/logflag"
 	"github.com/rancher/octopus-simulator/pkg/util/signals"
 )
 
 func RunAsRTU(opts *rtu.Options) error {
-	var s = mbserver.NewServer()
-
-	var (
-		cAddress = "/dev/ttyS001"
-		sAddress = "/dev/ttyS002"
-	)
-	if err := s.ListenRTU(&serial.Config{
-		Address:  sAddress,
-		BaudRate: opts.BaudRate,
-		DataBits: opts.DataBits,
-		StopBits: opts.StopBits,
-		Parity:   opts.Parity,
-	}); err != nil {
-		return errors.Wrap(err, "failed to start Modbus RTU server")
-	}
-	defer s.Close()
-	log.Info("Listening on " + sAddress)
+	if opts.ID < 1 || opts.ID > 247 {
+		return errors.Errorf("invalid slave ID %d, must be between 1 and 247", opts.ID)
+	}
+	var profiles = map[uint8]string{
+		opts.ID: opts.Device,
+	}
+	for idStr, profile := range opts.Slaves {
+		var id, err = strconv.ParseUint(idStr, 10, 8)
+		if err != nil || id < 1 || id > 247 {
+			return errors.Errorf("invalid slave ID %s, must be between 1 and 247", idStr)
+		}
+		if _, exist := profiles[uint8(id)]; exist {
+			return errors.Errorf("duplicate slave ID %d", id)
+		}
+		profiles[uint8(id)] = profile
+	}
 
-	var handler = modbus.NewRTUClientHandler(cAddress)
-	if logflag.GetLogVerbosity() > 4 {
-		handler.Logger = stdlog.New(os.Stdout, "modbus.client", stdlog.LstdFlags)
+	var stop = signals.SetupSignalHandler()
+	var b = make(bus, len(profiles))
+	var ds = make(devices, 0, len(profiles))
+	defer ds.Close()
+	for id, profile := range profiles {
+		var newDevice, exist = deviceFactories[profile]
+		if !exist {
+			return errors.Errorf("unknown device %s of slave %d", profile, id)
+		}
+		var sl = newSlave(id, newMemory())
+		b[id] = sl
+		ds = append(ds, newDevice(sl, stop))
 	}
-	handler.BaudRate = opts.BaudRate
-	handler.DataBits = opts.DataBits
-	handler.StopBits = opts.StopBits
-	handler.Parity = opts.Parity
-	handler.SlaveId = opts.ID
 
-	var t = mockThermometer(handler, signals.SetupSignalHandler())
-	defer t.Close()
+	var admin, err = prepareBus(b, opts.InitialState, opts.AdminAddress, nil)
+	if err != nil {
+		return err
+	}
+	if admin != nil {
+		defer admin.Close()
+	}
+
+	var port io.ReadWriteCloser
+	if opts.Port != "" {
+		var p, err = serial.Open(&serial.Config{
+			Address:  opts.Port,
+			BaudRate: opts.BaudRate,
+			DataBits: opts.DataBits,
+			StopBits: opts.StopBits,
+			Parity:   opts.Parity,
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to start Modbus RTU server")
+		}
+		port = p
+		log.Info("Listening on " + opts.Port)
+	} else {
+		var p, err = openPTY()
+		if err != nil {
+			return errors.Wrap(err, "failed to start Modbus RTU server")
+		}
+		port = p
+		if opts.Link != "" {
+			if err := p.Link(opts.Link); err != nil {
+				_ = p.Close()
+				return errors.Wrap(err, "failed to link the client side of pseudo terminal")
+			}
+			defer os.Remove(opts.Link)
+			log.Info("Listening on " + p.Name() + ", linked as " + opts.Link)
+		} else {
+			log.Info("Listening on " + p.Name())
+		}
+	}
+	defer port.Close()
 
-	return t.Mock(time.Duration(opts.Interval) * time.Second)
+	go func() {
+		if err := serveRTU(port, opts, b); err != nil {
+			log.Error(err, "Failed to serve Modbus RTU requests")
+		}
+	}()
+
+	return ds.Mock(time.Duration(opts.Interval) * time.Second)
 }
 
 func RunAsTCP(opts *tcp.Options) error {
-	var s = mbserver.NewServer()
+	var newDevice, exist = deviceFactories[opts.Device]
+	if !exist {
+		return errors.Errorf("unknown device %s", opts.Device)
+	}
+	if opts.GenerateCerts != "" && opts.TLSAddress == "" {
+		return errors.New("generate-certs requires tls-address to serve Modbus/TCP Security")
+	}
+	var sessions, err = newTCPSessions(opts)
+	if err != nil {
+		return err
+	}
+
+	var sl = newSlave(opts.ID, newMemory())
+	var d = newDevice(sl, signals.SetupSignalHandler())
+	defer d.Close()
+
+	admin, err := prepareBus(bus{opts.ID: sl}, opts.InitialState, opts.AdminAddress, sessions)
+	if err != nil {
+		return err
+	}
+	if admin != nil {
+		defer admin.Close()
+	}
 
 	var sAddress = "0.0.0.0:5020"
-	if err := s.ListenTCP(sAddress); err != nil {
+	listener, err := net.Listen("tcp", sAddress)
+	if err != nil {
 		return errors.Wrap(err, "failed to start Modbus TCP server")
 	}
-	defer s.Close()
+	defer listener.Close()
 	log.Info("Listening on " + sAddress)
 
-	var handler = modbus.NewTCPClientHandler(sAddress)
-	if logflag.GetLogVerbosity() > 4 {
-		handler.Logger = stdlog.New(os.Stdout, "modbus.client", stdlog.LstdFlags)
+	go func() {
+		if err := serveTCP(listener, sessions, sl); err != nil {
+			log.Error(err, "Failed to serve Modbus TCP requests")
+		}
+	}()
+
+	if opts.TLSAddress != "" {
+		var tlsConfig, err = newTLSConfig(opts)
+		if err != nil {
+			return err
+		}
+		tlsListener, err := tls.Listen("tcp", opts.TLSAddress, tlsConfig)
+		if err != nil {
+			return errors.Wrap(err, "failed to start Modbus/TCP Security server")
+		}
+		defer tlsListener.Close()
+		log.Info("Listening on " + opts.TLSAddress + " with TLS")
+
+		go func() {
+			if err := serveTCP(tlsListener, sessions, sl); err != nil {
+				log.Error(err, "Failed to serve Modbus/TCP Security requests")
+			}
+		}()
 	}
-	handler.SlaveId = opts.ID
-	defer handler.Close()
 
-	var t = mockThermometer(handler, signals.SetupSignalHandler())
-	defer t.Close()
+	return d.Mock(time.Duration(opts.Interval) * time.Second)
+}
+
+func DumpSnapshot(opts *snapshotopts.Options) error {
+	var ss, err = getSnapshot(opts.AdminAddress)
+	if err != nil {
+		return err
+	}
+	if err := saveSnapshot(opts.File, ss); err != nil {
+		return err
+	}
+	log.Info("Exported snapshot into " + opts.File)
+	return nil
+}
 
-	return t.Mock(time.Duration(opts.Interval) * time.Second)
+func RestoreSnapshot(opts *snapshotopts.Options) error {
+	var ss, err = loadSnapshot(opts.File)
+	if err != nil {
+		return err
+	}
+	if err := putSnapshot(opts.AdminAddress, ss); err != nil {
+		return err
+	}
+	log.Info("Restored snapshot from " + opts.File)
+	return nil
+}
+
+// prepareBus restores the initial state of the slaves if the snapshot is specified,
+// and then serves the admin endpoints if the address is specified.
+func prepareBus(b bus, initialState, adminAddress string, sessions http.Handler) (*http.Server, error) {
+	if initialState != "" {
+		var ss, err = loadSnapshot(initialState)
+		if err != nil {
+			return nil, err
+		}
+		if err := b.Restore(ss); err != nil {
+			return nil, errors.Wrap(err, "failed to restore initial state")
+		}
+		log.Info("Restored initial state from " + initialState)
+	}
+
+	if adminAddress == "" {
+		return nil, nil
+	}
+	return serveAdmin(adminAddress, b, sessions)
 }
@@ -0,0 +1,120 @@
+package modbus
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/tbrandon/mbserver"
+
+	"github.com/rancher/octopus-simulator/pkg/critical"
+	"github.com/rancher/octopus-simulator/pkg/log"
+)
+
+const (
+	plcIODigitalChannels = 16
+	plcIOAnalogChannels  = 8
+	plcIOAnalogMax       = 10000
+)
+
+func mockPLCIO(slave *slave, stop <-chan struct{}) *plcIO {
+	var ctx, ctxCancel = context.WithCancel(critical.Context(stop))
+
+	var in = &plcIO{
+		log:       log.WithName("plc_io").WithValues("slave", slave.id),
+		slave:     slave,
+		ctx:       ctx,
+		ctxCancel: ctxCancel,
+	}
+
+	// follows the digital outputs when writing coils register [0, 16)
+	slave.Handle(coilsTable, 0, plcIODigitalChannels, in.handleDigitalOutputs)
+	// follows the analog outputs when writing holding register [0, 8)
+	slave.Handle(holdingRegistersTable, 0, plcIOAnalogChannels, in.handleAnalogOutputs)
+	// reloads heartbeat after restoring
+	slave.HandleRestore(in.handleRestore)
+	return in
+}
+
+// plcIO is a PLC I/O block whose outputs are wired back to its inputs,
+// the discrete inputs follow the coils, and the input registers follow the holding registers.
+type plcIO struct {
+	log       logr.Logger
+	slave     *slave
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
+	// heartbeat is guarded by the lock of slave
+	heartbeat uint16
+}
+
+func (in *plcIO) Close() error {
+	if in.ctxCancel != nil {
+		in.ctxCancel()
+	}
+	return nil
+}
+
+func (in *plcIO) Mock(interval time.Duration) error {
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		in.slave.Update(func(tx *transaction) {
+			// the analog inputs are noisy
+			var analogInputs = in.readAnalog(tx.Get(holdingRegistersTable, 0, plcIOAnalogChannels))
+			tx.Set(inputRegistersTable, 0, analogInputs...)
+			in.log.Info(fmt.Sprintf("Mocked analog inputs as %v", analogInputs))
+
+			// blinks discrete input 16 and increases heartbeat input register 8
+			in.heartbeat++
+			tx.Set(discreteInputsTable, plcIODigitalChannels, in.heartbeat%2)
+			tx.Set(inputRegistersTable, plcIOAnalogChannels, in.heartbeat)
+			in.log.Info(fmt.Sprintf("Mocked heartbeat as %d", in.heartbeat))
+		})
+
+		select {
+		case <-in.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (in *plcIO) handleRestore(tx *transaction) {
+	in.heartbeat = tx.Get(inputRegistersTable, plcIOAnalogChannels, 1)[0]
+}
+
+func (in *plcIO) handleDigitalOutputs(tx *transaction, values []uint16) *mbserver.Exception {
+	tx.Set(discreteInputsTable, 0, values...)
+	in.log.Info(fmt.Sprintf("Configured digital outputs as %v", values))
+	return nil
+}
+
+func (in *plcIO) handleAnalogOutputs(tx *transaction, values []uint16) *mbserver.Exception {
+	for i, v := range values {
+		if v > plcIOAnalogMax {
+			in.log.Info(fmt.Sprintf("Rejected analog output %d as %d", i, v))
+			return &mbserver.IllegalDataValue
+		}
+	}
+	tx.Set(inputRegistersTable, 0, in.readAnalog(values)...)
+	in.log.Info(fmt.Sprintf("Configured analog outputs as %v", values))
+	return nil
+}
+
+// readAnalog returns the analog inputs wired to the outputs, with ±0.1% noise of the full scale.
+func (in *plcIO) readAnalog(outputs []uint16) []uint16 {
+	var inputs = make([]uint16, len(outputs))
+	for i, v := range outputs {
+		var noisy = int(v) + rand.Intn(21) - 10
+		if noisy < 0 {
+			noisy = 0
+		} else if noisy > plcIOAnalogMax {
+			noisy = plcIOAnalogMax
+		}
+		inputs[i] = uint16(noisy)
+	}
+	return inputs
+}
@@ -0,0 +1,260 @@
+package modbus
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	goburrow "github.com/goburrow/modbus"
+	"github.com/pkg/errors"
+
+	probe "github.com/rancher/octopus-simulator/cmd/modbus/probe/options"
+	"github.com/rancher/octopus-simulator/pkg/log"
+	"github.com/rancher/octopus-simulator/pkg/util/signals"
+)
+
+func ProbeRead(opts *probe.Options) error {
+	var t, err = parseTable(opts.Table)
+	if err != nil {
+		return err
+	}
+	var c = newRegisterCodec(t, opts.Type, opts.ByteOrder)
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	client, closer, err := newProbeClient(opts)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	var read = func() ([]string, error) {
+		var quantity = opts.Count * c.Size()
+		var data []byte
+		var err error
+		switch t {
+		case coilsTable:
+			data, err = client.ReadCoils(opts.Address, quantity)
+		case discreteInputsTable:
+			data, err = client.ReadDiscreteInputs(opts.Address, quantity)
+		case holdingRegistersTable:
+			data, err = client.ReadHoldingRegisters(opts.Address, quantity)
+		case inputRegistersTable:
+			data, err = client.ReadInputRegisters(opts.Address, quantity)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", opts.Table)
+		}
+		return c.Decode(data, opts.Count)
+	}
+
+	if opts.Watch <= 0 {
+		var values, err = read()
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			fmt.Printf("%s[%d] = %s\n", opts.Table, opts.Address+uint16(i)*c.Size(), v)
+		}
+		return nil
+	}
+
+	// prints the changed values only
+	var stop = signals.SetupSignalHandler()
+	var ticker = time.NewTicker(opts.Watch)
+	defer ticker.Stop()
+	var last []string
+	for {
+		var values, err = read()
+		if err != nil {
+			log.Error(err, "Failed to poll")
+		} else {
+			var now = time.Now().Format(time.RFC3339Nano)
+			for i, v := range values {
+				if last != nil && last[i] == v {
+					continue
+				}
+				fmt.Printf("%s %s[%d] = %s\n", now, opts.Table, opts.Address+uint16(i)*c.Size(), v)
+			}
+			last = values
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func ProbeWrite(opts *probe.Options) error {
+	var t, err = parseTable(opts.Table)
+	if err != nil {
+		return err
+	}
+	if t != coilsTable && t != holdingRegistersTable {
+		return errors.Errorf("%s are read-only", opts.Table)
+	}
+	if len(opts.Values) == 0 {
+		return errors.New("no values to write")
+	}
+	var c = newRegisterCodec(t, opts.Type, opts.ByteOrder)
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	data, quantity, err := c.Encode(opts.Values)
+	if err != nil {
+		return err
+	}
+
+	client, closer, err := newProbeClient(opts)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	switch {
+	case t == coilsTable && quantity == 1:
+		_, err = client.WriteSingleCoil(opts.Address, uint16(data[0])*0xFF00)
+	case t == coilsTable:
+		_, err = client.WriteMultipleCoils(opts.Address, quantity, data)
+	case quantity == 1:
+		_, err = client.WriteSingleRegister(opts.Address, uint16(data[0])<<8|uint16(data[1]))
+	default:
+		_, err = client.WriteMultipleRegisters(opts.Address, quantity, data)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s", opts.Table)
+	}
+	log.Info(fmt.Sprintf("Wrote %d %s from %d", quantity, opts.Table, opts.Address))
+	return nil
+}
+
+func parseTable(name string) (table, error) {
+	switch name {
+	case "coils":
+		return coilsTable, nil
+	case "discrete-inputs":
+		return discreteInputsTable, nil
+	case "holding-registers":
+		return holdingRegistersTable, nil
+	case "input-registers":
+		return inputRegistersTable, nil
+	}
+	return 0, errors.Errorf("unknown table %s", name)
+}
+
+// newProbeClient creates the client of the protocol, the returned closer disconnects the server.
+func newProbeClient(opts *probe.Options) (goburrow.Client, io.Closer, error) {
+	switch opts.Protocol {
+	case "tcp":
+		var handler = goburrow.NewTCPClientHandler(opts.Server)
+		handler.SlaveId = opts.SlaveID
+		handler.Timeout = opts.Timeout
+		return goburrow.NewClient(handler), handler, nil
+	case "rtu":
+		var handler = goburrow.NewRTUClientHandler(opts.Server)
+		handler.SlaveId = opts.SlaveID
+		handler.Timeout = opts.Timeout
+		handler.BaudRate = opts.BaudRate
+		handler.DataBits = opts.DataBits
+		handler.StopBits = opts.StopBits
+		handler.Parity = strings.ToUpper(opts.Parity)
+		return goburrow.NewClient(handler), handler, nil
+	case "ascii":
+		var handler = goburrow.NewASCIIClientHandler(opts.Server)
+		handler.SlaveId = opts.SlaveID
+		handler.Timeout = opts.Timeout
+		handler.BaudRate = opts.BaudRate
+		handler.DataBits = opts.DataBits
+		handler.StopBits = opts.StopBits
+		handler.Parity = strings.ToUpper(opts.Parity)
+		return goburrow.NewClient(handler), handler, nil
+	case "rtu-over-tcp":
+		// reuses the RTU framing, and transports the frames over TCP
+		var packager = goburrow.NewRTUClientHandler("")
+		packager.SlaveId = opts.SlaveID
+		var transporter = &rtuOverTCPTransporter{
+			address: opts.Server,
+			timeout: opts.Timeout,
+		}
+		return goburrow.NewClient2(packager, transporter), transporter, nil
+	}
+	return nil, nil, errors.Errorf("unknown protocol %s", opts.Protocol)
+}
+
+// rtuOverTCPTransporter sends the RTU frames over a TCP connection,
+// the response length is inferred from the function code as there is no header.
+type rtuOverTCPTransporter struct {
+	sync.Mutex
+	address string
+	timeout time.Duration
+	conn    net.Conn
+}
+
+func (t *rtuOverTCPTransporter) Send(aduRequest []byte) ([]byte, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.conn == nil {
+		var conn, err = net.DialTimeout("tcp", t.address, t.timeout)
+		if err != nil {
+			return nil, err
+		}
+		t.conn = conn
+	}
+	var aduResponse, err = t.send(aduRequest)
+	if err != nil {
+		// reconnects next time, the stale bytes of the broken exchange must not be read as the next response
+		_ = t.conn.Close()
+		t.conn = nil
+	}
+	return aduResponse, err
+}
+
+func (t *rtuOverTCPTransporter) send(aduRequest []byte) ([]byte, error) {
+	if t.timeout > 0 {
+		if err := t.conn.SetDeadline(time.Now().Add(t.timeout)); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := t.conn.Write(aduRequest); err != nil {
+		return nil, err
+	}
+
+	// slave address + function code + byte count or exception code
+	var aduResponse = make([]byte, 3, 256)
+	if _, err := io.ReadFull(t.conn, aduResponse); err != nil {
+		return nil, err
+	}
+	var length int
+	switch function := aduResponse[1]; {
+	case function&0x80 != 0:
+		length = 5
+	case function >= 1 && function <= 4:
+		length = 5 + int(aduResponse[2])
+	default:
+		length = 8
+	}
+	aduResponse = aduResponse[:length]
+	if _, err := io.ReadFull(t.conn, aduResponse[3:]); err != nil {
+		return nil, err
+	}
+	return aduResponse, nil
+}
+
+func (t *rtuOverTCPTransporter) Close() error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.conn == nil {
+		return nil
+	}
+	var err = t.conn.Close()
+	t.conn = nil
+	return err
+}
@@ -0,0 +1,53 @@
+package modbus
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// pty is a pair of pseudo terminals,
+// the master side is served by the simulator and the slave side is opened by the Modbus master, e.g. the adaptor.
+type pty struct {
+	ptm  *os.File
+	pts  *os.File
+	name string
+}
+
+func (p *pty) Read(b []byte) (int, error) {
+	return p.ptm.Read(b)
+}
+
+func (p *pty) Write(b []byte) (int, error) {
+	return p.ptm.Write(b)
+}
+
+func (p *pty) Close() error {
+	// keeps the slave side opening until closing,
+	// otherwise reading the master side gets EIO after the Modbus master closes the device
+	if p.pts != nil {
+		_ = p.pts.Close()
+	}
+	if p.ptm != nil {
+		return p.ptm.Close()
+	}
+	return nil
+}
+
+// Name returns the device path of the slave side.
+func (p *pty) Name() string {
+	return p.name
+}
+
+// Link creates a symbolic link to the slave side, the stale link is replaced.
+func (p *pty) Link(link string) error {
+	if fi, err := os.Lstat(link); err == nil {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return errors.Errorf("%s is existing but not a symbolic link", link)
+		}
+		if err := os.Remove(link); err != nil {
+			return errors.Wrapf(err, "failed to remove stale link %s", link)
+		}
+	}
+	return os.Symlink(p.name, link)
+}
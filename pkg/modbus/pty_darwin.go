@@ -0,0 +1,76 @@
+package modbus
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+func openPTY() (p *pty, err error) {
+	ptm, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open pseudo terminal master")
+	}
+	defer func() {
+		if err != nil {
+			_ = ptm.Close()
+		}
+	}()
+
+	// grants and unlocks the slave side
+	if err := ioctl(ptm.Fd(), unix.TIOCPTYGRANT, 0); err != nil {
+		return nil, errors.Wrap(err, "failed to grant pseudo terminal slave")
+	}
+	if err := ioctl(ptm.Fd(), unix.TIOCPTYUNLK, 0); err != nil {
+		return nil, errors.Wrap(err, "failed to unlock pseudo terminal slave")
+	}
+	var nameBytes = make([]byte, 128)
+	if err := ioctl(ptm.Fd(), unix.TIOCPTYGNAME, uintptr(unsafe.Pointer(&nameBytes[0]))); err != nil {
+		return nil, errors.Wrap(err, "failed to get pseudo terminal slave name")
+	}
+	var name = string(nameBytes[:bytes.IndexByte(nameBytes, 0)])
+
+	pts, err := os.OpenFile(name, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open pseudo terminal slave %s", name)
+	}
+	defer func() {
+		if err != nil {
+			_ = pts.Close()
+		}
+	}()
+
+	// makes raw, the same as cfmakeraw
+	t, err := unix.IoctlGetTermios(int(pts.Fd()), unix.TIOCGETA)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get pseudo terminal attributes")
+	}
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB
+	t.Cflag |= unix.CS8
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(int(pts.Fd()), unix.TIOCSETA, t); err != nil {
+		return nil, errors.Wrap(err, "failed to set pseudo terminal attributes")
+	}
+
+	return &pty{
+		ptm:  ptm,
+		pts:  pts,
+		name: name,
+	}, nil
+}
+
+func ioctl(fd uintptr, req uint, arg uintptr) error {
+	var _, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(req), arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package modbus
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+func openPTY() (p *pty, err error) {
+	ptm, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open pseudo terminal master")
+	}
+	defer func() {
+		if err != nil {
+			_ = ptm.Close()
+		}
+	}()
+
+	// unlocks the slave side
+	if err := unix.IoctlSetPointerInt(int(ptm.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		return nil, errors.Wrap(err, "failed to unlock pseudo terminal slave")
+	}
+	n, err := unix.IoctlGetUint32(int(ptm.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get pseudo terminal slave number")
+	}
+	var name = fmt.Sprintf("/dev/pts/%d", n)
+
+	pts, err := os.OpenFile(name, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open pseudo terminal slave %s", name)
+	}
+	defer func() {
+		if err != nil {
+			_ = pts.Close()
+		}
+	}()
+
+	// makes raw, the same as cfmakeraw
+	t, err := unix.IoctlGetTermios(int(pts.Fd()), unix.TCGETS)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get pseudo terminal attributes")
+	}
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB
+	t.Cflag |= unix.CS8
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(int(pts.Fd()), unix.TCSETS, t); err != nil {
+		return nil, errors.Wrap(err, "failed to set pseudo terminal attributes")
+	}
+
+	return &pty{
+		ptm:  ptm,
+		pts:  pts,
+		name: name,
+	}, nil
+}
@@ -0,0 +1,182 @@
+package modbus
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tbrandon/mbserver"
+
+	rtu "github.com/rancher/octopus-simulator/cmd/modbus/rtu/options"
+	"github.com/rancher/octopus-simulator/pkg/log"
+)
+
+// serveRTU serves the RTU requests addressed to the slaves on the bus until the port is closed,
+// the frames are delimited by the silent interval of 3.5 characters at the configured baud rate.
+func serveRTU(port io.ReadWriter, opts *rtu.Options, b bus) error {
+	var line = newRTULine(port, opts)
+
+	var chunks = make(chan []byte)
+	var readErr = make(chan error, 1)
+	var done = make(chan struct{})
+	defer close(done)
+	go func() {
+		var buffer = make([]byte, 512)
+		for {
+			var n, err = port.Read(buffer)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if n == 0 {
+				continue
+			}
+			var chunk = make([]byte, n)
+			copy(chunk, buffer[:n])
+			select {
+			case chunks <- chunk:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var packet []byte
+	var silence = time.NewTimer(line.silentInterval)
+	silence.Stop()
+	for {
+		select {
+		case chunk := <-chunks:
+			packet = append(packet, chunk...)
+			if !silence.Stop() {
+				select {
+				case <-silence.C:
+				default:
+				}
+			}
+			silence.Reset(line.silentInterval)
+			continue
+		case err := <-readErr:
+			if err == io.EOF || isClosed(err) {
+				return nil
+			}
+			return errors.Wrap(err, "failed to read from serial port")
+		case <-silence.C:
+		}
+
+		// the frame is completed after the silent interval
+		var request, err = mbserver.NewRTUFrame(packet)
+		packet = nil
+		if err != nil {
+			log.Error(err, "Dropped bad RTU frame")
+			continue
+		}
+
+		// applies the broadcast writes to all slaves without responding
+		if request.Address == 0 {
+			if isWriteFunction(request.Function) {
+				for _, s := range b {
+					_ = s.Serve(request)
+				}
+			}
+			continue
+		}
+
+		// the absent slaves don't respond
+		var s, exist = b[request.Address]
+		if !exist {
+			continue
+		}
+		var response = s.Serve(request)
+		if err := line.Respond(response.Bytes()); err != nil {
+			return errors.Wrap(err, "failed to write to serial port")
+		}
+	}
+}
+
+// rtuLine simulates the timing and the noise of the serial line.
+type rtuLine struct {
+	port           io.Writer
+	silentInterval time.Duration
+	latency        time.Duration
+	crcErrorRate   float64
+	dropRate       float64
+	garbageRate    float64
+}
+
+func newRTULine(port io.Writer, opts *rtu.Options) *rtuLine {
+	return &rtuLine{
+		port:           port,
+		silentInterval: silentInterval(opts),
+		latency:        opts.Latency,
+		crcErrorRate:   opts.CRCErrorRate,
+		dropRate:       opts.DropRate,
+		garbageRate:    opts.GarbageRate,
+	}
+}
+
+// Respond writes the response after the latency, the faults are injected according to the configured rates.
+func (l *rtuLine) Respond(adu []byte) error {
+	time.Sleep(l.latency)
+
+	if hit(l.garbageRate) {
+		var garbage = make([]byte, rand.Intn(8)+1)
+		_, _ = rand.Read(garbage)
+		log.Info(fmt.Sprintf("Injected garbage bytes %v", garbage))
+		if _, err := l.port.Write(garbage); err != nil {
+			return err
+		}
+		time.Sleep(l.silentInterval)
+	}
+
+	if hit(l.crcErrorRate) {
+		adu[len(adu)-1] ^= 0xFF
+		log.Info("Injected CRC error")
+	}
+	if hit(l.dropRate) {
+		var idx = rand.Intn(len(adu))
+		adu = append(adu[:idx], adu[idx+1:]...)
+		log.Info(fmt.Sprintf("Injected byte drop at %d", idx))
+	}
+
+	var _, err = l.port.Write(adu)
+	return err
+}
+
+// silentInterval returns the duration of 3.5 characters at the baud rate,
+// which is fixed to 1.75ms when the baud rate is greater than 19200.
+func silentInterval(opts *rtu.Options) time.Duration {
+	if opts.BaudRate <= 0 || opts.BaudRate > 19200 {
+		return 1750 * time.Microsecond
+	}
+
+	// start bit + data bits + parity bit + stop bits
+	var bits = 1 + opts.DataBits + opts.StopBits
+	if parity := strings.ToUpper(opts.Parity); parity != "N" && parity != "NONE" {
+		bits++
+	}
+	return time.Duration(float64(bits) * 3.5 * float64(time.Second) / float64(opts.BaudRate))
+}
+
+func isWriteFunction(code uint8) bool {
+	switch code {
+	case 5, 6, 15, 16:
+		return true
+	}
+	return false
+}
+
+func hit(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+func isClosed(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == os.ErrClosed
+	}
+	return false
+}
@@ -0,0 +1,278 @@
+package modbus
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/tbrandon/mbserver"
+
+	rtu "github.com/rancher/octopus-simulator/cmd/modbus/rtu/options"
+)
+
+// the frames of reading the holding register 0 and its value 0x1234, with the CRC in little endian.
+var (
+	readRegisterRequest  = []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0a}
+	readRegisterResponse = []byte{0x01, 0x03, 0x02, 0x12, 0x34, 0xb5, 0x33}
+)
+
+// rtuPort reads the requests written by the test, and writes the responses read by the test.
+type rtuPort struct {
+	io.Reader
+	io.Writer
+}
+
+type rtuHarness struct {
+	requests  *io.PipeWriter
+	responses chan []byte
+	served    chan error
+}
+
+// serveTestRTU serves the bus on the pipes until the harness is closed.
+func serveTestRTU(opts *rtu.Options, b bus) *rtuHarness {
+	var reqR, reqW = io.Pipe()
+	var respR, respW = io.Pipe()
+	var h = &rtuHarness{
+		requests:  reqW,
+		responses: make(chan []byte, 16),
+		served:    make(chan error, 1),
+	}
+	go func() {
+		h.served <- serveRTU(rtuPort{Reader: reqR, Writer: respW}, opts, b)
+		_ = respW.Close()
+	}()
+	go func() {
+		defer close(h.responses)
+		var buffer = make([]byte, 256)
+		for {
+			var n, err = respR.Read(buffer)
+			if err != nil {
+				return
+			}
+			h.responses <- append([]byte(nil), buffer[:n]...)
+		}
+	}()
+	return h
+}
+
+func (h *rtuHarness) write(t *testing.T, chunks ...[]byte) {
+	for _, chunk := range chunks {
+		if _, err := h.requests.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (h *rtuHarness) expect(t *testing.T, expected []byte) {
+	select {
+	case actual := <-h.responses:
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("expected response % x, but got % x", expected, actual)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected response % x, but got nothing", expected)
+	}
+}
+
+func (h *rtuHarness) expectNothing(t *testing.T) {
+	select {
+	case actual := <-h.responses:
+		t.Errorf("expected no response, but got % x", actual)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func (h *rtuHarness) close(t *testing.T) {
+	_ = h.requests.Close()
+	if err := <-h.served; err != nil {
+		t.Errorf("expected serving ends without error, but got %v", err)
+	}
+}
+
+func newRegisterSlave(id uint8, value uint16) *slave {
+	var s = newSlave(id, newMemory())
+	s.Update(func(tx *transaction) {
+		tx.Set(holdingRegistersTable, 0, value)
+	})
+	return s
+}
+
+func TestRTUFrameCRC(t *testing.T) {
+	// the well-known example of reading 10 holding registers from the slave 1
+	if _, err := mbserver.NewRTUFrame([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0a, 0xc5, 0xcd}); err != nil {
+		t.Errorf("expected valid CRC, but got %v", err)
+	}
+	if _, err := mbserver.NewRTUFrame([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0a, 0xcd, 0xc5}); err == nil {
+		t.Error("expected error of the swapped CRC bytes")
+	}
+
+	var frame, err = mbserver.NewRTUFrame(readRegisterRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response = newRegisterSlave(1, 0x1234).Serve(frame)
+	if actual := response.Bytes(); !bytes.Equal(actual, readRegisterResponse) {
+		t.Errorf("expected response % x, but got % x", readRegisterResponse, actual)
+	}
+}
+
+func TestServeRTUFraming(t *testing.T) {
+	// the silent interval is about 32ms at 1200 baud, which tolerates the scheduling of the test
+	var h = serveTestRTU(&rtu.Options{BaudRate: 1200, DataBits: 8, StopBits: 1, Parity: "E"}, bus{1: newRegisterSlave(1, 0x1234)})
+	defer h.close(t)
+
+	// the chunks within the silent interval are assembled into one frame
+	h.write(t, readRegisterRequest[:3], readRegisterRequest[3:])
+	h.expect(t, readRegisterResponse)
+
+	// the bad CRC is dropped, and the line recovers on the next frame
+	var corrupted = append([]byte(nil), readRegisterRequest...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	h.write(t, corrupted)
+	h.expectNothing(t)
+	h.write(t, readRegisterRequest)
+	h.expect(t, readRegisterResponse)
+
+	// the frames without the silent interval between them are merged and dropped as a whole
+	h.write(t, append(append([]byte(nil), readRegisterRequest...), readRegisterRequest...))
+	h.expectNothing(t)
+
+	// the frame shorter than 5 bytes is dropped
+	h.write(t, readRegisterRequest[:4])
+	h.expectNothing(t)
+}
+
+func TestServeRTUSlaves(t *testing.T) {
+	var h = serveTestRTU(&rtu.Options{BaudRate: 1200, DataBits: 8, StopBits: 1, Parity: "E"}, bus{
+		1: newRegisterSlave(1, 0x1234),
+		2: newRegisterSlave(2, 0x1234),
+	})
+	defer h.close(t)
+
+	// each slave answers the frames addressed to it
+	h.write(t, []byte{0x02, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x39})
+	h.expect(t, []byte{0x02, 0x03, 0x02, 0x12, 0x34, 0xf1, 0x33})
+
+	// the absent slave doesn't respond
+	h.write(t, (&mbserver.RTUFrame{Address: 3, Function: 3, Data: []byte{0x00, 0x00, 0x00, 0x01}}).Bytes())
+	h.expectNothing(t)
+
+	// the broadcast write is applied to all slaves without responding
+	h.write(t, []byte{0x00, 0x06, 0x00, 0x00, 0x56, 0x78, 0xb7, 0x99})
+	h.expectNothing(t)
+	h.write(t, readRegisterRequest)
+	h.expect(t, []byte{0x01, 0x03, 0x02, 0x56, 0x78, 0x87, 0xc6})
+	h.write(t, []byte{0x02, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x39})
+	h.expect(t, []byte{0x02, 0x03, 0x02, 0x56, 0x78, 0xc3, 0xc6})
+
+	// the broadcast read is ignored
+	h.write(t, (&mbserver.RTUFrame{Address: 0, Function: 3, Data: []byte{0x00, 0x00, 0x00, 0x01}}).Bytes())
+	h.expectNothing(t)
+}
+
+func TestRTULineFaults(t *testing.T) {
+	var testCases = []struct {
+		name   string
+		line   rtuLine
+		verify func(t *testing.T, written []byte)
+	}{
+		{
+			name: "clean",
+			verify: func(t *testing.T, written []byte) {
+				if !bytes.Equal(written, readRegisterResponse) {
+					t.Errorf("expected % x, but got % x", readRegisterResponse, written)
+				}
+			},
+		},
+		{
+			name: "crc error",
+			line: rtuLine{crcErrorRate: 1},
+			verify: func(t *testing.T, written []byte) {
+				if len(written) != len(readRegisterResponse) {
+					t.Fatalf("expected %d bytes, but got % x", len(readRegisterResponse), written)
+				}
+				if _, err := mbserver.NewRTUFrame(written); err == nil {
+					t.Errorf("expected bad CRC, but got % x", written)
+				}
+			},
+		},
+		{
+			name: "drop",
+			line: rtuLine{dropRate: 1},
+			verify: func(t *testing.T, written []byte) {
+				if len(written) != len(readRegisterResponse)-1 {
+					t.Errorf("expected %d bytes, but got % x", len(readRegisterResponse)-1, written)
+				}
+			},
+		},
+		{
+			name: "garbage",
+			line: rtuLine{garbageRate: 1},
+			verify: func(t *testing.T, written []byte) {
+				var garbage = len(written) - len(readRegisterResponse)
+				if garbage < 1 || garbage > 8 || !bytes.HasSuffix(written, readRegisterResponse) {
+					t.Errorf("expected 1 to 8 garbage bytes ahead of % x, but got % x", readRegisterResponse, written)
+				}
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var port bytes.Buffer
+			var line = tc.line
+			line.port = &port
+			if err := line.Respond(append([]byte(nil), readRegisterResponse...)); err != nil {
+				t.Fatal(err)
+			}
+			tc.verify(t, port.Bytes())
+		})
+	}
+}
+
+func TestSilentInterval(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		opts     rtu.Options
+		expected time.Duration
+	}{
+		{name: "fixed above 19200", opts: rtu.Options{BaudRate: 115200, DataBits: 8, StopBits: 1, Parity: "E"}, expected: 1750 * time.Microsecond},
+		{name: "fixed without baud rate", opts: rtu.Options{}, expected: 1750 * time.Microsecond},
+		{name: "9600 8E1", opts: rtu.Options{BaudRate: 9600, DataBits: 8, StopBits: 1, Parity: "E"}, expected: 4010416 * time.Nanosecond},
+		{name: "9600 8N2", opts: rtu.Options{BaudRate: 9600, DataBits: 8, StopBits: 2, Parity: "N"}, expected: 4010416 * time.Nanosecond},
+		{name: "9600 7O1", opts: rtu.Options{BaudRate: 9600, DataBits: 7, StopBits: 1, Parity: "O"}, expected: 3645833 * time.Nanosecond},
+		{name: "19200 8N1", opts: rtu.Options{BaudRate: 19200, DataBits: 8, StopBits: 1, Parity: "none"}, expected: 1822916 * time.Nanosecond},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := silentInterval(&tc.opts); actual != tc.expected {
+				t.Errorf("expected %v, but got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRunAsRTUInvalidSlaves(t *testing.T) {
+	var testCases = []struct {
+		name   string
+		id     uint8
+		slaves map[string]string
+	}{
+		{name: "broadcast primary", id: 0},
+		{name: "reserved primary", id: 248},
+		{name: "broadcast slave", id: 1, slaves: map[string]string{"0": "vfd"}},
+		{name: "duplicate of primary", id: 1, slaves: map[string]string{"1": "vfd"}},
+		{name: "duplicate slaves", id: 1, slaves: map[string]string{"2": "vfd", "02": "energy-meter"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var opts = rtu.Options{ID: tc.id, Device: "thermometer", Slaves: tc.slaves}
+			if err := RunAsRTU(&opts); err == nil {
+				t.Error("expected error of the slave IDs")
+			}
+		})
+	}
+}
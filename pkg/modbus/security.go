@@ -0,0 +1,138 @@
+package modbus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	tcp "github.com/rancher/octopus-simulator/cmd/modbus/tcp/options"
+	"github.com/rancher/octopus-simulator/pkg/log"
+	"github.com/rancher/octopus-simulator/pkg/util/certs"
+)
+
+// roleOID is the X.509v3 extension of the client certificate to carry the role, defined by Modbus/TCP Security.
+var roleOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 50316, 802, 1}
+
+// permission indicates the function codes allowed for a role.
+type permission uint8
+
+const (
+	readPermission permission = 1 << iota
+	writePermission
+
+	fullPermission = readPermission | writePermission
+)
+
+func parsePermission(s string) (permission, error) {
+	switch s {
+	case "read":
+		return readPermission, nil
+	case "write":
+		return writePermission, nil
+	case "read-write":
+		return fullPermission, nil
+	}
+	return 0, errors.Errorf("unknown permission %s, select from [read, write, read-write]", s)
+}
+
+// Allows returns true if the function code is allowed,
+// the read functions require read permission, and the others require write permission.
+func (p permission) Allows(function uint8) bool {
+	switch function {
+	case 1, 2, 3, 4:
+		return p&readPermission != 0
+	}
+	return p&writePermission != 0
+}
+
+func parseRoles(roles map[string]string) (map[string]permission, error) {
+	var ret = make(map[string]permission, len(roles))
+	for role, s := range roles {
+		var p, err = parsePermission(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid permission of role %s", role)
+		}
+		ret[role] = p
+	}
+	return ret, nil
+}
+
+// roleOf returns the role carried by the client certificate, or blank if absent.
+func roleOf(cert *x509.Certificate) (string, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(roleOID) {
+			continue
+		}
+		var role string
+		var rest, err = asn1.Unmarshal(ext.Value, &role)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to unmarshal role extension")
+		}
+		if len(rest) != 0 {
+			return "", errors.Errorf("failed to unmarshal role extension: %d trailing bytes", len(rest))
+		}
+		return role, nil
+	}
+	return "", nil
+}
+
+// newTLSConfig creates the TLS configuration which requires the client certificates signed by the client CA,
+// the throwaway certificates are generated and used if the directory to generate is specified.
+func newTLSConfig(opts *tcp.Options) (*tls.Config, error) {
+	var certFile, keyFile, clientCAFile = opts.TLSCertFile, opts.TLSKeyFile, opts.TLSClientCAFile
+	if opts.GenerateCerts != "" {
+		if err := generateCerts(opts.GenerateCerts, opts.Roles); err != nil {
+			return nil, err
+		}
+		certFile = filepath.Join(opts.GenerateCerts, "server.pem")
+		keyFile = filepath.Join(opts.GenerateCerts, "server-key.pem")
+		clientCAFile = filepath.Join(opts.GenerateCerts, "ca.pem")
+	}
+	if certFile == "" || keyFile == "" || clientCAFile == "" {
+		return nil, errors.New("server certificate, key and client CA are required to serve Modbus/TCP Security")
+	}
+
+	var cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load server certificate")
+	}
+	caPEM, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read client CA")
+	}
+	var clientCAs = x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, errors.Errorf("failed to parse client CA %s", clientCAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		// Modbus/TCP Security requires TLS 1.2 at least
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// generateCerts creates a throwaway CA and the certificates signed by it into the directory:
+// server.pem for the listener, client.pem without role, and client-<role>.pem for each role.
+func generateCerts(dir string, roles map[string]string) error {
+	var clients = make(map[string][]pkix.Extension, len(roles))
+	for role := range roles {
+		var value, err = asn1.MarshalWithParams(role, "utf8")
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal role %s", role)
+		}
+		clients[role] = []pkix.Extension{{Id: roleOID, Value: value}}
+	}
+	if err := certs.Generate(dir, certs.Hosts(), clients); err != nil {
+		return err
+	}
+	log.Info(fmt.Sprintf("Generated throwaway certificates into %s", dir))
+	return nil
+}
@@ -0,0 +1,149 @@
+package modbus
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher/octopus-simulator/pkg/util/certs"
+)
+
+func TestRoleOf(t *testing.T) {
+	var ca, err = certs.NewCA("test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var utf8Role, _ = asn1.MarshalWithParams("operator", "utf8")
+	var printableRole, _ = asn1.Marshal("viewer")
+
+	var testCases = []struct {
+		name       string
+		extensions []pkix.Extension
+		expected   string
+		expectErr  bool
+	}{
+		{
+			name: "without role",
+		},
+		{
+			name:       "utf8 string",
+			extensions: []pkix.Extension{{Id: roleOID, Value: utf8Role}},
+			expected:   "operator",
+		},
+		{
+			name:       "printable string",
+			extensions: []pkix.Extension{{Id: roleOID, Value: printableRole}},
+			expected:   "viewer",
+		},
+		{
+			name:       "other extension",
+			extensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 50316, 802, 2}, Value: utf8Role}},
+		},
+		{
+			name:       "octet string",
+			extensions: []pkix.Extension{{Id: roleOID, Value: []byte{0x04, 0x02, 0x6f, 0x70}}},
+			expectErr:  true,
+		},
+		{
+			name:       "trailing bytes",
+			extensions: []pkix.Extension{{Id: roleOID, Value: append(append([]byte(nil), utf8Role...), 0x00)}},
+			expectErr:  true,
+		},
+		{
+			name:       "truncated",
+			extensions: []pkix.Extension{{Id: roleOID, Value: utf8Role[:len(utf8Role)-1]}},
+			expectErr:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var client, err = ca.IssueClient("test-client", tc.extensions...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			role, err := roleOf(client.Cert)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("expected error, but got role %q", role)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if role != tc.expected {
+				t.Errorf("expected role %q, but got %q", tc.expected, role)
+			}
+		})
+	}
+}
+
+func TestGenerateCertsRoles(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := generateCerts(dir, map[string]string{"operator": "read-write", "viewer": "read"}); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"client": "", "client-operator": "operator", "client-viewer": "viewer"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name+".pem"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var block, _ = pem.Decode(data)
+		if block == nil {
+			t.Fatalf("expected PEM certificate of %s", name)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		role, err := roleOf(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if role != expected {
+			t.Errorf("expected role %q of %s, but got %q", expected, name, role)
+		}
+	}
+}
+
+func TestPermissionAllows(t *testing.T) {
+	var testCases = []struct {
+		permission string
+		// expected is whether the read (3) and the write (6, 16) functions are allowed
+		read, write bool
+	}{
+		{permission: "read", read: true},
+		{permission: "write", write: true},
+		{permission: "read-write", read: true, write: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.permission, func(t *testing.T) {
+			var p, err = parsePermission(tc.permission)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Allows(3) != tc.read {
+				t.Errorf("expected reading allowed %v", tc.read)
+			}
+			if p.Allows(6) != tc.write || p.Allows(16) != tc.write {
+				t.Errorf("expected writing allowed %v", tc.write)
+			}
+		})
+	}
+
+	if _, err := parsePermission("admin"); err == nil {
+		t.Error("expected error of the unknown permission")
+	}
+}
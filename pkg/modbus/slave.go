@@ -0,0 +1,329 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// table indicates the kind of the data model of Modbus.
+type table uint8
+
+const (
+	coilsTable table = iota
+	discreteInputsTable
+	holdingRegistersTable
+	inputRegistersTable
+)
+
+// writeHandler is called synchronously before a write request touching the watched range is committed,
+// the values are the whole watched range as it would be after the request, coils are represented as 0 or 1.
+// Returning an exception rejects the request without changing anything,
+// otherwise the changes staged in the transaction are committed together with the request.
+type writeHandler func(tx *transaction, values []uint16) *mbserver.Exception
+
+type writeHandlerRegistration struct {
+	address  uint16
+	quantity uint16
+	handler  writeHandler
+}
+
+func (r writeHandlerRegistration) overlaps(address uint16, quantity int) bool {
+	return int(address) < int(r.address)+int(r.quantity) && int(r.address) < int(address)+quantity
+}
+
+// restoreHandler is called synchronously after the register space is restored from a snapshot,
+// it reloads the internal state of the device model from the restored points,
+// the changes staged in the transaction are discarded, so that the restored points stay as they were captured.
+type restoreHandler func(tx *transaction)
+
+// slave is the register space of a Modbus unit, the requests and the updates from the device model are serialized,
+// so that the device model can change its points atomically.
+type slave struct {
+	sync.Mutex
+	id        uint8
+	memory    *mbserver.Server
+	handlers  map[table][]writeHandlerRegistration
+	restorers []restoreHandler
+	functions [256]function
+}
+
+// function is the same as the function handler of mbserver.
+type function func(*mbserver.Server, mbserver.Framer) ([]byte, *mbserver.Exception)
+
+func newSlave(id uint8, memory *mbserver.Server) *slave {
+	var s = &slave{
+		id:       id,
+		memory:   memory,
+		handlers: make(map[table][]writeHandlerRegistration),
+	}
+	s.functions[1] = s.read(mbserver.ReadCoils)
+	s.functions[2] = s.read(mbserver.ReadDiscreteInputs)
+	s.functions[3] = s.read(mbserver.ReadHoldingRegisters)
+	s.functions[4] = s.read(mbserver.ReadInputRegisters)
+	s.functions[5] = s.writeSingleCoil
+	s.functions[6] = s.writeHoldingRegister
+	s.functions[15] = s.writeMultipleCoils
+	s.functions[16] = s.writeHoldingRegisters
+	return s
+}
+
+// Handle registers the handler to be called when the range [address, address+quantity) of the table is written.
+func (s *slave) Handle(t table, address, quantity uint16, handler writeHandler) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.handlers[t] = append(s.handlers[t], writeHandlerRegistration{
+		address:  address,
+		quantity: quantity,
+		handler:  handler,
+	})
+}
+
+// HandleRestore registers the handler to be called after the register space is restored from a snapshot.
+func (s *slave) HandleRestore(handler restoreHandler) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.restorers = append(s.restorers, handler)
+}
+
+// Update changes the points within the transaction atomically, the write handlers are not triggered.
+func (s *slave) Update(fn func(tx *transaction)) {
+	s.Lock()
+	defer s.Unlock()
+
+	var tx = &transaction{slave: s}
+	fn(tx)
+	tx.commit()
+}
+
+// Serve handles the request frame and returns the response frame.
+func (s *slave) Serve(request mbserver.Framer) mbserver.Framer {
+	var response = request.Copy()
+
+	var exception *mbserver.Exception
+	if fn := s.functions[request.GetFunction()]; fn != nil {
+		var data []byte
+		data, exception = fn(s.memory, request)
+		response.SetData(data)
+	} else {
+		exception = &mbserver.IllegalFunction
+	}
+	if *exception != mbserver.Success {
+		response.SetException(exception)
+	}
+	return response
+}
+
+func (s *slave) read(fn function) function {
+	return func(_ *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+		if len(frame.GetData()) < 4 {
+			return []byte{}, &mbserver.IllegalDataValue
+		}
+
+		s.Lock()
+		defer s.Unlock()
+		return fn(s.memory, frame)
+	}
+}
+
+func (s *slave) writeSingleCoil(_ *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	var data = frame.GetData()
+	if len(data) < 4 {
+		return []byte{}, &mbserver.IllegalDataValue
+	}
+
+	var address = binary.BigEndian.Uint16(data[0:2])
+	var value uint16
+	if binary.BigEndian.Uint16(data[2:4]) != 0 {
+		value = 1
+	}
+	return data[0:4], s.write(coilsTable, address, []uint16{value})
+}
+
+func (s *slave) writeHoldingRegister(_ *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	var data = frame.GetData()
+	if len(data) < 4 {
+		return []byte{}, &mbserver.IllegalDataValue
+	}
+
+	var address = binary.BigEndian.Uint16(data[0:2])
+	var value = binary.BigEndian.Uint16(data[2:4])
+	return data[0:4], s.write(holdingRegistersTable, address, []uint16{value})
+}
+
+func (s *slave) writeMultipleCoils(_ *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	var data = frame.GetData()
+	if len(data) < 5 {
+		return []byte{}, &mbserver.IllegalDataValue
+	}
+
+	var address = binary.BigEndian.Uint16(data[0:2])
+	var quantity = int(binary.BigEndian.Uint16(data[2:4]))
+	var valueBytes = data[5:]
+	if quantity == 0 || len(valueBytes) < (quantity+7)/8 {
+		return []byte{}, &mbserver.IllegalDataValue
+	}
+
+	var values = make([]uint16, quantity)
+	for i := range values {
+		values[i] = uint16(valueBytes[i/8]>>(uint(i)%8)) & 0x01
+	}
+	return data[0:4], s.write(coilsTable, address, values)
+}
+
+func (s *slave) writeHoldingRegisters(_ *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	var data = frame.GetData()
+	if len(data) < 5 {
+		return []byte{}, &mbserver.IllegalDataValue
+	}
+
+	var address = binary.BigEndian.Uint16(data[0:2])
+	var quantity = int(binary.BigEndian.Uint16(data[2:4]))
+	var valueBytes = data[5:]
+	if quantity == 0 || len(valueBytes) != quantity*2 {
+		return []byte{}, &mbserver.IllegalDataValue
+	}
+	return data[0:4], s.write(holdingRegistersTable, address, mbserver.BytesToUint16(valueBytes))
+}
+
+// write runs the handlers watching the written range, and then commits the values and the staged changes.
+func (s *slave) write(t table, address uint16, values []uint16) *mbserver.Exception {
+	if int(address)+len(values) > 65536 {
+		return &mbserver.IllegalDataAddress
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	var tx = &transaction{slave: s}
+	for _, r := range s.handlers[t] {
+		if !r.overlaps(address, len(values)) {
+			continue
+		}
+
+		// merges the written values into the watched range
+		var watched = s.get(t, r.address, r.quantity)
+		for i := range watched {
+			var idx = int(r.address) + i - int(address)
+			if idx >= 0 && idx < len(values) {
+				watched[i] = values[idx]
+			}
+		}
+		if exception := r.handler(tx, watched); exception != nil && *exception != mbserver.Success {
+			return exception
+		}
+	}
+	s.set(t, address, values)
+	tx.commit()
+	return &mbserver.Success
+}
+
+func (s *slave) get(t table, address, quantity uint16) []uint16 {
+	var end = int(address) + int(quantity)
+	if end > 65536 {
+		end = 65536
+	}
+	var ret = make([]uint16, 0, end-int(address))
+	switch t {
+	case coilsTable:
+		for _, v := range s.memory.Coils[address:end] {
+			ret = append(ret, uint16(v))
+		}
+	case discreteInputsTable:
+		for _, v := range s.memory.DiscreteInputs[address:end] {
+			ret = append(ret, uint16(v))
+		}
+	case holdingRegistersTable:
+		ret = append(ret, s.memory.HoldingRegisters[address:end]...)
+	case inputRegistersTable:
+		ret = append(ret, s.memory.InputRegisters[address:end]...)
+	}
+	return ret
+}
+
+func (s *slave) set(t table, address uint16, values []uint16) {
+	switch t {
+	case coilsTable:
+		for i, v := range values {
+			if int(address)+i < len(s.memory.Coils) {
+				s.memory.Coils[int(address)+i] = toBit(v)
+			}
+		}
+	case discreteInputsTable:
+		for i, v := range values {
+			if int(address)+i < len(s.memory.DiscreteInputs) {
+				s.memory.DiscreteInputs[int(address)+i] = toBit(v)
+			}
+		}
+	case holdingRegistersTable:
+		copy(s.memory.HoldingRegisters[address:], values)
+	case inputRegistersTable:
+		copy(s.memory.InputRegisters[address:], values)
+	}
+}
+
+// transaction reads the committed points of the slave, and stages the changes to commit them at once.
+type transaction struct {
+	slave   *slave
+	changes []func()
+}
+
+// Get returns the committed values of the range [address, address+quantity) of the table.
+func (tx *transaction) Get(t table, address, quantity uint16) []uint16 {
+	return tx.slave.get(t, address, quantity)
+}
+
+// Set stages the values to write into the table from the address.
+func (tx *transaction) Set(t table, address uint16, values ...uint16) {
+	tx.changes = append(tx.changes, func() {
+		tx.slave.set(t, address, values)
+	})
+}
+
+// SetBytes stages the big-endian bytes to write into the registers of the table from the address,
+// the odd length bytes is padded with zero.
+func (tx *transaction) SetBytes(t table, address uint16, bs []byte) {
+	if len(bs)%2 != 0 {
+		bs = append(bs, 0)
+	}
+	tx.Set(t, address, mbserver.BytesToUint16(bs)...)
+}
+
+// GetBytes returns the committed registers of the table as big-endian bytes.
+func (tx *transaction) GetBytes(t table, address, quantity uint16) []byte {
+	return mbserver.Uint16ToBytes(tx.Get(t, address, quantity))
+}
+
+func (tx *transaction) commit() {
+	for _, change := range tx.changes {
+		change()
+	}
+	tx.changes = nil
+}
+
+func toBit(v uint16) byte {
+	if v != 0 {
+		return 1
+	}
+	return 0
+}
+
+func fromBool(b bool) uint16 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// newMemory allocates the Modbus memory maps, the same as mbserver.NewServer but without launching the handler.
+func newMemory() *mbserver.Server {
+	return &mbserver.Server{
+		DiscreteInputs:   make([]byte, 65536),
+		Coils:            make([]byte, 65536),
+		HoldingRegisters: make([]uint16, 65536),
+		InputRegisters:   make([]uint16, 65536),
+	}
+}
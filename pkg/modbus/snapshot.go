@@ -0,0 +1,166 @@
+package modbus
+
+import (
+	"io/ioutil"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/octopus-simulator/pkg/converter"
+)
+
+// snapshot is the captured register space of all slaves.
+type snapshot struct {
+	Slaves []slaveSnapshot `json:"slaves"`
+}
+
+// slaveSnapshot is the captured register space of a slave, only the non-zero blocks are recorded.
+type slaveSnapshot struct {
+	ID               uint8           `json:"id"`
+	Coils            []snapshotBlock `json:"coils,omitempty"`
+	DiscreteInputs   []snapshotBlock `json:"discreteInputs,omitempty"`
+	HoldingRegisters []snapshotBlock `json:"holdingRegisters,omitempty"`
+	InputRegisters   []snapshotBlock `json:"inputRegisters,omitempty"`
+}
+
+// snapshotBlock is a run of consecutive values started from the address,
+// coils and discrete inputs are represented as 0 or 1.
+type snapshotBlock struct {
+	Address uint16   `json:"address"`
+	Values  []uint16 `json:"values"`
+}
+
+// loadSnapshot reads the snapshot from the JSON file.
+func loadSnapshot(path string) (*snapshot, error) {
+	var data, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read snapshot file %s", path)
+	}
+	var ss snapshot
+	if err := converter.UnmarshalJSON(data, &ss); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal snapshot file %s", path)
+	}
+	return &ss, nil
+}
+
+// saveSnapshot writes the snapshot into the JSON file.
+func saveSnapshot(path string, ss *snapshot) error {
+	var data, err = converter.MarshalJSON(ss)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal snapshot")
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write snapshot file %s", path)
+	}
+	return nil
+}
+
+// bus is the slaves indexed by ID.
+type bus map[uint8]*slave
+
+// Snapshot captures the register space of all slaves, ordered by ID.
+func (b bus) Snapshot() *snapshot {
+	var ss = &snapshot{}
+	for _, s := range b {
+		ss.Slaves = append(ss.Slaves, s.Snapshot())
+	}
+	sort.Slice(ss.Slaves, func(i, j int) bool {
+		return ss.Slaves[i].ID < ss.Slaves[j].ID
+	})
+	return ss
+}
+
+// Restore loads the register space of all slaves from the snapshot,
+// the slaves absent from the snapshot are kept as they are,
+// and nothing is changed if any slave of the snapshot is not found or any block is out of range.
+func (b bus) Restore(ss *snapshot) error {
+	for _, sss := range ss.Slaves {
+		if _, exist := b[sss.ID]; !exist {
+			return errors.Errorf("slave %d is not found", sss.ID)
+		}
+		if err := sss.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid snapshot of slave %d", sss.ID)
+		}
+	}
+	for _, sss := range ss.Slaves {
+		b[sss.ID].Restore(sss)
+	}
+	return nil
+}
+
+// Validate rejects the blocks overflowing the table.
+func (ss slaveSnapshot) Validate() error {
+	var blocks = map[string][]snapshotBlock{
+		"coils":             ss.Coils,
+		"discrete inputs":   ss.DiscreteInputs,
+		"holding registers": ss.HoldingRegisters,
+		"input registers":   ss.InputRegisters,
+	}
+	for name, tBlocks := range blocks {
+		for _, block := range tBlocks {
+			if int(block.Address)+len(block.Values) > 65536 {
+				return errors.Errorf("block of %d %s at address %d overflows the table", len(block.Values), name, block.Address)
+			}
+		}
+	}
+	return nil
+}
+
+// Snapshot captures the register space of the slave.
+func (s *slave) Snapshot() slaveSnapshot {
+	s.Lock()
+	defer s.Unlock()
+
+	return slaveSnapshot{
+		ID:               s.id,
+		Coils:            s.capture(coilsTable),
+		DiscreteInputs:   s.capture(discreteInputsTable),
+		HoldingRegisters: s.capture(holdingRegistersTable),
+		InputRegisters:   s.capture(inputRegistersTable),
+	}
+}
+
+// Restore loads the register space of the slave from the snapshot, and then calls the restore handlers to reload the state of device model,
+// the write handlers are not triggered, so that their side effects, e.g. injecting faults, are not replayed,
+// the snapshot must have been validated.
+func (s *slave) Restore(ss slaveSnapshot) {
+	s.Lock()
+	defer s.Unlock()
+
+	var blocks = map[table][]snapshotBlock{
+		coilsTable:            ss.Coils,
+		discreteInputsTable:   ss.DiscreteInputs,
+		holdingRegistersTable: ss.HoldingRegisters,
+		inputRegistersTable:   ss.InputRegisters,
+	}
+	for t, tBlocks := range blocks {
+		s.set(t, 0, make([]uint16, 65536))
+		for _, block := range tBlocks {
+			s.set(t, block.Address, block.Values)
+		}
+	}
+
+	for _, restore := range s.restorers {
+		restore(&transaction{slave: s})
+	}
+}
+
+func (s *slave) capture(t table) []snapshotBlock {
+	var ret []snapshotBlock
+	// the quantity of the whole table overflows uint16
+	var values = append(s.get(t, 0, 65535), s.get(t, 65535, 1)...)
+
+	var block *snapshotBlock
+	for address, v := range values {
+		if v == 0 {
+			block = nil
+			continue
+		}
+		if block == nil {
+			ret = append(ret, snapshotBlock{Address: uint16(address)})
+			block = &ret[len(ret)-1]
+		}
+		block.Values = append(block.Values, v)
+	}
+	return ret
+}
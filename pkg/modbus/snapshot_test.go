@@ -0,0 +1,163 @@
+package modbus
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	var s = newSlave(1, newMemory())
+	s.Update(func(tx *transaction) {
+		tx.Set(coilsTable, 0, 1, 0, 1)
+		tx.Set(discreteInputsTable, 65535, 1)
+		tx.Set(holdingRegistersTable, 10, 1, 2, 3)
+		tx.Set(holdingRegistersTable, 20, 4)
+		tx.Set(inputRegistersTable, 0, 0xFFFF)
+	})
+
+	var ss = bus{1: s}.Snapshot()
+	var expected = slaveSnapshot{
+		ID:               1,
+		Coils:            []snapshotBlock{{Address: 0, Values: []uint16{1}}, {Address: 2, Values: []uint16{1}}},
+		DiscreteInputs:   []snapshotBlock{{Address: 65535, Values: []uint16{1}}},
+		HoldingRegisters: []snapshotBlock{{Address: 10, Values: []uint16{1, 2, 3}}, {Address: 20, Values: []uint16{4}}},
+		InputRegisters:   []snapshotBlock{{Address: 0, Values: []uint16{0xFFFF}}},
+	}
+	if len(ss.Slaves) != 1 || !reflect.DeepEqual(ss.Slaves[0], expected) {
+		t.Fatalf("unexpected snapshot %+v", ss.Slaves)
+	}
+
+	var dir, err = ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var path = filepath.Join(dir, "snapshot.json")
+	if err := saveSnapshot(path, ss); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the points absent from the snapshot are cleared
+	var restored = newSlave(1, newMemory())
+	restored.Update(func(tx *transaction) {
+		tx.Set(holdingRegistersTable, 100, 42)
+	})
+	if err := (bus{1: restored}).Restore(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if actual := restored.Snapshot(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected restored %+v, but got %+v", expected, actual)
+	}
+
+	if err := (bus{2: restored}).Restore(loaded); err == nil {
+		t.Error("expected error of restoring the absent slave")
+	}
+
+	// the out of range block is rejected before changing anything
+	var overflowed = &snapshot{Slaves: []slaveSnapshot{
+		{ID: 1},
+		{ID: 2, HoldingRegisters: []snapshotBlock{{Address: 65535, Values: []uint16{1, 2}}}},
+	}}
+	if err := (bus{1: restored, 2: newSlave(2, newMemory())}).Restore(overflowed); err == nil {
+		t.Error("expected error of restoring the out of range block")
+	}
+	if actual := restored.Snapshot(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected kept %+v, but got %+v", expected, actual)
+	}
+}
+
+func TestRestoreVFD(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		snapshot slaveSnapshot
+		// input registers [0, 5) after a step: status word, frequency, current (skipped), fault, speed
+		expected [5]uint16
+		// the fault injection register is kept as restored
+		injection uint16
+	}{
+		{
+			name: "running forward",
+			snapshot: slaveSnapshot{
+				ID:               1,
+				HoldingRegisters: []snapshotBlock{{Address: 0, Values: []uint16{vfdControlRun, 300, 50}}},
+				InputRegisters:   []snapshotBlock{{Address: 0, Values: []uint16{vfdStatusReady | vfdStatusRunning | vfdStatusAtSetpoint, 300, 100, 0, 900, 545}}},
+			},
+			expected: [5]uint16{vfdStatusReady | vfdStatusRunning | vfdStatusAtSetpoint, 300, 0, vfdFaultNone, 900},
+		},
+		{
+			name: "running reverse",
+			snapshot: slaveSnapshot{
+				ID:               1,
+				HoldingRegisters: []snapshotBlock{{Address: 0, Values: []uint16{vfdControlRun | vfdControlReverse, 300, 50}}},
+				InputRegisters:   []snapshotBlock{{Address: 0, Values: []uint16{vfdStatusReady | vfdStatusRunning | vfdStatusAtSetpoint | vfdStatusReverse, 300, 100, 0, uint16(0x10000 - 900), 545}}},
+			},
+			expected: [5]uint16{vfdStatusReady | vfdStatusRunning | vfdStatusAtSetpoint | vfdStatusReverse, 300, 0, vfdFaultNone, uint16(0x10000 - 900)},
+		},
+		{
+			// coasts by 1Hz per step with 5s ramp time, and the stale fault injection register is not replayed
+			name: "faulted",
+			snapshot: slaveSnapshot{
+				ID:               1,
+				HoldingRegisters: []snapshotBlock{{Address: 0, Values: []uint16{vfdControlRun, 300, 50, vfdFaultOvervoltage}}},
+				InputRegisters:   []snapshotBlock{{Address: 0, Values: []uint16{vfdStatusFault | vfdStatusRunning, 200, 80, vfdFaultOvercurrent, 600, 545}}},
+			},
+			expected:  [5]uint16{vfdStatusFault | vfdStatusRunning, 190, 0, vfdFaultOvercurrent, 570},
+			injection: vfdFaultOvervoltage,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var stop = make(chan struct{})
+			defer close(stop)
+
+			var s = newSlave(1, newMemory())
+			var d = mockVFD(s, stop)
+			defer d.Close()
+
+			s.Restore(tc.snapshot)
+			s.Update(func(tx *transaction) {
+				d.step(tx)
+			})
+
+			var actual [5]uint16
+			s.Update(func(tx *transaction) {
+				copy(actual[:], tx.Get(inputRegistersTable, 0, 5))
+			})
+			actual[2] = 0
+			if actual != tc.expected {
+				t.Errorf("expected input registers %v, but got %v", tc.expected, actual)
+			}
+			var injection uint16
+			s.Update(func(tx *transaction) {
+				injection = tx.Get(holdingRegistersTable, 3, 1)[0]
+			})
+			if injection != tc.injection {
+				t.Errorf("expected fault injection register %d, but got %d", tc.injection, injection)
+			}
+		})
+	}
+}
+
+func TestRestoreThermometer(t *testing.T) {
+	var stop = make(chan struct{})
+	defer close(stop)
+
+	var s = newSlave(1, newMemory())
+	var d = mockThermometer(s, stop)
+	defer d.Close()
+
+	s.Restore(slaveSnapshot{ID: 1})
+	s.Update(func(tx *transaction) {
+		if d.mocking {
+			t.Error("expected mocking switched off as the restored coil")
+		}
+	})
+}
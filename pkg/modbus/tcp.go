@@ -0,0 +1,401 @@
+package modbus
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tbrandon/mbserver"
+
+	tcp "github.com/rancher/octopus-simulator/cmd/modbus/tcp/options"
+	"github.com/rancher/octopus-simulator/pkg/converter"
+	"github.com/rancher/octopus-simulator/pkg/log"
+)
+
+const (
+	// evicts the oldest session when reaching the max connections
+	evictOldestPolicy = "evict-oldest"
+	// refuses the new connection when reaching the max connections
+	refusePolicy = "refuse"
+)
+
+// bounds the TLS handshake, or the idle timeout if it is shorter
+const handshakeTimeout = 10 * time.Second
+
+// serveTCP accepts the connections and serves the requests to the slave until the listener is closed.
+func serveTCP(listener net.Listener, sessions *tcpSessions, s *slave) error {
+	for {
+		var conn, err = listener.Accept()
+		if err != nil {
+			if isClosedConn(err) {
+				return nil
+			}
+			return errors.Wrap(err, "failed to accept connection")
+		}
+
+		var session = sessions.Open(conn)
+		if session == nil {
+			continue
+		}
+		go func() {
+			defer sessions.Close(session)
+			session.Serve(s)
+		}()
+	}
+}
+
+// tcpSessions manages the connection sessions with the configured limits.
+type tcpSessions struct {
+	sync.Mutex
+	maxConnections int
+	policy         string
+	idleTimeout    time.Duration
+	rateLimit      float64
+	// roles maps the roles of the client certificates to the permissions, all functions are allowed if empty
+	roles map[string]permission
+
+	seq    uint64
+	active []*tcpSession // ordered by connected time
+}
+
+func newTCPSessions(opts *tcp.Options) (*tcpSessions, error) {
+	switch opts.ConnectionPolicy {
+	case refusePolicy, evictOldestPolicy:
+	default:
+		return nil, errors.Errorf("unknown connection policy %s, select from [%s, %s]", opts.ConnectionPolicy, refusePolicy, evictOldestPolicy)
+	}
+	var roles, err = parseRoles(opts.Roles)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpSessions{
+		maxConnections: opts.MaxConnections,
+		policy:         opts.ConnectionPolicy,
+		idleTimeout:    opts.IdleTimeout,
+		rateLimit:      opts.RateLimit,
+		roles:          roles,
+	}, nil
+}
+
+// Open starts a session of the connection, returns nil if the connection is refused.
+func (m *tcpSessions) Open(conn net.Conn) *tcpSession {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.maxConnections > 0 && len(m.active) >= m.maxConnections {
+		if m.policy == refusePolicy {
+			log.Info(fmt.Sprintf("Refused connection from %s, reached max connections %d", conn.RemoteAddr(), m.maxConnections))
+			_ = conn.Close()
+			return nil
+		}
+		var oldest = m.active[0]
+		log.Info(fmt.Sprintf("Evicting session %d, reached max connections %d", oldest.id, m.maxConnections))
+		// the eviction is completed when the serving goroutine closes the session
+		_ = oldest.conn.Close()
+		m.active = m.active[1:]
+	}
+
+	m.seq++
+	var now = time.Now()
+	var session = &tcpSession{
+		id:          m.seq,
+		conn:        conn,
+		idleTimeout: m.idleTimeout,
+		connectedAt: now,
+		lastActive:  now,
+		limiter:     newRateLimiter(m.rateLimit),
+		roles:       m.roles,
+		permission:  fullPermission,
+	}
+	m.active = append(m.active, session)
+	log.Info(fmt.Sprintf("Opened session %d from %s", session.id, conn.RemoteAddr()))
+	return session
+}
+
+// Close ends the session and logs its stats.
+func (m *tcpSessions) Close(session *tcpSession) {
+	m.Lock()
+	for i, s := range m.active {
+		if s == session {
+			m.active = append(m.active[:i], m.active[i+1:]...)
+			break
+		}
+	}
+	m.Unlock()
+
+	_ = session.conn.Close()
+	var stats = session.Stats()
+	log.Info(fmt.Sprintf("Closed session %d from %s, lasted %s, served %d requests, %d exceptions, %d throttled",
+		stats.ID, stats.RemoteAddress, time.Since(stats.ConnectedAt).Round(time.Millisecond), stats.Requests, stats.Exceptions, stats.Throttled))
+}
+
+// Stats returns the stats of all active sessions, ordered by ID.
+func (m *tcpSessions) Stats() []tcpSessionStats {
+	m.Lock()
+	defer m.Unlock()
+
+	var ret = make([]tcpSessionStats, 0, len(m.active))
+	for _, s := range m.active {
+		ret = append(ret, s.Stats())
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ID < ret[j].ID
+	})
+	return ret
+}
+
+// ServeHTTP responds the stats of all active sessions as JSON.
+func (m *tcpSessions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var data, err = converter.MarshalJSON(m.Stats())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// tcpSessionStats is the stats of a session.
+type tcpSessionStats struct {
+	ID            uint64    `json:"id"`
+	RemoteAddress string    `json:"remoteAddress"`
+	Role          string    `json:"role,omitempty"`
+	ConnectedAt   time.Time `json:"connectedAt"`
+	LastActive    time.Time `json:"lastActive"`
+	Requests      uint64    `json:"requests"`
+	Exceptions    uint64    `json:"exceptions"`
+	Throttled     uint64    `json:"throttled"`
+	BytesIn       uint64    `json:"bytesIn"`
+	BytesOut      uint64    `json:"bytesOut"`
+}
+
+// tcpSession serves the requests of a connection.
+type tcpSession struct {
+	sync.Mutex
+	id          uint64
+	conn        net.Conn
+	idleTimeout time.Duration
+	limiter     *rateLimiter
+	roles       map[string]permission
+
+	// the followings are guarded by the lock
+	role        string
+	permission  permission
+	connectedAt time.Time
+	lastActive  time.Time
+	requests    uint64
+	exceptions  uint64
+	throttled   uint64
+	bytesIn     uint64
+	bytesOut    uint64
+}
+
+func (s *tcpSession) Stats() tcpSessionStats {
+	s.Lock()
+	defer s.Unlock()
+
+	return tcpSessionStats{
+		ID:            s.id,
+		RemoteAddress: s.conn.RemoteAddr().String(),
+		Role:          s.role,
+		ConnectedAt:   s.connectedAt,
+		LastActive:    s.lastActive,
+		Requests:      s.requests,
+		Exceptions:    s.exceptions,
+		Throttled:     s.throttled,
+		BytesIn:       s.bytesIn,
+		BytesOut:      s.bytesOut,
+	}
+}
+
+// Serve reads the requests until the connection is closed or idle timeout,
+// the requests exceeded the rate limit are responded with SlaveDeviceBusy exception,
+// and the requests not permitted to the role of TLS client are responded with IllegalFunction exception.
+func (s *tcpSession) Serve(sl *slave) {
+	if conn, ok := s.conn.(*tls.Conn); ok {
+		if err := s.authenticate(conn); err != nil {
+			log.Error(err, fmt.Sprintf("Failed to authenticate session %d", s.id))
+			return
+		}
+	}
+
+	for {
+		var packet, err = s.read()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				log.Info(fmt.Sprintf("Closing session %d, idle for %s", s.id, s.idleTimeout))
+			} else if err != io.EOF && !isClosedConn(err) {
+				log.Error(err, fmt.Sprintf("Failed to read from session %d", s.id))
+			}
+			return
+		}
+
+		var request, ferr = mbserver.NewTCPFrame(packet)
+		if ferr != nil {
+			log.Error(ferr, fmt.Sprintf("Dropped bad TCP frame from session %d", s.id))
+			return
+		}
+
+		var response mbserver.Framer
+		var throttled = !s.limiter.Allow()
+		switch {
+		case throttled:
+			response = request.Copy()
+			response.SetException(&mbserver.SlaveDeviceBusy)
+		case !s.permission.Allows(request.GetFunction()):
+			log.Info(fmt.Sprintf("Denied function %d of role %q on session %d", request.GetFunction(), s.role, s.id))
+			response = request.Copy()
+			response.SetException(&mbserver.IllegalFunction)
+		default:
+			response = sl.Serve(request)
+		}
+		var adu = response.Bytes()
+
+		s.Lock()
+		s.lastActive = time.Now()
+		s.requests++
+		s.bytesIn += uint64(len(packet))
+		s.bytesOut += uint64(len(adu))
+		if throttled {
+			s.throttled++
+		} else if response.GetFunction()&0x80 != 0 {
+			s.exceptions++
+		}
+		s.Unlock()
+
+		if _, err := s.conn.Write(adu); err != nil {
+			if !isClosedConn(err) {
+				log.Error(err, fmt.Sprintf("Failed to write to session %d", s.id))
+			}
+			return
+		}
+	}
+}
+
+// authenticate completes the TLS handshake, and then resolves the permission from the role of client certificate,
+// the client without role or with unknown role is denied to all functions if the roles are configured.
+func (s *tcpSession) authenticate(conn *tls.Conn) error {
+	// the handshake both reads and writes, so it is always bounded in both directions,
+	// otherwise the peer never sending ClientHello holds the session slot,
+	// and then the deadlines are cleared as read refreshes the read deadline by the idle timeout
+	var timeout = handshakeTimeout
+	if s.idleTimeout > 0 && s.idleTimeout < timeout {
+		timeout = s.idleTimeout
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if err := conn.Handshake(); err != nil {
+		return errors.Wrap(err, "failed to complete TLS handshake")
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	var role string
+	if peers := conn.ConnectionState().PeerCertificates; len(peers) != 0 {
+		var err error
+		if role, err = roleOf(peers[0]); err != nil {
+			return err
+		}
+	}
+	var permission = fullPermission
+	if len(s.roles) != 0 {
+		permission = s.roles[role]
+	}
+
+	s.Lock()
+	s.role = role
+	s.permission = permission
+	s.Unlock()
+	log.Info(fmt.Sprintf("Authenticated session %d as role %q", s.id, role))
+	return nil
+}
+
+// read reads an ADU which is delimited by the length field of MBAP header.
+func (s *tcpSession) read() ([]byte, error) {
+	if s.idleTimeout > 0 {
+		if err := s.conn.SetReadDeadline(time.Now().Add(s.idleTimeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	// transaction identifier + protocol identifier + length + unit identifier
+	var header = make([]byte, 7)
+	if _, err := io.ReadFull(s.conn, header); err != nil {
+		return nil, err
+	}
+	var length = int(binary.BigEndian.Uint16(header[4:6]))
+	if length < 2 || length > 254 {
+		return nil, errors.Errorf("invalid length %d of MBAP header", length)
+	}
+	var packet = make([]byte, 6+length)
+	copy(packet, header)
+	if _, err := io.ReadFull(s.conn, packet[7:]); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// rateLimiter is a token bucket refilled at the rate per second, the burst is the rate rounded up.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil if the rate is not positive, which allows all requests.
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	var burst = float64(int(rate))
+	if burst < rate {
+		burst++
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Allow consumes a token if there is any, it is only called by the serving goroutine of session.
+func (l *rateLimiter) Allow() bool {
+	if l == nil {
+		return true
+	}
+	var now = time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func isClosedConn(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	// net.ErrClosed is not available before go 1.16
+	return err != nil && err.Error() == "use of closed network connection"
+}
@@ -2,42 +2,62 @@
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
-	"io"
-	"math"
 	"math/rand"
 	"time"
 
-	"github.com/goburrow/modbus"
-	"github.com/pkg/errors"
+	"github.com/go-logr/logr"
+	"github.com/tbrandon/mbserver"
 
 	"github.com/rancher/octopus-simulator/pkg/critical"
 	"github.com/rancher/octopus-simulator/pkg/log"
 )
 
-func mockThermometer(handler modbus.ClientHandler, stop <-chan struct{}) *thermometer {
+func mockThermometer(slave *slave, stop <-chan struct{}) *thermometer {
 	var ctx, ctxCancel = context.WithCancel(critical.Context(stop))
 
-	return &thermometer{
-		handler:   handler,
+	var in = &thermometer{
+		log:       log.WithName("thermometer").WithValues("slave", slave.id),
+		slave:     slave,
 		ctx:       ctx,
 		ctxCancel: ctxCancel,
 	}
+
+	// switches mocking when writing coils register 1
+	slave.Handle(coilsTable, 1, 1, in.handleSwitch)
+	// validates temperature limitation and reevaluates alarm when writing holding register 4
+	slave.Handle(holdingRegistersTable, 4, 2, in.handleTemperatureLimitation)
+	// reloads mocking switch after restoring
+	slave.HandleRestore(in.handleRestore)
+
+	slave.Update(func(tx *transaction) {
+		// defaults allowing mocking is true
+		tx.Set(coilsTable, 1, 1)
+		in.mocking = true
+
+		// defaults temperature limitation is 324K
+		tx.SetBytes(holdingRegistersTable, 4, convertInt32ToBytes(324))
+
+		// defaults battery is 100
+		tx.SetBytes(holdingRegistersTable, 6, convertInt8ToBytes(100))
+
+		// defaults manufacturer is Rancher Octopus Fake Factory
+		tx.SetBytes(holdingRegistersTable, 7, []byte("Rancher Octopus Fake Factory"))
+	})
+	return in
 }
 
 type thermometer struct {
-	handler   modbus.ClientHandler
+	log       logr.Logger
+	slave     *slave
 	ctx       context.Context
 	ctxCancel context.CancelFunc
+
+	// mocking is guarded by the lock of slave
+	mocking bool
 }
 
 func (in *thermometer) Close() error {
-	if in.handler != nil {
-		if closer, ok := in.handler.(io.Closer); ok {
-			return closer.Close()
-		}
-	}
 	if in.ctxCancel != nil {
 		in.ctxCancel()
 	}
@@ -45,34 +65,7 @@ func (in *thermometer) Close() error {
 }
 
 func (in *thermometer) Mock(interval time.Duration) error {
-	var cli = modbus.NewClient(in.handler)
-
-	// defaults allowing mocking is true
-	_, err := cli.WriteSingleCoil(1, 0xFF00)
-	if err != nil {
-		log.Error(err, "Failed to configure switch to default value")
-	}
-
-	// defaults temperature limitation is 324K
-	_, err = cli.WriteMultipleRegisters(4, 2, convertInt32ToBytes(324))
-	if err != nil {
-		log.Error(err, "Failed to configure temperature limitation to default value")
-	}
-
-	// defaults battery is 100
-	_, err = cli.WriteMultipleRegisters(6, 1, convertInt8ToBytes(100))
-	if err != nil {
-		log.Error(err, "Failed to configure battery to default value")
-	}
 	var start = time.Now()
-
-	// defaults manufacturer is Rancher Octopus Fake Factory
-	var manufacturer = "Rancher Octopus Fake Factory"
-	_, err = cli.WriteMultipleRegisters(7, (uint16(len(manufacturer))+1)/2, []byte(manufacturer))
-	if err != nil {
-		log.Error(err, "Failed to configure manufacturer to default value")
-	}
-
 	var ticker = time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
@@ -82,77 +75,43 @@ func (in *thermometer) Mock(interval time.Duration) error {
 		default:
 		}
 
-		// mocks or not
-		var coilsRegister1, err = cli.ReadCoils(1, 1)
-		if err != nil {
-			return errors.Wrap(err, "failed to read coils registers 1")
-		}
-		if coilsRegister1[0]&0x01 != 0x01 {
-			log.Info("Mocking is stopped")
-			select {
-			case <-in.ctx.Done():
-				return nil
-			case <-ticker.C:
+		in.slave.Update(func(tx *transaction) {
+			// mocks or not
+			if !in.mocking {
+				in.log.Info("Mocking is stopped")
+				return
 			}
-			continue
-		} else {
-			log.Info("Mocking is starting")
-		}
-
-		// mocks absolute temperature, base unit is kevin, range is (273.15K, 378.15K]
-		var holdingRegister0 = rand.Float32()*100 + 274.15
-		_, err = cli.WriteMultipleRegisters(0, 2, convertFloat32ToBytes(holdingRegister0))
-		if err != nil {
-			return errors.Wrapf(err, "failed to write holding register 0, %s:%v", "value", holdingRegister0)
-		}
-		log.Info(fmt.Sprintf("Mocked absolute temperature as %vK", holdingRegister0))
-
-		// mocks relative humidity, unit is percent, range is [10%, 100%)
-		var holdingRegister2 = rand.Float32()*90 + 10
-		_, err = cli.WriteMultipleRegisters(2, 2, convertFloat32ToBytes(holdingRegister2))
-		if err != nil {
-			return errors.Wrapf(err, "failed to write holding register 2, %s:%v", "value", holdingRegister2)
-		}
-		log.Info(fmt.Sprintf("Mocked relative humidity as %v%%", holdingRegister2))
-
-		// gets temperature limitation
-		holdingRegister4Bytes, err := cli.ReadHoldingRegisters(4, 2)
-		if err != nil {
-			return errors.Wrap(err, "failed to read holding registers 4")
-		}
-		var holdingRegister4 = parseBytesToInt32(holdingRegister4Bytes)
-		log.Info(fmt.Sprintf("Mocked temperature limiation is %vK", holdingRegister4))
-
-		// mocks battery, unit is percent, range is [20%, 100%]
-		var holdingRegister6 = 100 - int8(time.Since(start)/time.Hour)
-		if holdingRegister6 < 20 {
-			holdingRegister6 = 20
-		}
-		_, err = cli.WriteMultipleRegisters(6, 1, convertInt8ToBytes(holdingRegister6))
-		if err != nil {
-			return errors.Wrapf(err, "failed to write holding register 6, %s:%v", "value", holdingRegister6)
-		}
-		log.Info(fmt.Sprintf("Mocked battery as %v%%", holdingRegister6))
+			in.log.Info("Mocking is starting")
+
+			// mocks absolute temperature, base unit is kevin, range is (273.15K, 378.15K]
+			var holdingRegister0 = rand.Float32()*100 + 274.15
+			tx.SetBytes(holdingRegistersTable, 0, convertFloat32ToBytes(holdingRegister0))
+			in.log.Info(fmt.Sprintf("Mocked absolute temperature as %vK", holdingRegister0))
+
+			// mocks relative humidity, unit is percent, range is [10%, 100%)
+			var holdingRegister2 = rand.Float32()*90 + 10
+			tx.SetBytes(holdingRegistersTable, 2, convertFloat32ToBytes(holdingRegister2))
+			in.log.Info(fmt.Sprintf("Mocked relative humidity as %v%%", holdingRegister2))
+
+			// gets temperature limitation
+			var holdingRegister4 = parseBytesToInt32(tx.GetBytes(holdingRegistersTable, 4, 2))
+			in.log.Info(fmt.Sprintf("Mocked temperature limiation is %vK", holdingRegister4))
+
+			// mocks battery, unit is percent, range is [20%, 100%]
+			var holdingRegister6 = 100 - int8(time.Since(start)/time.Hour)
+			if holdingRegister6 < 20 {
+				holdingRegister6 = 20
+			}
+			tx.SetBytes(holdingRegistersTable, 6, convertInt8ToBytes(holdingRegister6))
+			in.log.Info(fmt.Sprintf("Mocked battery as %v%%", holdingRegister6))
 
-		// gets manufacturer
-		holdingRegister7, err := cli.ReadHoldingRegisters(7, 14)
-		if err != nil {
-			return errors.Wrap(err, "failed to read holding registers 7")
-		}
-		log.Info(fmt.Sprintf("Mocked manufacturer is %v", string(holdingRegister7)))
+			// gets manufacturer
+			var holdingRegister7 = tx.GetBytes(holdingRegistersTable, 7, 14)
+			in.log.Info(fmt.Sprintf("Mocked manufacturer is %v", string(holdingRegister7)))
 
-		// reports alarm
-		var coilsRegister0 uint16 = 0x0000
-		if holdingRegister0-float32(holdingRegister4) > 0.1 {
-			log.Info("++ Reported high temperature alarm ++")
-			coilsRegister0 = 0xFF00
-		} else {
-			log.Info("-- Removed high temperature alarm --")
-		}
-		_, err = cli.WriteSingleCoil(0, coilsRegister0)
-		if err != nil {
-			return errors.Wrapf(err, "failed to write coils register 0, %s:%v", "value", coilsRegister0)
-		}
+			// reports alarm
+			tx.Set(coilsTable, 0, in.evaluateAlarm(holdingRegister0, holdingRegister4))
+		})
 
 		select {
 		case <-in.ctx.Done():
@@ -162,34 +121,43 @@ func (in *thermometer) Mock(interval time.Duration) error {
 	}
 }
 
-func convertInt8ToBytes(i int8) []byte {
-	var ret = make([]byte, 2)
-	binary.BigEndian.PutUint16(ret, uint16(i))
-	return ret
-}
-
-func convertInt32ToBytes(i int32) []byte {
-	var ret = make([]byte, 4)
-	binary.BigEndian.PutUint32(ret, uint32(i))
-	return ret
+func (in *thermometer) handleSwitch(_ *transaction, values []uint16) *mbserver.Exception {
+	var mocking = values[0] == 1
+	if mocking != in.mocking {
+		if mocking {
+			in.log.Info("Mocking is switched on")
+		} else {
+			in.log.Info("Mocking is switched off")
+		}
+	}
+	in.mocking = mocking
+	return nil
 }
 
-func convertFloat32ToBytes(f float32) []byte {
-	var ret = make([]byte, 4)
-	binary.BigEndian.PutUint32(ret, math.Float32bits(f))
-	return ret
+func (in *thermometer) handleRestore(tx *transaction) {
+	in.mocking = tx.Get(coilsTable, 1, 1)[0] == 1
 }
 
-func convertFloat64ToBytes(f float64) []byte {
-	var ret = make([]byte, 8)
-	binary.BigEndian.PutUint64(ret, math.Float64bits(f))
-	return ret
-}
+func (in *thermometer) handleTemperatureLimitation(tx *transaction, values []uint16) *mbserver.Exception {
+	// the limitation must be in the range of the absolute temperature, which is (273.15K, 378.15K]
+	var holdingRegister4 = parseBytesToInt32(mbserver.Uint16ToBytes(values))
+	if holdingRegister4 < 274 || holdingRegister4 > 378 {
+		in.log.Info(fmt.Sprintf("Rejected temperature limitation as %vK", holdingRegister4))
+		return &mbserver.IllegalDataValue
+	}
+	in.log.Info(fmt.Sprintf("Configured temperature limitation as %vK", holdingRegister4))
 
-func parseBytesToInt32(bs []byte) int32 {
-	return int32(binary.BigEndian.Uint32(bs))
+	// reevaluates alarm with the new limitation
+	var holdingRegister0 = parseBytesToFloat32(tx.GetBytes(holdingRegistersTable, 0, 2))
+	tx.Set(coilsTable, 0, in.evaluateAlarm(holdingRegister0, holdingRegister4))
+	return nil
 }
 
-func parseBytesToFloat32(bs []byte) float32 {
-	return math.Float32frombits(binary.BigEndian.Uint32(bs))
+func (in *thermometer) evaluateAlarm(temperature float32, limitation int32) uint16 {
+	if temperature-float32(limitation) > 0.1 {
+		in.log.Info("++ Reported high temperature alarm ++")
+		return 1
+	}
+	in.log.Info("-- Removed high temperature alarm --")
+	return 0
 }
@@ -0,0 +1,241 @@
+package modbus
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/tbrandon/mbserver"
+
+	"github.com/rancher/octopus-simulator/pkg/critical"
+	"github.com/rancher/octopus-simulator/pkg/log"
+)
+
+const (
+	// bits of control word
+	vfdControlRun        = 1 << 0
+	vfdControlReverse    = 1 << 1
+	vfdControlFaultReset = 1 << 7
+
+	// bits of status word
+	vfdStatusReady      = 1 << 0
+	vfdStatusRunning    = 1 << 1
+	vfdStatusFault      = 1 << 2
+	vfdStatusAtSetpoint = 1 << 3
+	vfdStatusReverse    = 1 << 4
+
+	// fault codes
+	vfdFaultNone        = 0
+	vfdFaultOvercurrent = 1
+	vfdFaultOvervoltage = 2
+
+	vfdMaxFrequency = 50.0
+	vfdRatedCurrent = 15.0
+	vfdStep         = 100 * time.Millisecond
+)
+
+func mockVFD(slave *slave, stop <-chan struct{}) *vfd {
+	var ctx, ctxCancel = context.WithCancel(critical.Context(stop))
+
+	var in = &vfd{
+		log:       log.WithName("vfd").WithValues("slave", slave.id),
+		slave:     slave,
+		ctx:       ctx,
+		ctxCancel: ctxCancel,
+	}
+
+	// handles control word when writing holding register 0
+	slave.Handle(holdingRegistersTable, 0, 1, in.handleControlWord)
+	// validates speed setpoint when writing holding register 1
+	slave.Handle(holdingRegistersTable, 1, 1, in.handleSetpoint)
+	// validates ramp time when writing holding register 2
+	slave.Handle(holdingRegistersTable, 2, 1, in.handleRampTime)
+	// injects fault when writing holding register 3
+	slave.Handle(holdingRegistersTable, 3, 1, in.handleFaultInjection)
+	// reloads output frequency and fault after restoring
+	slave.HandleRestore(in.handleRestore)
+
+	slave.Update(func(tx *transaction) {
+		// defaults ramp time is 5.0s
+		tx.Set(holdingRegistersTable, 2, 50)
+		in.refresh(tx, 0, false)
+	})
+	return in
+}
+
+// vfd is a variable frequency drive,
+// which ramps the output frequency to the setpoint when running, and coasts to stop when faulting.
+type vfd struct {
+	log       logr.Logger
+	slave     *slave
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
+	// the followings are guarded by the lock of slave
+	frequency float64 // output frequency in Hz, negative is reverse
+	fault     uint16
+}
+
+func (in *vfd) Close() error {
+	if in.ctxCancel != nil {
+		in.ctxCancel()
+	}
+	return nil
+}
+
+func (in *vfd) Mock(interval time.Duration) error {
+	var ticker = time.NewTicker(vfdStep)
+	defer ticker.Stop()
+	var reported = time.Now()
+	for {
+		select {
+		case <-in.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		in.slave.Update(func(tx *transaction) {
+			var target = in.step(tx)
+			if time.Since(reported) >= interval {
+				reported = time.Now()
+				in.log.Info(fmt.Sprintf("Mocked output frequency as %.1fHz, target is %.1fHz", in.frequency, target))
+			}
+		})
+	}
+}
+
+// step ramps the output frequency for a step, and returns the target frequency.
+func (in *vfd) step(tx *transaction) float64 {
+	var controlWord = tx.Get(holdingRegistersTable, 0, 1)[0]
+	var setpoint = float64(tx.Get(holdingRegistersTable, 1, 1)[0]) / 10
+	var rampTime = float64(tx.Get(holdingRegistersTable, 2, 1)[0]) / 10
+
+	// ramps to the target, the slope is the max frequency per ramp time
+	var target float64
+	if in.fault == vfdFaultNone && controlWord&vfdControlRun != 0 {
+		target = setpoint
+		if controlWord&vfdControlReverse != 0 {
+			target = -setpoint
+		}
+	}
+	var delta = vfdMaxFrequency / rampTime * vfdStep.Seconds()
+	var accelerating = false
+	switch {
+	case in.frequency < target:
+		in.frequency = math.Min(in.frequency+delta, target)
+		accelerating = in.frequency > 0
+	case in.frequency > target:
+		in.frequency = math.Max(in.frequency-delta, target)
+		accelerating = in.frequency < 0
+	}
+
+	// trips overcurrent when accelerating too fast
+	if accelerating && rampTime < 1 {
+		in.fault = vfdFaultOvercurrent
+		in.log.Info(fmt.Sprintf("Tripped fault %d", in.fault))
+	}
+	in.refresh(tx, target, accelerating)
+	return target
+}
+
+// refresh updates the status points according to the output frequency.
+func (in *vfd) refresh(tx *transaction, target float64, accelerating bool) {
+	var statusWord uint16
+	if in.fault != vfdFaultNone {
+		statusWord |= vfdStatusFault
+	} else {
+		statusWord |= vfdStatusReady
+	}
+	if in.frequency != 0 {
+		statusWord |= vfdStatusRunning
+	}
+	if target != 0 && math.Abs(in.frequency-target) < 0.05 {
+		statusWord |= vfdStatusAtSetpoint
+	}
+	if in.frequency < 0 {
+		statusWord |= vfdStatusReverse
+	}
+
+	// the current is proportional to the frequency with noise, and rises when accelerating
+	var current float64
+	if in.frequency != 0 {
+		current = 2 + math.Abs(in.frequency)/vfdMaxFrequency*(vfdRatedCurrent-2) + rand.Float64()*0.2 - 0.1
+		if accelerating {
+			current += vfdRatedCurrent * 0.2
+		}
+	}
+
+	tx.Set(inputRegistersTable, 0,
+		statusWord,
+		uint16(math.Round(math.Abs(in.frequency)*10)),
+		uint16(math.Round(current*10)),
+		in.fault,
+		// 4 poles motor, the synchronous speed is 30 rpm per Hz
+		uint16(int16(math.Round(in.frequency*30))),
+		// DC bus voltage
+		uint16(540+rand.Intn(10)),
+	)
+}
+
+func (in *vfd) handleRestore(tx *transaction) {
+	var status = tx.Get(inputRegistersTable, 0, 4)
+	in.frequency = float64(status[1]) / 10
+	if status[0]&vfdStatusReverse != 0 {
+		in.frequency = -in.frequency
+	}
+	in.fault = status[3]
+}
+
+func (in *vfd) handleControlWord(tx *transaction, values []uint16) *mbserver.Exception {
+	var controlWord = values[0]
+	if controlWord&vfdControlFaultReset != 0 {
+		// the fault can only be reset when the run command is off
+		if in.fault != vfdFaultNone && controlWord&vfdControlRun == 0 {
+			in.log.Info(fmt.Sprintf("Reset fault %d", in.fault))
+			in.fault = vfdFaultNone
+			in.refresh(tx, 0, false)
+		}
+		// the fault reset bit returns to false after resetting
+		tx.Set(holdingRegistersTable, 0, controlWord&^vfdControlFaultReset)
+	}
+	in.log.Info(fmt.Sprintf("Configured control word as 0x%04X", controlWord))
+	return nil
+}
+
+func (in *vfd) handleSetpoint(_ *transaction, values []uint16) *mbserver.Exception {
+	if float64(values[0])/10 > vfdMaxFrequency {
+		in.log.Info(fmt.Sprintf("Rejected speed setpoint as %.1fHz", float64(values[0])/10))
+		return &mbserver.IllegalDataValue
+	}
+	in.log.Info(fmt.Sprintf("Configured speed setpoint as %.1fHz", float64(values[0])/10))
+	return nil
+}
+
+func (in *vfd) handleRampTime(_ *transaction, values []uint16) *mbserver.Exception {
+	if values[0] < 1 || values[0] > 6000 {
+		in.log.Info(fmt.Sprintf("Rejected ramp time as %.1fs", float64(values[0])/10))
+		return &mbserver.IllegalDataValue
+	}
+	in.log.Info(fmt.Sprintf("Configured ramp time as %.1fs", float64(values[0])/10))
+	return nil
+}
+
+func (in *vfd) handleFaultInjection(tx *transaction, values []uint16) *mbserver.Exception {
+	switch values[0] {
+	case vfdFaultNone:
+		return nil
+	case vfdFaultOvercurrent, vfdFaultOvervoltage:
+	default:
+		return &mbserver.IllegalDataValue
+	}
+
+	in.fault = values[0]
+	in.refresh(tx, 0, false)
+	// the injection register returns to zero after injecting
+	tx.Set(holdingRegistersTable, 3, 0)
+	in.log.Info(fmt.Sprintf("Injected fault %d", in.fault))
+	return nil
+}
@@ -0,0 +1,56 @@
+package mqtt
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/octopus-simulator/pkg/log"
+)
+
+// serveAdmin serves the administration endpoints of the mockers on the address:
+//
+//	POST /devices/<name>/kill: drops the connection of the device abruptly, the broker delivers its offline will then.
+func serveAdmin(address string, m mockers) (*http.Server, error) {
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/devices/", func(w http.ResponseWriter, r *http.Request) {
+		var path = strings.TrimPrefix(r.URL.Path, "/devices/")
+		if !strings.HasSuffix(path, "/kill") {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		var name = strings.TrimSuffix(path, "/kill")
+		var device, exist = m[name]
+		if !exist {
+			http.Error(w, fmt.Sprintf("device %s is not found", name), http.StatusNotFound)
+			return
+		}
+		if err := device.Kill(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Info(fmt.Sprintf("Killed the connection of device %s", name))
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	var listener, err = net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start admin server")
+	}
+	var server = &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error(err, "Failed to serve admin requests")
+		}
+	}()
+	log.Info("Serving admin endpoints on " + address)
+	return server, nil
+}
@@ -0,0 +1,287 @@
+package mqtt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/transport"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/octopus-simulator/pkg/converter"
+	"github.com/rancher/octopus-simulator/pkg/log"
+)
+
+const (
+	readAccess      = "read"
+	writeAccess     = "write"
+	readWriteAccess = "readwrite"
+)
+
+// credentials is the content of credentials file, e.g.
+//
+//	{
+//	  "users": [
+//	    {
+//	      "username": "adaptor",
+//	      "password": "secret",
+//	      "acl": [
+//	        {"topic": "cattle.io/octopus/home/status/#", "access": "read"},
+//	        {"topic": "cattle.io/octopus/home/+/%u/#", "access": "readwrite"}
+//	      ]
+//	    }
+//	  ]
+//	}
+//
+// The user without acl is allowed to all topics, otherwise only the topics matched by the rules are allowed,
+// %u and %c in the topic of a rule are replaced with the username and the client ID.
+type credentials struct {
+	Users []user `json:"users"`
+}
+
+type user struct {
+	Username string    `json:"username"`
+	Password string    `json:"password"`
+	ACL      []aclRule `json:"acl,omitempty"`
+}
+
+type aclRule struct {
+	Topic  string `json:"topic"`
+	Access string `json:"access"`
+}
+
+func loadCredentials(path string) (*credentials, error) {
+	var data, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read credentials file %s", path)
+	}
+	var c credentials
+	if err := converter.UnmarshalJSON(data, &c); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal credentials file %s", path)
+	}
+	for _, u := range c.Users {
+		for _, r := range u.ACL {
+			switch r.Access {
+			case readAccess, writeAccess, readWriteAccess:
+			default:
+				return nil, errors.Errorf("unknown access %s of user %s, select from [%s, %s, %s]", r.Access, u.Username, readAccess, writeAccess, readWriteAccess)
+			}
+		}
+	}
+	return &c, nil
+}
+
+// Authenticate returns the user of the username and password,
+// or the return code of CONNACK if the client is rejected.
+func (in *credentials) Authenticate(username, password string) (*user, packet.ConnackCode) {
+	if username == "" {
+		return nil, packet.NotAuthorized
+	}
+	for i := range in.Users {
+		var u = &in.Users[i]
+		if u.Username == username {
+			if u.Password != password {
+				return nil, packet.BadUsernameOrPassword
+			}
+			return u, packet.ConnectionAccepted
+		}
+	}
+	return nil, packet.BadUsernameOrPassword
+}
+
+// Allows returns true if the user can access the topic filter,
+// subscribing requires read access, and publishing requires write access.
+func (in *user) Allows(clientID, filter, access string) bool {
+	if in == nil {
+		return false
+	}
+	if in.ACL == nil {
+		return true
+	}
+	for _, r := range in.ACL {
+		if r.Access != access && r.Access != readWriteAccess {
+			continue
+		}
+		var topic = strings.NewReplacer("%u", in.Username, "%c", clientID).Replace(r.Topic)
+		if coversFilter(topic, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// coversFilter returns true if all topics matched by the filter are also matched by the rule,
+// a topic name is regarded as a filter without wildcards.
+func coversFilter(rule, filter string) bool {
+	var ruleLevels = strings.Split(rule, "/")
+	var filterLevels = strings.Split(filter, "/")
+	for i, r := range ruleLevels {
+		if r == "#" {
+			return true
+		}
+		if i >= len(filterLevels) {
+			return false
+		}
+		var f = filterLevels[i]
+		switch {
+		case f == "#":
+			return false
+		case r == "+":
+			continue
+		case r != f:
+			return false
+		}
+	}
+	return len(ruleLevels) == len(filterLevels)
+}
+
+// authServer wraps the accepted connections to authenticate and authorize with the credentials.
+type authServer struct {
+	transport.Server
+	credentials *credentials
+}
+
+func (s *authServer) Accept() (transport.Conn, error) {
+	var conn, err = s.Server.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &authConn{
+		Conn:        conn,
+		credentials: s.credentials,
+		denied:      make(map[packet.ID][]int),
+		dropped:     make(map[packet.ID]struct{}),
+	}, nil
+}
+
+// authConn intercepts the packets between the client and the broker,
+// it responds CONNACK with failure code for the rejected clients,
+// removes the denied subscriptions from SUBSCRIBE and inserts failure codes into the corresponding SUBACK,
+// and acknowledges the denied PUBLISH without forwarding it, as MQTT 3.1.1 has no negative PUBACK.
+type authConn struct {
+	transport.Conn
+	credentials *credentials
+
+	// the broker and the interceptor send concurrently
+	sendLock sync.Mutex
+
+	clientID string
+	user     *user
+	// indexes of the denied subscriptions by the packet ID of SUBSCRIBE
+	denied     map[packet.ID][]int
+	deniedLock sync.Mutex
+	// packet IDs of the dropped QoS 2 PUBLISH, which are waiting for PUBREL
+	dropped map[packet.ID]struct{}
+}
+
+func (c *authConn) Send(pkt packet.Generic, async bool) error {
+	if suback, ok := pkt.(*packet.Suback); ok {
+		c.deniedLock.Lock()
+		var indexes = c.denied[suback.ID]
+		delete(c.denied, suback.ID)
+		c.deniedLock.Unlock()
+
+		if len(indexes) != 0 {
+			suback.ReturnCodes = insertFailureCodes(suback.ReturnCodes, indexes)
+		}
+	}
+
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	return c.Conn.Send(pkt, async)
+}
+
+func (c *authConn) Receive() (packet.Generic, error) {
+	for {
+		var pkt, err = c.Conn.Receive()
+		if err != nil {
+			return nil, err
+		}
+
+		switch p := pkt.(type) {
+		case *packet.Connect:
+			var u, code = c.credentials.Authenticate(p.Username, p.Password)
+			if code == packet.ConnectionAccepted && p.Will != nil && !u.Allows(p.ClientID, p.Will.Topic, writeAccess) {
+				log.Info(fmt.Sprintf("Denied client %q of user %q to publish will %s", p.ClientID, p.Username, p.Will.Topic))
+				code = packet.NotAuthorized
+			}
+			if code != packet.ConnectionAccepted {
+				log.Info(fmt.Sprintf("Rejected client %q of user %q from %s: %s", p.ClientID, p.Username, c.RemoteAddr(), code))
+				var connack = packet.NewConnack()
+				connack.ReturnCode = code
+				_ = c.Send(connack, false)
+				_ = c.Close()
+				return nil, errors.Errorf("rejected client %q", p.ClientID)
+			}
+			c.clientID = p.ClientID
+			c.user = u
+		case *packet.Subscribe:
+			var allowed = make([]packet.Subscription, 0, len(p.Subscriptions))
+			var indexes []int
+			for i, sub := range p.Subscriptions {
+				if c.user.Allows(c.clientID, sub.Topic, readAccess) {
+					allowed = append(allowed, sub)
+					continue
+				}
+				log.Info(fmt.Sprintf("Denied client %q of user %q to subscribe %s", c.clientID, c.user.Username, sub.Topic))
+				indexes = append(indexes, i)
+			}
+			if len(indexes) != 0 {
+				c.deniedLock.Lock()
+				c.denied[p.ID] = indexes
+				c.deniedLock.Unlock()
+				p.Subscriptions = allowed
+			}
+		case *packet.Publish:
+			if c.user.Allows(c.clientID, p.Message.Topic, writeAccess) {
+				break
+			}
+			log.Info(fmt.Sprintf("Denied client %q of user %q to publish %s", c.clientID, c.user.Username, p.Message.Topic))
+			switch p.Message.QOS {
+			case packet.QOSAtLeastOnce:
+				var puback = packet.NewPuback()
+				puback.ID = p.ID
+				if err := c.Send(puback, false); err != nil {
+					return nil, err
+				}
+			case packet.QOSExactlyOnce:
+				c.dropped[p.ID] = struct{}{}
+				var pubrec = packet.NewPubrec()
+				pubrec.ID = p.ID
+				if err := c.Send(pubrec, false); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		case *packet.Pubrel:
+			if _, exist := c.dropped[p.ID]; !exist {
+				break
+			}
+			delete(c.dropped, p.ID)
+			var pubcomp = packet.NewPubcomp()
+			pubcomp.ID = p.ID
+			if err := c.Send(pubcomp, false); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return pkt, nil
+	}
+}
+
+// insertFailureCodes inserts the failure codes at the indexes of the removed subscriptions into the granted return codes of SUBACK.
+func insertFailureCodes(granted []packet.QOS, indexes []int) []packet.QOS {
+	var codes = make([]packet.QOS, 0, len(granted)+len(indexes))
+	for i := 0; len(codes) < cap(codes); i++ {
+		if len(indexes) != 0 && indexes[0] == i {
+			codes = append(codes, packet.QOSFailure)
+			indexes = indexes[1:]
+			continue
+		}
+		codes = append(codes, granted[0])
+		granted = granted[1:]
+	}
+	return codes
+}
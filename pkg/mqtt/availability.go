@@ -0,0 +1,29 @@
+package mqtt
+
+import (
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/pkg/errors"
+)
+
+const (
+	onlineAvailability  = "online"
+	offlineAvailability = "offline"
+)
+
+// willMessage is delivered by the broker once the device connection is lost without DISCONNECT.
+func willMessage(availabilityTopic string) *packet.Message {
+	return &packet.Message{
+		Topic:   availabilityTopic,
+		Payload: []byte(offlineAvailability),
+		QOS:     packet.QOSAtLeastOnce,
+		Retain:  true,
+	}
+}
+
+// publishAvailability publishes the retained availability of the device.
+func publishAvailability(svc *mockerService, availabilityTopic, availability string) error {
+	if err := svc.Publish(availabilityTopic, []byte(availability), packet.QOSAtLeastOnce, true); err != nil {
+		return errors.Wrapf(err, "failed to publish %s availability for topic %s", availability, availabilityTopic)
+	}
+	return nil
+}
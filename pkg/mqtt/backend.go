@@ -0,0 +1,432 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/256dpi/gomqtt/broker"
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/session"
+	"github.com/256dpi/gomqtt/topic"
+	"github.com/pkg/errors"
+)
+
+var errQueueFull = errors.New("queue full")
+var errClosing = errors.New("closing")
+var errKillTimeout = errors.New("kill timeout")
+
+// memoryBackend is derived from the memory backend of gomqtt,
+// the session queues are kept in slices rather than channels,
+// so that the retained messages and the persistent sessions can be taken as a snapshot.
+type memoryBackend struct {
+	// the size of the session queue
+	sessionQueueSize int
+	// the time to wait the killed existing client to exit
+	killTimeout time.Duration
+	// the state is persisted to the store if not nil
+	store *backendStore
+
+	logger func(broker.LogEvent, *broker.Client, packet.Generic, *packet.Message, error)
+	stats  backendStats
+
+	activeClients     map[string]*broker.Client
+	storedSessions    map[string]*memorySession
+	temporarySessions map[*broker.Client]*memorySession
+	retainedMessages  *topic.Tree
+	globalMutex       sync.Mutex
+	setupMutex        sync.Mutex
+	closing           bool
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		sessionQueueSize:  100,
+		killTimeout:       5 * time.Second,
+		activeClients:     make(map[string]*broker.Client),
+		storedSessions:    make(map[string]*memorySession),
+		temporarySessions: make(map[*broker.Client]*memorySession),
+		retainedMessages:  topic.NewStandardTree(),
+	}
+}
+
+// Authenticate accepts all clients, the credentials are verified by the authServer.
+func (m *memoryBackend) Authenticate(_ *broker.Client, _, _ string) (bool, error) {
+	m.globalMutex.Lock()
+	defer m.globalMutex.Unlock()
+
+	if m.closing {
+		return false, errClosing
+	}
+	return true, nil
+}
+
+// Setup closes the existing client of the same ID, and returns the stored session if the clean session is not requested.
+func (m *memoryBackend) Setup(client *broker.Client, id string, clean bool) (broker.Session, bool, error) {
+	m.setupMutex.Lock()
+	defer m.setupMutex.Unlock()
+
+	m.globalMutex.Lock()
+	defer m.globalMutex.Unlock()
+
+	if m.closing {
+		return nil, false, errClosing
+	}
+
+	// returns a temporary session if the id is blank
+	if len(id) == 0 {
+		var sess = newMemorySession(m.sessionQueueSize)
+		sess.activeClient = client
+		m.temporarySessions[client] = sess
+		return sess, false, nil
+	}
+
+	// kills the existing client if the session is taken
+	var existingSession, ok = m.storedSessions[id]
+	if !ok {
+		if existingClient, exist := m.activeClients[id]; exist {
+			existingSession, ok = m.temporarySessions[existingClient]
+		}
+	}
+	if ok && existingSession.activeClient != nil {
+		existingSession.activeClient.Close()
+
+		// releases the global mutex to allow the existing client to terminate,
+		// but keeps the setup mutex to prevent other setups
+		m.globalMutex.Unlock()
+		var err error
+		select {
+		case <-existingSession.activeClient.Closed():
+		case <-time.After(m.killTimeout):
+			err = errKillTimeout
+		}
+		m.globalMutex.Lock()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	// deletes the stored session if the clean session is requested
+	if clean {
+		delete(m.storedSessions, id)
+
+		var sess = newMemorySession(m.sessionQueueSize)
+		sess.activeClient = client
+		m.temporarySessions[client] = sess
+		m.activeClients[id] = client
+		return sess, false, nil
+	}
+
+	// reuses the stored session
+	if storedSession, exist := m.storedSessions[id]; exist {
+		storedSession.temporaryQueue.Reset()
+		storedSession.activeClient = client
+		m.activeClients[id] = client
+		return storedSession, true, nil
+	}
+
+	var storedSession = newMemorySession(m.sessionQueueSize)
+	storedSession.activeClient = client
+	m.storedSessions[id] = storedSession
+	m.activeClients[id] = client
+	return storedSession, false, nil
+}
+
+// Restore does nothing, the offline messages are picked up by Dequeue.
+func (m *memoryBackend) Restore(*broker.Client) error {
+	return nil
+}
+
+// Subscribe stores the subscriptions and queues the retained messages.
+func (m *memoryBackend) Subscribe(client *broker.Client, subs []packet.Subscription, ack broker.Ack) error {
+	m.globalMutex.Lock()
+	defer m.globalMutex.Unlock()
+
+	var sess = client.Session().(*memorySession)
+	for i := range subs {
+		var sub = subs[i]
+		sess.subscriptions.Set(sub.Topic, &sub)
+	}
+
+	if ack != nil {
+		ack()
+	}
+
+	for _, sub := range subs {
+		for _, value := range m.retainedMessages.Search(sub.Topic) {
+			var msg = value.(*packet.Message)
+			if excludesSystemTopic(sub.Topic, msg.Topic) {
+				continue
+			}
+			if !sess.temporaryQueue.TryPush(msg) {
+				return errQueueFull
+			}
+		}
+	}
+	return nil
+}
+
+// Unsubscribe deletes the subscriptions.
+func (m *memoryBackend) Unsubscribe(client *broker.Client, topics []string, ack broker.Ack) error {
+	m.globalMutex.Lock()
+	defer m.globalMutex.Unlock()
+
+	var sess = client.Session().(*memorySession)
+	for _, t := range topics {
+		sess.subscriptions.Empty(t)
+	}
+
+	if ack != nil {
+		ack()
+	}
+	return nil
+}
+
+// Publish retains the message and adds it to the queues of the matched sessions,
+// the messages of QoS 1 and 2 are added to the stored queues, which are kept for the offline persistent sessions,
+// the client is nil if the message is published by the broker itself, e.g. the $SYS topics.
+func (m *memoryBackend) Publish(client *broker.Client, msg *packet.Message, ack broker.Ack) error {
+	m.globalMutex.Lock()
+	defer m.globalMutex.Unlock()
+
+	if msg.Retain {
+		if len(msg.Payload) > 0 {
+			m.retainedMessages.Set(msg.Topic, msg.Copy())
+		} else {
+			m.retainedMessages.Empty(msg.Topic)
+		}
+	}
+	msg.Retain = false
+
+	var queue = func(s *memorySession) *messageQueue {
+		if msg.QOS > 0 {
+			return s.storedQueue
+		}
+		return s.temporaryQueue
+	}
+	var enqueue = func(sess *memorySession) error {
+		if sess.lookupSubscription(msg.Topic) == nil {
+			return nil
+		}
+		switch {
+		case client != nil && sess.activeClient == client:
+			// detects the deadlock of adding to its own queue
+			if !queue(sess).TryPush(msg) {
+				return errQueueFull
+			}
+		case sess.activeClient != nil:
+			// waits for room since the client is online
+			queue(sess).Push(msg, sess.activeClient.Closing())
+		default:
+			// ignores the message if the offline queue is full
+			queue(sess).TryPush(msg)
+		}
+		return nil
+	}
+	for _, sess := range m.temporarySessions {
+		if err := enqueue(sess); err != nil {
+			return err
+		}
+	}
+	for _, sess := range m.storedSessions {
+		if err := enqueue(sess); err != nil {
+			return err
+		}
+	}
+
+	if ack != nil {
+		ack()
+	}
+	return nil
+}
+
+// Dequeue takes the next message from the temporary queue or the stored queue.
+func (m *memoryBackend) Dequeue(client *broker.Client) (*packet.Message, broker.Ack, error) {
+	var sess = client.Session().(*memorySession)
+	for {
+		if msg := sess.temporaryQueue.Pop(); msg != nil {
+			return sess.applyQOS(msg), nil, nil
+		}
+		if msg := sess.storedQueue.Pop(); msg != nil {
+			return sess.applyQOS(msg), nil, nil
+		}
+		select {
+		case <-sess.temporaryQueue.pushed:
+		case <-sess.storedQueue.pushed:
+		case <-client.Closing():
+			return nil, nil, nil
+		}
+	}
+}
+
+// Terminate disassociates the session from the client.
+func (m *memoryBackend) Terminate(client *broker.Client) error {
+	m.globalMutex.Lock()
+	defer m.globalMutex.Unlock()
+
+	if sess, ok := client.Session().(*memorySession); ok && sess != nil {
+		sess.activeClient = nil
+	}
+	delete(m.temporarySessions, client)
+	delete(m.activeClients, client.ID())
+	return nil
+}
+
+func (m *memoryBackend) Log(event broker.LogEvent, client *broker.Client, pkt packet.Generic, msg *packet.Message, err error) {
+	m.stats.count(event)
+	if m.logger != nil {
+		m.logger(event, client, pkt, msg, err)
+	}
+}
+
+// Close closes all active clients, and then persists the state if the store is configured,
+// returns false if the clients are not closed in time.
+func (m *memoryBackend) Close(timeout time.Duration) bool {
+	m.globalMutex.Lock()
+	m.closing = true
+	var clients []*broker.Client
+	for _, sess := range m.temporarySessions {
+		sess.activeClient.Close()
+		clients = append(clients, sess.activeClient)
+	}
+	for _, sess := range m.storedSessions {
+		if sess.activeClient != nil {
+			sess.activeClient.Close()
+			clients = append(clients, sess.activeClient)
+		}
+	}
+	m.globalMutex.Unlock()
+
+	var closed = true
+	var deadline = time.After(timeout)
+wait:
+	for _, client := range clients {
+		select {
+		case <-client.Closed():
+		case <-deadline:
+			closed = false
+			break wait
+		}
+	}
+
+	if m.store != nil {
+		m.store.Close(m)
+	}
+	return closed
+}
+
+type memorySession struct {
+	*session.MemorySession
+
+	subscriptions  *topic.Tree
+	storedQueue    *messageQueue
+	temporaryQueue *messageQueue
+	activeClient   *broker.Client
+}
+
+func newMemorySession(backlog int) *memorySession {
+	return &memorySession{
+		MemorySession:  session.NewMemorySession(),
+		subscriptions:  topic.NewStandardTree(),
+		storedQueue:    newMessageQueue(backlog),
+		temporaryQueue: newMessageQueue(backlog),
+	}
+}
+
+func (s *memorySession) lookupSubscription(topic string) *packet.Subscription {
+	for _, value := range s.subscriptions.Match(topic) {
+		var sub = value.(*packet.Subscription)
+		if !excludesSystemTopic(sub.Topic, topic) {
+			return sub
+		}
+	}
+	return nil
+}
+
+// applyQOS downgrades the QoS of the message to the maximum QoS of the subscription.
+func (s *memorySession) applyQOS(msg *packet.Message) *packet.Message {
+	if sub := s.lookupSubscription(msg.Topic); sub != nil && msg.QOS > sub.QOS {
+		msg = msg.Copy()
+		msg.QOS = sub.QOS
+	}
+	return msg
+}
+
+// messageQueue is a bounded FIFO of the messages.
+type messageQueue struct {
+	sync.Mutex
+	size     int
+	messages []*packet.Message
+	// signaled once a message is pushed or popped
+	pushed chan struct{}
+	popped chan struct{}
+}
+
+func newMessageQueue(size int) *messageQueue {
+	return &messageQueue{
+		size:   size,
+		pushed: make(chan struct{}, 1),
+		popped: make(chan struct{}, 1),
+	}
+}
+
+// TryPush adds the message, returns false if the queue is full.
+func (q *messageQueue) TryPush(msg *packet.Message) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.messages) >= q.size {
+		return false
+	}
+	q.messages = append(q.messages, msg)
+	signal(q.pushed)
+	return true
+}
+
+// Push waits for the room to add the message, or gives up once the closing channel is closed.
+func (q *messageQueue) Push(msg *packet.Message, closing <-chan struct{}) {
+	for !q.TryPush(msg) {
+		select {
+		case <-q.popped:
+		case <-closing:
+			return
+		}
+	}
+}
+
+// Pop takes the first message, returns nil if the queue is empty.
+func (q *messageQueue) Pop() *packet.Message {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.messages) == 0 {
+		return nil
+	}
+	var msg = q.messages[0]
+	q.messages[0] = nil
+	q.messages = q.messages[1:]
+	signal(q.popped)
+	return msg
+}
+
+// Messages returns the queued messages.
+func (q *messageQueue) Messages() []*packet.Message {
+	q.Lock()
+	defer q.Unlock()
+
+	return append([]*packet.Message(nil), q.messages...)
+}
+
+func (q *messageQueue) Reset() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.messages = nil
+}
+
+// signal notifies the waiter of the channel without blocking.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
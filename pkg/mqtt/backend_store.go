@@ -0,0 +1,273 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/session"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/octopus-simulator/pkg/converter"
+	"github.com/rancher/octopus-simulator/pkg/log"
+)
+
+// backendSnapshot is the persisted state of the memoryBackend.
+type backendSnapshot struct {
+	Retained []persistedMessage `json:"retained"`
+	Sessions []persistedSession `json:"sessions"`
+}
+
+type persistedMessage struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+	QOS     byte   `json:"qos"`
+	Retain  bool   `json:"retain,omitempty"`
+}
+
+type persistedSubscription struct {
+	Topic string `json:"topic"`
+	QOS   byte   `json:"qos"`
+}
+
+// persistedSession is the session of the client connected with clean-session=false.
+type persistedSession struct {
+	ClientID      string                  `json:"clientID"`
+	Subscriptions []persistedSubscription `json:"subscriptions"`
+	// the QoS 1 and 2 messages queued while the client is offline
+	Queue []persistedMessage `json:"queue"`
+	// the encoded packets in flight, which are resent once the client resumes
+	Incoming [][]byte `json:"incoming,omitempty"`
+	Outgoing [][]byte `json:"outgoing,omitempty"`
+}
+
+// backendStore persists the snapshot of the memoryBackend into the file,
+// the snapshot is written every interval if changed, and once the backend is closed.
+type backendStore struct {
+	path     string
+	interval time.Duration
+	saved    []byte
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+func newBackendStore(path string) *backendStore {
+	return &backendStore{
+		path:     path,
+		interval: time.Second,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Load restores the snapshot into the backend, nothing is restored if the file does not exist.
+func (s *backendStore) Load(m *memoryBackend) error {
+	var data, err = ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to read persistence file %s", s.path)
+	}
+	var snapshot backendSnapshot
+	if err := converter.UnmarshalJSON(data, &snapshot); err != nil {
+		return errors.Wrapf(err, "failed to unmarshal persistence file %s", s.path)
+	}
+
+	m.globalMutex.Lock()
+	defer m.globalMutex.Unlock()
+
+	for _, r := range snapshot.Retained {
+		m.retainedMessages.Set(r.Topic, r.message())
+	}
+	for _, ps := range snapshot.Sessions {
+		var sess = newMemorySession(m.sessionQueueSize)
+		for _, sub := range ps.Subscriptions {
+			sess.subscriptions.Set(sub.Topic, &packet.Subscription{Topic: sub.Topic, QOS: packet.QOS(sub.QOS)})
+		}
+		for _, q := range ps.Queue {
+			sess.storedQueue.TryPush(q.message())
+		}
+		incoming, err := decodePackets(ps.Incoming)
+		if err != nil {
+			return errors.Wrapf(err, "failed to restore incoming packets of %s", ps.ClientID)
+		}
+		outgoing, err := decodePackets(ps.Outgoing)
+		if err != nil {
+			return errors.Wrapf(err, "failed to restore outgoing packets of %s", ps.ClientID)
+		}
+		sess.Incoming = session.NewPacketStoreWithPackets(incoming)
+		sess.Outgoing = session.NewPacketStoreWithPackets(outgoing)
+		// continues after the IDs in flight, so that the new packets do not overwrite them
+		var next packet.ID = 1
+		for _, pkt := range outgoing {
+			if id, ok := packet.GetID(pkt); ok && id >= next {
+				next = id + 1
+			}
+		}
+		sess.Counter = session.NewIDCounterWithNext(next)
+		m.storedSessions[ps.ClientID] = sess
+	}
+	s.saved = data
+	log.Info(fmt.Sprintf("Restored %d retained messages and %d persistent sessions from %s", len(snapshot.Retained), len(snapshot.Sessions), s.path))
+	return nil
+}
+
+// Start writes the snapshot every interval if changed.
+func (s *backendStore) Start(m *memoryBackend) {
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		var ticker = time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+			if err := s.Save(m); err != nil {
+				log.Error(err, "failed to persist broker state", "path", s.path)
+			}
+		}
+	}()
+}
+
+// Close stops the periodic writing and writes the last snapshot.
+func (s *backendStore) Close(m *memoryBackend) {
+	close(s.stop)
+	s.done.Wait()
+	if err := s.Save(m); err != nil {
+		log.Error(err, "failed to persist broker state", "path", s.path)
+	}
+}
+
+// Save writes the snapshot of the backend into the file if changed,
+// the file is replaced atomically to survive the crash during writing.
+func (s *backendStore) Save(m *memoryBackend) error {
+	var data, err = converter.MarshalJSON(takeSnapshot(m))
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal snapshot")
+	}
+	if bytes.Equal(data, s.saved) {
+		return nil
+	}
+
+	var tmp = s.path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create directory of %s", s.path)
+	}
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write %s", tmp)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return errors.Wrapf(err, "failed to replace %s", s.path)
+	}
+	s.saved = data
+	return nil
+}
+
+// takeSnapshot collects the retained messages and the persistent sessions in stable order.
+func takeSnapshot(m *memoryBackend) *backendSnapshot {
+	m.globalMutex.Lock()
+	defer m.globalMutex.Unlock()
+
+	var snapshot = &backendSnapshot{
+		Retained: []persistedMessage{},
+		Sessions: []persistedSession{},
+	}
+	for _, value := range m.retainedMessages.All() {
+		// the statistics are republished by the broker
+		var msg = value.(*packet.Message)
+		if isSystemTopic(msg.Topic) {
+			continue
+		}
+		snapshot.Retained = append(snapshot.Retained, persistedMessageOf(msg))
+	}
+	sort.Slice(snapshot.Retained, func(i, j int) bool {
+		return snapshot.Retained[i].Topic < snapshot.Retained[j].Topic
+	})
+
+	for id, sess := range m.storedSessions {
+		var ps = persistedSession{
+			ClientID:      id,
+			Subscriptions: []persistedSubscription{},
+			Queue:         []persistedMessage{},
+		}
+		for _, value := range sess.subscriptions.All() {
+			var sub = value.(*packet.Subscription)
+			ps.Subscriptions = append(ps.Subscriptions, persistedSubscription{Topic: sub.Topic, QOS: byte(sub.QOS)})
+		}
+		sort.Slice(ps.Subscriptions, func(i, j int) bool {
+			return ps.Subscriptions[i].Topic < ps.Subscriptions[j].Topic
+		})
+		for _, msg := range sess.storedQueue.Messages() {
+			ps.Queue = append(ps.Queue, persistedMessageOf(msg))
+		}
+		ps.Incoming = encodePackets(sess.Incoming.All())
+		ps.Outgoing = encodePackets(sess.Outgoing.All())
+		snapshot.Sessions = append(snapshot.Sessions, ps)
+	}
+	sort.Slice(snapshot.Sessions, func(i, j int) bool {
+		return snapshot.Sessions[i].ClientID < snapshot.Sessions[j].ClientID
+	})
+	return snapshot
+}
+
+func persistedMessageOf(msg *packet.Message) persistedMessage {
+	return persistedMessage{
+		Topic:   msg.Topic,
+		Payload: msg.Payload,
+		QOS:     byte(msg.QOS),
+		Retain:  msg.Retain,
+	}
+}
+
+func (in persistedMessage) message() *packet.Message {
+	return &packet.Message{
+		Topic:   in.Topic,
+		Payload: in.Payload,
+		QOS:     packet.QOS(in.QOS),
+		Retain:  in.Retain,
+	}
+}
+
+// encodePackets encodes the packets in the order of their IDs, the packets failed to encode are skipped.
+func encodePackets(pkts []packet.Generic) [][]byte {
+	sort.Slice(pkts, func(i, j int) bool {
+		var a, _ = packet.GetID(pkts[i])
+		var b, _ = packet.GetID(pkts[j])
+		return a < b
+	})
+	var ret [][]byte
+	for _, pkt := range pkts {
+		var buf = make([]byte, pkt.Len())
+		if _, err := pkt.Encode(buf); err != nil {
+			continue
+		}
+		ret = append(ret, buf)
+	}
+	return ret
+}
+
+func decodePackets(data [][]byte) ([]packet.Generic, error) {
+	var ret = make([]packet.Generic, 0, len(data))
+	for _, bs := range data {
+		var _, typ = packet.DetectPacket(bs)
+		var pkt, err = typ.New()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pkt.Decode(bs); err != nil {
+			return nil, err
+		}
+		ret = append(ret, pkt)
+	}
+	return ret, nil
+}
@@ -0,0 +1,99 @@
+package mqtt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/256dpi/gomqtt/packet"
+)
+
+func TestBackendStoreRoundTrip(t *testing.T) {
+	var m = newMemoryBackend()
+	m.retainedMessages.Set("cattle.io/octopus/home/status/kitchen/door/state", &packet.Message{
+		Topic:   "cattle.io/octopus/home/status/kitchen/door/state",
+		Payload: []byte("closed"),
+		QOS:     packet.QOSAtLeastOnce,
+		Retain:  true,
+	})
+	// the statistics are not persisted
+	m.retainedMessages.Set("$SYS/broker/uptime", &packet.Message{Topic: "$SYS/broker/uptime", Payload: []byte("1"), Retain: true})
+
+	var sess = newMemorySession(m.sessionQueueSize)
+	sess.subscriptions.Set("cattle.io/octopus/home/set/#", &packet.Subscription{Topic: "cattle.io/octopus/home/set/#", QOS: packet.QOSExactlyOnce})
+	sess.subscriptions.Set("cattle.io/octopus/home/get/#", &packet.Subscription{Topic: "cattle.io/octopus/home/get/#", QOS: packet.QOSAtLeastOnce})
+	sess.storedQueue.TryPush(&packet.Message{Topic: "cattle.io/octopus/home/set/kitchen/light/switch", Payload: []byte("true"), QOS: packet.QOSAtLeastOnce})
+	sess.storedQueue.TryPush(&packet.Message{Topic: "cattle.io/octopus/home/set/kitchen/light/gear", Payload: []byte("mid"), QOS: packet.QOSExactlyOnce})
+
+	// the QoS 2 PUBLISH received from the client, which is waiting for PUBREL
+	var incoming = packet.NewPublish()
+	incoming.ID = 7
+	incoming.Message = packet.Message{Topic: "cattle.io/octopus/home/status/kitchen/door/state", Payload: []byte("open"), QOS: packet.QOSExactlyOnce}
+	sess.Incoming.Save(incoming)
+	// the QoS 1 PUBLISH and the PUBREL sent to the client, which are waiting for the acknowledgements
+	var outgoing = packet.NewPublish()
+	outgoing.ID = 5
+	outgoing.Message = packet.Message{Topic: "cattle.io/octopus/home/set/kitchen/light/switch", Payload: []byte("false"), QOS: packet.QOSAtLeastOnce}
+	sess.Outgoing.Save(outgoing)
+	var pubrel = packet.NewPubrel()
+	pubrel.ID = 9
+	sess.Outgoing.Save(pubrel)
+	m.storedSessions["adaptor"] = sess
+	m.storedSessions["empty"] = newMemorySession(m.sessionQueueSize)
+
+	var dir, err = ioutil.TempDir("", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var path = filepath.Join(dir, "state", "broker.json")
+	if err := newBackendStore(path).Save(m); err != nil {
+		t.Fatal(err)
+	}
+
+	var restored = newMemoryBackend()
+	if err := newBackendStore(path).Load(restored); err != nil {
+		t.Fatal(err)
+	}
+	var expected, actual = takeSnapshot(m), takeSnapshot(restored)
+	if len(expected.Retained) != 1 || len(expected.Sessions) != 2 {
+		t.Fatalf("unexpected snapshot %+v", expected)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected restored %+v, but got %+v", expected, actual)
+	}
+
+	// the new packets continue after the IDs in flight
+	if id := restored.storedSessions["adaptor"].NextID(); id != 10 {
+		t.Errorf("expected next packet ID 10, but got %d", id)
+	}
+	if id := restored.storedSessions["empty"].NextID(); id != 1 {
+		t.Errorf("expected next packet ID 1, but got %d", id)
+	}
+}
+
+func TestBackendStoreLoad(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var m = newMemoryBackend()
+	if err := newBackendStore(filepath.Join(dir, "absent.json")).Load(m); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot := takeSnapshot(m); len(snapshot.Retained) != 0 || len(snapshot.Sessions) != 0 {
+		t.Errorf("expected empty backend, but got %+v", snapshot)
+	}
+
+	var path = filepath.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(path, []byte(`{"sessions":[{"clientID":"adaptor","outgoing":["AA=="]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := newBackendStore(path).Load(newMemoryBackend()); err == nil {
+		t.Error("expected error of the invalid packet")
+	}
+}
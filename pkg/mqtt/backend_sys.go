@@ -0,0 +1,188 @@
+package mqtt
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/256dpi/gomqtt/broker"
+	"github.com/256dpi/gomqtt/packet"
+	ldflagsv "k8s.io/client-go/pkg/version"
+
+	"github.com/rancher/octopus-simulator/pkg/log"
+)
+
+const sysTopicPrefix = "$SYS/broker/"
+
+// the windows of the load averages, which follow the 1min, 5min and 15min loads of Mosquitto.
+var sysLoadWindows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// isSystemTopic returns true if the topic starts with $, e.g. $SYS/broker/uptime.
+func isSystemTopic(topic string) bool {
+	return strings.HasPrefix(topic, "$")
+}
+
+// excludesSystemTopic returns true if the filter must not match the topic,
+// the filters starting with wildcards do not match the topics starting with $, e.g. # does not match $SYS/broker/uptime.
+func excludesSystemTopic(filter, topic string) bool {
+	return isSystemTopic(topic) && (strings.HasPrefix(filter, "#") || strings.HasPrefix(filter, "+"))
+}
+
+// backendStats counts the traffic of the backend.
+type backendStats struct {
+	packetsReceived uint64
+	packetsSent     uint64
+	publishReceived uint64
+	publishSent     uint64
+	connections     uint64
+}
+
+func (s *backendStats) count(event broker.LogEvent) {
+	switch event {
+	case broker.PacketReceived:
+		atomic.AddUint64(&s.packetsReceived, 1)
+	case broker.PacketSent:
+		atomic.AddUint64(&s.packetsSent, 1)
+	case broker.MessagePublished:
+		atomic.AddUint64(&s.publishReceived, 1)
+	case broker.MessageForwarded:
+		atomic.AddUint64(&s.publishSent, 1)
+	case broker.NewConnection:
+		atomic.AddUint64(&s.connections, 1)
+	}
+}
+
+// sysPublisher publishes the retained statistics of the backend to the $SYS/broker/... topics every interval.
+type sysPublisher struct {
+	backend  *memoryBackend
+	interval time.Duration
+	started  time.Time
+
+	// the time of the last publishing, the last counters and the load averages per minute of them, keyed by the topic levels
+	last     time.Time
+	counters map[string]uint64
+	loads    map[string][]float64
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+func newSysPublisher(backend *memoryBackend, interval time.Duration) *sysPublisher {
+	return &sysPublisher{
+		backend:  backend,
+		interval: interval,
+		counters: make(map[string]uint64),
+		loads:    make(map[string][]float64),
+		stop:     make(chan struct{}),
+	}
+}
+
+func (p *sysPublisher) Start() {
+	p.started = time.Now()
+	p.last = p.started
+	p.done.Add(1)
+	go func() {
+		defer p.done.Done()
+		var ticker = time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			p.publish()
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (p *sysPublisher) Close() {
+	close(p.stop)
+	p.done.Wait()
+}
+
+func (p *sysPublisher) publish() {
+	var m = p.backend
+	var stats = &m.stats
+
+	var connected, disconnected, subscriptions int
+	m.globalMutex.Lock()
+	for _, sess := range m.temporarySessions {
+		connected++
+		subscriptions += sess.subscriptions.Count()
+	}
+	for _, sess := range m.storedSessions {
+		if sess.activeClient != nil {
+			connected++
+		} else {
+			disconnected++
+		}
+		subscriptions += sess.subscriptions.Count()
+	}
+	var retained = m.retainedMessages.Count()
+	m.globalMutex.Unlock()
+
+	var now = time.Now()
+	var elapsed = now.Sub(p.last)
+	p.last = now
+
+	var values = map[string]string{
+		"version":                 "octopus-simulator " + ldflagsv.Get().GitVersion,
+		"uptime":                  fmt.Sprintf("%d seconds", int64(now.Sub(p.started).Seconds())),
+		"clients/connected":       strconv.Itoa(connected),
+		"clients/disconnected":    strconv.Itoa(disconnected),
+		"clients/total":           strconv.Itoa(connected + disconnected),
+		"subscriptions/count":     strconv.Itoa(subscriptions),
+		"retained messages/count": strconv.Itoa(retained),
+	}
+	var counters = map[string]uint64{
+		"messages/received":         atomic.LoadUint64(&stats.packetsReceived),
+		"messages/sent":             atomic.LoadUint64(&stats.packetsSent),
+		"publish/messages/received": atomic.LoadUint64(&stats.publishReceived),
+		"publish/messages/sent":     atomic.LoadUint64(&stats.publishSent),
+		"connections":               atomic.LoadUint64(&stats.connections),
+	}
+	for name, counter := range counters {
+		if name != "connections" {
+			values[name] = strconv.FormatUint(counter, 10)
+		}
+
+		// the loads are the exponential moving averages of the counts per minute
+		var loads, exist = p.loads[name]
+		if !exist {
+			loads = make([]float64, len(sysLoadWindows))
+			p.loads[name] = loads
+		}
+		if elapsed > 0 {
+			var perMinute = float64(counter-p.counters[name]) / elapsed.Minutes()
+			for i, window := range sysLoadWindows {
+				var decay = math.Exp(-elapsed.Seconds() / window.Seconds())
+				loads[i] = loads[i]*decay + perMinute*(1-decay)
+			}
+		}
+		p.counters[name] = counter
+		for i, window := range sysLoadWindows {
+			values[fmt.Sprintf("load/%s/%s", name, sysLoadWindowName(window))] = strconv.FormatFloat(loads[i], 'f', 2, 64)
+		}
+	}
+
+	for name, value := range values {
+		var msg = &packet.Message{
+			Topic:   sysTopicPrefix + name,
+			Payload: []byte(value),
+			QOS:     packet.QOSAtMostOnce,
+			Retain:  true,
+		}
+		if err := m.Publish(nil, msg, nil); err != nil {
+			log.Error(err, "failed to publish broker statistics", "topic", msg.Topic)
+		}
+	}
+}
+
+func sysLoadWindowName(window time.Duration) string {
+	return fmt.Sprintf("%dmin", int(window.Minutes()))
+}
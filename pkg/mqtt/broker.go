@@ -0,0 +1,241 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/256dpi/gomqtt/broker"
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/transport"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/octopus-simulator/cmd/mqtt/options"
+	"github.com/rancher/octopus-simulator/pkg/log"
+	"github.com/rancher/octopus-simulator/pkg/util/certs"
+	"github.com/rancher/octopus-simulator/pkg/util/log/logflag"
+)
+
+type memoryBroker struct {
+	addresses []string
+	servers   []transport.Server
+	backend   *memoryBackend
+	engine    *broker.Engine
+	// publishes the statistics to the $SYS topics if not nil
+	sys *sysPublisher
+	// injects the faults if not nil
+	chaos *brokerChaos
+}
+
+func (b *memoryBroker) Start() {
+	b.engine = broker.NewEngine(b.backend)
+	if b.backend.store != nil {
+		b.backend.store.Start(b.backend)
+	}
+	if b.sys != nil {
+		b.sys.Start()
+	}
+	if b.chaos != nil {
+		b.chaos.Start()
+	}
+	for i, server := range b.servers {
+		b.engine.Accept(server)
+		log.Info("Listening on " + b.addresses[i])
+	}
+}
+
+func (b *memoryBroker) Close() {
+	if b.chaos != nil {
+		b.chaos.Close()
+	}
+	if b.sys != nil {
+		b.sys.Close()
+	}
+	if b.backend != nil {
+		b.backend.Close(5 * time.Second)
+	}
+	for _, server := range b.servers {
+		_ = server.Close()
+	}
+	if b.engine != nil {
+		b.engine.Close()
+	}
+}
+
+// MockerURL returns the address for the mockers to connect, the secured listeners are preferred,
+// so that the mockers exercise the same secured transport as the adaptors,
+// the unspecified host is replaced with the loopback address to match the server certificate.
+func (b *memoryBroker) MockerURL() string {
+	var address = b.addresses[0]
+	for _, a := range b.addresses {
+		if isSecureURL(a) {
+			address = a
+			break
+		}
+	}
+
+	var u, err = url.Parse(address)
+	if err != nil {
+		return address
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && ip.IsUnspecified() {
+		u.Host = net.JoinHostPort("127.0.0.1", u.Port())
+	}
+	return u.String()
+}
+
+func newMemoryBroker(opts *options.Options) (*memoryBroker, error) {
+	var addresses = opts.Listen
+	if len(addresses) == 0 {
+		var sAddress = "tcp://0.0.0.0:1883"
+		if podIP := os.Getenv("POD_IP"); podIP != "" {
+			sAddress = fmt.Sprintf("tcp://%s:1883", podIP)
+		}
+		addresses = []string{sAddress}
+	}
+
+	var launchConfig transport.LaunchConfig
+	for _, address := range addresses {
+		if !isSecureURL(address) {
+			continue
+		}
+		var tlsConfig, err = newServerTLSConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		launchConfig.TLSConfig = tlsConfig
+		break
+	}
+
+	var creds *credentials
+	if opts.CredentialsFile != "" {
+		var c, err = loadCredentials(opts.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		creds = c
+	}
+
+	chaos, err := newBrokerChaos(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var b = &memoryBroker{
+		addresses: addresses,
+		backend:   newMemoryBackend(),
+		chaos:     chaos,
+	}
+	if opts.PersistenceFile != "" {
+		var store = newBackendStore(opts.PersistenceFile)
+		if err := store.Load(b.backend); err != nil {
+			return nil, err
+		}
+		b.backend.store = store
+	}
+	if opts.SysInterval > 0 {
+		b.sys = newSysPublisher(b.backend, opts.SysInterval)
+	}
+	var launcher = transport.NewLauncher(launchConfig)
+	for _, address := range addresses {
+		var server, err = launcher.Launch(address)
+		if err != nil {
+			b.Close()
+			return nil, errors.Wrapf(err, "failed to launch broker on %s", address)
+		}
+		if creds != nil {
+			server = &authServer{Server: server, credentials: creds}
+		}
+		if chaos != nil {
+			server = &chaosServer{Server: server, chaos: chaos}
+		}
+		b.servers = append(b.servers, server)
+	}
+
+	if logflag.GetLogVerbosity() > 4 {
+		b.backend.logger = func(e broker.LogEvent, c *broker.Client, pkt packet.Generic, msg *packet.Message, err error) {
+			if err != nil {
+				log.Error(err, fmt.Sprintf("[%s]", e))
+			} else if msg != nil {
+				log.Info(fmt.Sprintf("[%s] %s", e, msg.String()))
+			} else if pkt != nil {
+				log.Info(fmt.Sprintf("[%s] %s", e, pkt.String()))
+			} else {
+				log.Info(fmt.Sprintf("%s", e))
+			}
+		}
+	}
+	return b, nil
+}
+
+// newServerTLSConfig creates the TLS configuration of the secured listeners,
+// the client certificates signed by the client CA are required if the client CA is specified.
+func newServerTLSConfig(opts *options.Options) (*tls.Config, error) {
+	if opts.ServerCertFile == "" || opts.ServerKeyFile == "" {
+		return nil, errors.New("server certificate and key are required by the secured listeners")
+	}
+	var cert, err = tls.LoadX509KeyPair(opts.ServerCertFile, opts.ServerKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load server certificate")
+	}
+	var config = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if opts.ClientCAFile != "" {
+		var caPEM, err = ioutil.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read client CA")
+		}
+		var pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.Errorf("failed to parse client CA %s", opts.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// generateCerts creates a throwaway CA and the certificates signed by it into the directory,
+// and then uses them for the secured listeners and the mockers if the corresponding files are not specified,
+// the client CA is left as specified, so that the client certificates are only required by the explicit --client-ca-file.
+func generateCerts(opts *options.Options) error {
+	var dir = opts.GenerateCerts
+	if err := certs.Generate(dir, certs.Hosts(), nil); err != nil {
+		return err
+	}
+	log.Info(fmt.Sprintf("Generated throwaway certificates into %s", dir))
+
+	var defaults = map[*string]string{
+		&opts.ServerCertFile: filepath.Join(dir, "server.pem"),
+		&opts.ServerKeyFile:  filepath.Join(dir, "server-key.pem"),
+		&opts.TLSCAFile:      filepath.Join(dir, "ca.pem"),
+		&opts.TLSCertFile:    filepath.Join(dir, "client.pem"),
+		&opts.TLSKeyFile:     filepath.Join(dir, "client-key.pem"),
+	}
+	for field, value := range defaults {
+		if *field == "" {
+			*field = value
+		}
+	}
+	return nil
+}
+
+func isSecureURL(address string) bool {
+	var u, err = url.Parse(address)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "tls", "ssl", "mqtts", "wss":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,299 @@
+package mqtt
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/transport"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/octopus-simulator/cmd/mqtt/options"
+	"github.com/rancher/octopus-simulator/pkg/log"
+)
+
+// brokerChaos injects the faults into the embedded broker,
+// so that the reconnecting, resubscribing and redelivering of the adaptor can be exercised.
+type brokerChaos struct {
+	// disconnects all clients every interval, or a random client after a random duration up to twice the interval if random
+	disconnectInterval time.Duration
+	disconnectRandom   bool
+	// refuses the new connections for the duration every interval
+	refusalInterval time.Duration
+	refusalDuration time.Duration
+	refusing        int32
+	// delays PUBACK and PUBREC for a random duration up to the delay
+	ackDelay time.Duration
+	// the probabilities of dropping PUBACK and PUBREC, sending PUBLISH twice and failing a subscription
+	ackDropRate          float64
+	duplicateRate        float64
+	subscribeFailureRate float64
+	// the clients of the ID prefix are spared, e.g. the mockers
+	sparedPrefix string
+
+	conns     map[*chaosConn]struct{}
+	connsLock sync.Mutex
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// newBrokerChaos returns nil if no fault is configured.
+func newBrokerChaos(opts *options.Options) (*brokerChaos, error) {
+	var rates = map[string]float64{
+		"chaos-ack-drop-rate":          opts.ChaosAckDropRate,
+		"chaos-duplicate-rate":         opts.ChaosDuplicateRate,
+		"chaos-subscribe-failure-rate": opts.ChaosSubscribeFailureRate,
+	}
+	for name, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return nil, errors.Errorf("%s must be in [0, 1] but got %v", name, rate)
+		}
+	}
+	if opts.ChaosRefusalInterval > 0 && opts.ChaosRefusalDuration >= opts.ChaosRefusalInterval {
+		return nil, errors.Errorf("chaos-refusal-duration must be less than chaos-refusal-interval %v", opts.ChaosRefusalInterval)
+	}
+
+	var c = &brokerChaos{
+		disconnectInterval:   opts.ChaosDisconnectInterval,
+		disconnectRandom:     opts.ChaosDisconnectRandom,
+		refusalInterval:      opts.ChaosRefusalInterval,
+		refusalDuration:      opts.ChaosRefusalDuration,
+		ackDelay:             opts.ChaosAckDelay,
+		ackDropRate:          opts.ChaosAckDropRate,
+		duplicateRate:        opts.ChaosDuplicateRate,
+		subscribeFailureRate: opts.ChaosSubscribeFailureRate,
+		conns:                make(map[*chaosConn]struct{}),
+		stop:                 make(chan struct{}),
+	}
+	if !opts.ChaosIncludeMockers {
+		c.sparedPrefix = opts.ClientIDPrefix
+	}
+	if c.disconnectInterval <= 0 && (c.refusalInterval <= 0 || c.refusalDuration <= 0) && c.ackDelay <= 0 &&
+		c.ackDropRate == 0 && c.duplicateRate == 0 && c.subscribeFailureRate == 0 {
+		return nil, nil
+	}
+	return c, nil
+}
+
+func (c *brokerChaos) Start() {
+	log.Info(fmt.Sprintf("Chaos enabled: disconnect interval %v (random %v), refusal %v every %v, ack delay %v, ack drop rate %v, duplicate rate %v, subscribe failure rate %v",
+		c.disconnectInterval, c.disconnectRandom, c.refusalDuration, c.refusalInterval, c.ackDelay, c.ackDropRate, c.duplicateRate, c.subscribeFailureRate))
+
+	if c.disconnectInterval > 0 {
+		c.done.Add(1)
+		go func() {
+			defer c.done.Done()
+			for {
+				var wait = c.disconnectInterval
+				if c.disconnectRandom {
+					wait = time.Duration(rand.Int63n(int64(2 * c.disconnectInterval)))
+				}
+				select {
+				case <-c.stop:
+					return
+				case <-time.After(wait):
+				}
+				c.disconnect()
+			}
+		}()
+	}
+
+	if c.refusalInterval > 0 && c.refusalDuration > 0 {
+		c.done.Add(1)
+		go func() {
+			defer c.done.Done()
+			var ticker = time.NewTicker(c.refusalInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-c.stop:
+					return
+				case <-ticker.C:
+				}
+				log.Info(fmt.Sprintf("Chaos: refusing new connections for %v", c.refusalDuration))
+				atomic.StoreInt32(&c.refusing, 1)
+				select {
+				case <-c.stop:
+					return
+				case <-time.After(c.refusalDuration):
+				}
+				atomic.StoreInt32(&c.refusing, 0)
+				log.Info("Chaos: accepting new connections")
+			}
+		}()
+	}
+}
+
+func (c *brokerChaos) Close() {
+	close(c.stop)
+	c.done.Wait()
+}
+
+// disconnect closes the connections abruptly as the network is lost,
+// all connections are closed unless random, which closes one of them.
+func (c *brokerChaos) disconnect() {
+	c.connsLock.Lock()
+	var conns = make([]*chaosConn, 0, len(c.conns))
+	for conn := range c.conns {
+		conns = append(conns, conn)
+	}
+	c.connsLock.Unlock()
+	if len(conns) == 0 {
+		return
+	}
+
+	if c.disconnectRandom {
+		var i = rand.Intn(len(conns))
+		conns = conns[i : i+1]
+	}
+	for _, conn := range conns {
+		log.Info(fmt.Sprintf("Chaos: disconnecting client %q from %s", conn.ClientID(), conn.RemoteAddr()))
+		_ = conn.Close()
+	}
+}
+
+func (c *brokerChaos) happens(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// chaosServer wraps the accepted connections to inject the faults.
+type chaosServer struct {
+	transport.Server
+	chaos *brokerChaos
+}
+
+func (s *chaosServer) Accept() (transport.Conn, error) {
+	var conn, err = s.Server.Accept()
+	if err != nil {
+		return nil, err
+	}
+	var c = &chaosConn{
+		Conn:  conn,
+		chaos: s.chaos,
+	}
+	return c, nil
+}
+
+// chaosConn intercepts the packets between the client and the broker,
+// it refuses CONNECT during the refusal windows, delays or drops PUBACK and PUBREC,
+// sends PUBLISH again with the DUP flag, and fails the subscriptions with the failure code of SUBACK.
+type chaosConn struct {
+	transport.Conn
+	chaos *brokerChaos
+
+	clientID atomic.Value
+	spared   int32
+	// indexes of the failed subscriptions by the packet ID of SUBSCRIBE
+	failed     map[packet.ID][]int
+	failedLock sync.Mutex
+}
+
+func (c *chaosConn) ClientID() string {
+	var id, _ = c.clientID.Load().(string)
+	return id
+}
+
+func (c *chaosConn) Send(pkt packet.Generic, async bool) error {
+	if atomic.LoadInt32(&c.spared) == 1 {
+		return c.Conn.Send(pkt, async)
+	}
+
+	switch p := pkt.(type) {
+	case *packet.Puback, *packet.Pubrec:
+		var id, _ = packet.GetID(pkt)
+		if c.chaos.happens(c.chaos.ackDropRate) {
+			log.Info(fmt.Sprintf("Chaos: dropped %s of packet %d to client %q", pkt.Type(), id, c.ClientID()))
+			return nil
+		}
+		if c.chaos.ackDelay > 0 {
+			var delay = time.Duration(rand.Int63n(int64(c.chaos.ackDelay)))
+			log.Info(fmt.Sprintf("Chaos: delayed %s of packet %d to client %q for %v", pkt.Type(), id, c.ClientID(), delay))
+			time.AfterFunc(delay, func() {
+				_ = c.Conn.Send(pkt, false)
+			})
+			return nil
+		}
+	case *packet.Publish:
+		if p.Message.QOS == packet.QOSAtMostOnce || !c.chaos.happens(c.chaos.duplicateRate) {
+			break
+		}
+		if err := c.Conn.Send(pkt, async); err != nil {
+			return err
+		}
+		var dup = *p
+		dup.Dup = true
+		log.Info(fmt.Sprintf("Chaos: duplicated packet %d of %s to client %q", p.ID, p.Message.Topic, c.ClientID()))
+		return c.Conn.Send(&dup, async)
+	case *packet.Suback:
+		c.failedLock.Lock()
+		var indexes = c.failed[p.ID]
+		delete(c.failed, p.ID)
+		c.failedLock.Unlock()
+
+		if len(indexes) != 0 {
+			p.ReturnCodes = insertFailureCodes(p.ReturnCodes, indexes)
+		}
+	}
+	return c.Conn.Send(pkt, async)
+}
+
+func (c *chaosConn) Receive() (packet.Generic, error) {
+	var pkt, err = c.Conn.Receive()
+	if err != nil || atomic.LoadInt32(&c.spared) == 1 {
+		return pkt, err
+	}
+
+	switch p := pkt.(type) {
+	case *packet.Connect:
+		c.clientID.Store(p.ClientID)
+		if c.chaos.sparedPrefix != "" && strings.HasPrefix(p.ClientID, c.chaos.sparedPrefix) {
+			atomic.StoreInt32(&c.spared, 1)
+			break
+		}
+		if atomic.LoadInt32(&c.chaos.refusing) == 0 {
+			c.chaos.connsLock.Lock()
+			c.chaos.conns[c] = struct{}{}
+			c.chaos.connsLock.Unlock()
+			break
+		}
+		log.Info(fmt.Sprintf("Chaos: refused client %q from %s", p.ClientID, c.RemoteAddr()))
+		var connack = packet.NewConnack()
+		connack.ReturnCode = packet.ServerUnavailable
+		_ = c.Conn.Send(connack, false)
+		_ = c.Close()
+		return nil, errors.Errorf("refused client %q", p.ClientID)
+	case *packet.Subscribe:
+		var kept = make([]packet.Subscription, 0, len(p.Subscriptions))
+		var indexes []int
+		for i, sub := range p.Subscriptions {
+			if !c.chaos.happens(c.chaos.subscribeFailureRate) {
+				kept = append(kept, sub)
+				continue
+			}
+			log.Info(fmt.Sprintf("Chaos: failed client %q to subscribe %s", c.ClientID(), sub.Topic))
+			indexes = append(indexes, i)
+		}
+		if len(indexes) != 0 {
+			c.failedLock.Lock()
+			if c.failed == nil {
+				c.failed = make(map[packet.ID][]int)
+			}
+			c.failed[p.ID] = indexes
+			c.failedLock.Unlock()
+			p.Subscriptions = kept
+		}
+	}
+	return pkt, nil
+}
+
+func (c *chaosConn) Close() error {
+	c.chaos.connsLock.Lock()
+	delete(c.chaos.conns, c)
+	c.chaos.connsLock.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,247 @@
+package mqtt
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/octopus-simulator/pkg/converter"
+)
+
+const (
+	textCodec     = "text"
+	jsonCodec     = "json"
+	cborCodec     = "cbor"
+	msgpackCodec  = "msgpack"
+	base64Codec   = "base64"
+	protobufCodec = "protobuf"
+)
+
+// payloadCodec converts between the payloads and the values of the devices,
+// the values are modeled as nil, bool, int64, uint64, float64, string, []byte, []interface{} and map[string]interface{},
+// and the structs are accepted when encoding as they are converted via JSON.
+type payloadCodec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// newPayloadCodec creates the codec by the spec, select from:
+//
+//	text:               the scalar values are formatted as they are, and the others are formatted as JSON.
+//	json:               JSON, the numeric and boolean texts are encoded as numbers and booleans.
+//	cbor:               CBOR, the same values as JSON.
+//	msgpack:            MessagePack, the same values as JSON.
+//	protobuf:<message>: protobuf of the message declared in the descriptor set, the scalar values are carried by the field named value.
+//	base64[+<codec>]:   the payload of the wrapped codec encoded in standard base64, the wrapped codec is text by default.
+func newPayloadCodec(spec string, descriptors *protoDescriptors) (payloadCodec, error) {
+	switch {
+	case spec == textCodec:
+		return textPayloadCodec{}, nil
+	case spec == jsonCodec:
+		return jsonPayloadCodec{}, nil
+	case spec == cborCodec:
+		return cborPayloadCodec{}, nil
+	case spec == msgpackCodec:
+		return msgpackPayloadCodec{}, nil
+	case spec == base64Codec:
+		return base64PayloadCodec{wrapped: textPayloadCodec{}}, nil
+	case strings.HasPrefix(spec, base64Codec+"+"):
+		var wrapped, err = newPayloadCodec(strings.TrimPrefix(spec, base64Codec+"+"), descriptors)
+		if err != nil {
+			return nil, err
+		}
+		return base64PayloadCodec{wrapped: wrapped}, nil
+	case strings.HasPrefix(spec, protobufCodec+":"):
+		if descriptors == nil {
+			return nil, errors.New("protobuf codec requires the descriptor set")
+		}
+		var name = strings.TrimPrefix(spec, protobufCodec+":")
+		var message = descriptors.Message(name)
+		if message == nil {
+			return nil, errors.Errorf("protobuf message %s is not found in the descriptor set", name)
+		}
+		return protobufPayloadCodec{message: message}, nil
+	}
+	return nil, errors.Errorf("unknown payload codec %s, select from [%s, %s, %s, %s, %s:<message>, %s[+<codec>]]",
+		spec, textCodec, jsonCodec, cborCodec, msgpackCodec, protobufCodec, base64Codec)
+}
+
+type textPayloadCodec struct{}
+
+func (textPayloadCodec) Encode(v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case string:
+		return []byte(t), nil
+	case []byte:
+		return t, nil
+	case nil, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return []byte(textOf(t)), nil
+	}
+	return marshalValue(v)
+}
+
+func (textPayloadCodec) Decode(data []byte) (interface{}, error) {
+	return string(data), nil
+}
+
+type jsonPayloadCodec struct{}
+
+func (jsonPayloadCodec) Encode(v interface{}) ([]byte, error) {
+	if s, ok := v.(string); ok {
+		return marshalValue(inferValue(s))
+	}
+	return marshalValue(v)
+}
+
+func (jsonPayloadCodec) Decode(data []byte) (interface{}, error) {
+	var v interface{}
+	if err := converter.UnmarshalJSON(data, &v); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal JSON")
+	}
+	return v, nil
+}
+
+type base64PayloadCodec struct {
+	wrapped payloadCodec
+}
+
+func (c base64PayloadCodec) Encode(v interface{}) ([]byte, error) {
+	var data, err = c.wrapped.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return converter.EncodeBase64(data), nil
+}
+
+func (c base64PayloadCodec) Decode(data []byte) (interface{}, error) {
+	var decoded, err = converter.DecodeBase64(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode base64")
+	}
+	return c.wrapped.Decode(decoded)
+}
+
+// textOf formats the scalar value as text, and the others as JSON.
+func textOf(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case []byte:
+		return string(t)
+	case bool:
+		return strconv.FormatBool(t)
+	case int:
+		return strconv.FormatInt(int64(t), 10)
+	case int32:
+		return strconv.FormatInt(int64(t), 10)
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case uint:
+		return strconv.FormatUint(uint64(t), 10)
+	case uint32:
+		return strconv.FormatUint(uint64(t), 10)
+	case uint64:
+		return strconv.FormatUint(t, 10)
+	case float32:
+		return strconv.FormatFloat(float64(t), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	var data, _ = marshalValue(v)
+	return string(data)
+}
+
+// marshalValue marshals the value as JSON, the generic values are marshaled with encoding/json,
+// because the map iteration of reflect2 under jsoniter is broken by the newer Go runtimes.
+func marshalValue(v interface{}) ([]byte, error) {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+	default:
+		return converter.MarshalJSON(v)
+	}
+	var buf bytes.Buffer
+	var enc = stdjson.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// inferValue parses the text into the JSON object or array, the boolean or the number if possible,
+// e.g. "true" results in true, "245" results in 245, and "wood" is kept.
+func inferValue(s string) interface{} {
+	if strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[") {
+		var v interface{}
+		if err := converter.UnmarshalJSON([]byte(s), &v); err == nil {
+			return v
+		}
+		return s
+	}
+	if s == "true" || s == "false" {
+		return s == "true"
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return s
+}
+
+// genericOf converts the value into the generic model, the texts are inferred by inferValue,
+// and the others which are not in the model are converted via JSON.
+func genericOf(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case nil, bool, int64, uint64, float64, []byte:
+		return t, nil
+	case string:
+		return inferValue(t), nil
+	case int:
+		return int64(t), nil
+	case int32:
+		return int64(t), nil
+	case uint:
+		return uint64(t), nil
+	case uint32:
+		return uint64(t), nil
+	case float32:
+		return float64(t), nil
+	case []interface{}:
+		var ret = make([]interface{}, 0, len(t))
+		for _, e := range t {
+			var g, err = genericOf(e)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, g)
+		}
+		return ret, nil
+	case map[string]interface{}:
+		var ret = make(map[string]interface{}, len(t))
+		for k, e := range t {
+			var g, err = genericOf(e)
+			if err != nil {
+				return nil, err
+			}
+			ret[k] = g
+		}
+		return ret, nil
+	}
+
+	var data, err = converter.MarshalJSON(v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to convert %T value", v)
+	}
+	var ret interface{}
+	if err := converter.UnmarshalJSON(data, &ret); err != nil {
+		return nil, errors.Wrapf(err, "failed to convert %T value", v)
+	}
+	return ret, nil
+}
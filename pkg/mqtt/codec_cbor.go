@@ -0,0 +1,252 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// the major types of CBOR, defined by RFC 8949.
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborBytes    = 2
+	cborText     = 3
+	cborArray    = 4
+	cborMap      = 5
+	cborTag      = 6
+	cborSimple   = 7
+)
+
+type cborPayloadCodec struct{}
+
+func (cborPayloadCodec) Encode(v interface{}) ([]byte, error) {
+	var g, err = genericOf(v)
+	if err != nil {
+		return nil, err
+	}
+	return appendCBOR(nil, g)
+}
+
+func (cborPayloadCodec) Decode(data []byte) (interface{}, error) {
+	var v, rest, err = readCBOR(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode CBOR")
+	}
+	if len(rest) != 0 {
+		return nil, errors.Errorf("failed to decode CBOR: %d trailing bytes", len(rest))
+	}
+	return v, nil
+}
+
+func appendCBORHead(b []byte, major byte, n uint64) []byte {
+	var m = major << 5
+	switch {
+	case n < 24:
+		return append(b, m|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, m|24, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, m|25, 0, 0)
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(n))
+		return b
+	case n <= math.MaxUint32:
+		b = append(b, m|26, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], uint32(n))
+		return b
+	}
+	b = append(b, m|27, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(b[len(b)-8:], n)
+	return b
+}
+
+func appendCBOR(b []byte, v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case nil:
+		return append(b, cborSimple<<5|22), nil
+	case bool:
+		if t {
+			return append(b, cborSimple<<5|21), nil
+		}
+		return append(b, cborSimple<<5|20), nil
+	case int64:
+		if t < 0 {
+			return appendCBORHead(b, cborNegative, uint64(-(t + 1))), nil
+		}
+		return appendCBORHead(b, cborUnsigned, uint64(t)), nil
+	case uint64:
+		return appendCBORHead(b, cborUnsigned, t), nil
+	case float64:
+		b = append(b, cborSimple<<5|27, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(b[len(b)-8:], math.Float64bits(t))
+		return b, nil
+	case string:
+		return append(appendCBORHead(b, cborText, uint64(len(t))), t...), nil
+	case []byte:
+		return append(appendCBORHead(b, cborBytes, uint64(len(t))), t...), nil
+	case []interface{}:
+		b = appendCBORHead(b, cborArray, uint64(len(t)))
+		for _, e := range t {
+			var err error
+			if b, err = appendCBOR(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		b = appendCBORHead(b, cborMap, uint64(len(t)))
+		for _, k := range sortedKeys(t) {
+			b = append(appendCBORHead(b, cborText, uint64(len(k))), k...)
+			var err error
+			if b, err = appendCBOR(b, t[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, errors.Errorf("cannot encode %T value as CBOR", v)
+}
+
+// readCBORHead returns the major type, the additional information, the argument and the rest of data.
+func readCBORHead(data []byte) (byte, byte, uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, 0, nil, errors.New("unexpected end of data")
+	}
+	var major, info = data[0] >> 5, data[0] & 0x1f
+	data = data[1:]
+	var size int
+	switch {
+	case info < 24:
+		return major, info, uint64(info), data, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, 0, nil, errors.Errorf("unsupported additional information %d", info)
+	}
+	if len(data) < size {
+		return 0, 0, 0, nil, errors.New("unexpected end of data")
+	}
+	var n uint64
+	for _, c := range data[:size] {
+		n = n<<8 | uint64(c)
+	}
+	return major, info, n, data[size:], nil
+}
+
+func readCBOR(data []byte) (interface{}, []byte, error) {
+	var major, info, n, rest, err = readCBORHead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch major {
+	case cborUnsigned:
+		if n > math.MaxInt64 {
+			return n, rest, nil
+		}
+		return int64(n), rest, nil
+	case cborNegative:
+		if n > math.MaxInt64 {
+			return nil, nil, errors.New("negative integer overflows int64")
+		}
+		return -int64(n) - 1, rest, nil
+	case cborBytes, cborText:
+		if uint64(len(rest)) < n {
+			return nil, nil, errors.New("unexpected end of data")
+		}
+		if major == cborText {
+			return string(rest[:n]), rest[n:], nil
+		}
+		return append([]byte(nil), rest[:n]...), rest[n:], nil
+	case cborArray:
+		// each element takes one byte at least, which rejects the forged length before allocating
+		if uint64(len(rest)) < n {
+			return nil, nil, errors.New("unexpected end of data")
+		}
+		var ret = make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var e interface{}
+			if e, rest, err = readCBOR(rest); err != nil {
+				return nil, nil, err
+			}
+			ret = append(ret, e)
+		}
+		return ret, rest, nil
+	case cborMap:
+		if uint64(len(rest))/2 < n {
+			return nil, nil, errors.New("unexpected end of data")
+		}
+		var ret = make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			var k, e interface{}
+			if k, rest, err = readCBOR(rest); err != nil {
+				return nil, nil, err
+			}
+			if e, rest, err = readCBOR(rest); err != nil {
+				return nil, nil, err
+			}
+			ret[keyOf(k)] = e
+		}
+		return ret, rest, nil
+	case cborTag:
+		// the tags are ignored, e.g. the epoch time is decoded as the number
+		return readCBOR(rest)
+	}
+
+	switch info {
+	case 20:
+		return false, rest, nil
+	case 21:
+		return true, rest, nil
+	case 22, 23:
+		return nil, rest, nil
+	case 25:
+		return float64(halfToFloat32(uint16(n))), rest, nil
+	case 26:
+		return float64(math.Float32frombits(uint32(n))), rest, nil
+	case 27:
+		return math.Float64frombits(n), rest, nil
+	}
+	return nil, nil, errors.Errorf("unsupported simple value %d", info)
+}
+
+func halfToFloat32(h uint16) float32 {
+	var sign = uint32(h>>15) << 31
+	var exp = uint32(h>>10) & 0x1f
+	var frac = uint32(h) & 0x3ff
+	switch exp {
+	case 0:
+		var f = float32(frac) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0xff<<23 | frac<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | frac<<13)
+}
+
+func keyOf(k interface{}) string {
+	if s, ok := k.(string); ok {
+		return s
+	}
+	return fmt.Sprint(k)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	var keys = make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,257 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+type msgpackPayloadCodec struct{}
+
+func (msgpackPayloadCodec) Encode(v interface{}) ([]byte, error) {
+	var g, err = genericOf(v)
+	if err != nil {
+		return nil, err
+	}
+	return appendMsgpack(nil, g)
+}
+
+func (msgpackPayloadCodec) Decode(data []byte) (interface{}, error) {
+	var v, rest, err = readMsgpack(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode MessagePack")
+	}
+	if len(rest) != 0 {
+		return nil, errors.Errorf("failed to decode MessagePack: %d trailing bytes", len(rest))
+	}
+	return v, nil
+}
+
+// appendMsgpackSized appends the fix format if the size fits, otherwise the 8, 16 or 32 bits formats.
+func appendMsgpackSized(b []byte, fix byte, fixMax int, f8, f16, f32 byte, n int) []byte {
+	switch {
+	case n <= fixMax:
+		return append(b, fix|byte(n))
+	case f8 != 0 && n <= math.MaxUint8:
+		return append(b, f8, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, f16, 0, 0)
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(n))
+		return b
+	}
+	b = append(b, f32, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], uint32(n))
+	return b
+}
+
+func appendMsgpack(b []byte, v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if t {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case int64:
+		switch {
+		case t >= 0:
+			return appendMsgpack(b, uint64(t))
+		case t >= -32:
+			return append(b, byte(t)), nil
+		case t >= math.MinInt8:
+			return append(b, 0xd0, byte(t)), nil
+		case t >= math.MinInt16:
+			b = append(b, 0xd1, 0, 0)
+			binary.BigEndian.PutUint16(b[len(b)-2:], uint16(t))
+			return b, nil
+		case t >= math.MinInt32:
+			b = append(b, 0xd2, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(b[len(b)-4:], uint32(t))
+			return b, nil
+		}
+		b = append(b, 0xd3, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(b[len(b)-8:], uint64(t))
+		return b, nil
+	case uint64:
+		switch {
+		case t <= 0x7f:
+			return append(b, byte(t)), nil
+		case t <= math.MaxUint8:
+			return append(b, 0xcc, byte(t)), nil
+		case t <= math.MaxUint16:
+			b = append(b, 0xcd, 0, 0)
+			binary.BigEndian.PutUint16(b[len(b)-2:], uint16(t))
+			return b, nil
+		case t <= math.MaxUint32:
+			b = append(b, 0xce, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(b[len(b)-4:], uint32(t))
+			return b, nil
+		}
+		b = append(b, 0xcf, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(b[len(b)-8:], t)
+		return b, nil
+	case float64:
+		b = append(b, 0xcb, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(b[len(b)-8:], math.Float64bits(t))
+		return b, nil
+	case string:
+		return append(appendMsgpackSized(b, 0xa0, 31, 0xd9, 0xda, 0xdb, len(t)), t...), nil
+	case []byte:
+		return append(appendMsgpackSized(b, 0xc4, -1, 0xc4, 0xc5, 0xc6, len(t)), t...), nil
+	case []interface{}:
+		b = appendMsgpackSized(b, 0x90, 15, 0, 0xdc, 0xdd, len(t))
+		for _, e := range t {
+			var err error
+			if b, err = appendMsgpack(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		b = appendMsgpackSized(b, 0x80, 15, 0, 0xde, 0xdf, len(t))
+		for _, k := range sortedKeys(t) {
+			b = append(appendMsgpackSized(b, 0xa0, 31, 0xd9, 0xda, 0xdb, len(k)), k...)
+			var err error
+			if b, err = appendMsgpack(b, t[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, errors.Errorf("cannot encode %T value as MessagePack", v)
+}
+
+// readMsgpackUint reads the big endian unsigned integer of the size.
+func readMsgpackUint(data []byte, size int) (uint64, []byte, error) {
+	if len(data) < size {
+		return 0, nil, errors.New("unexpected end of data")
+	}
+	var n uint64
+	for _, c := range data[:size] {
+		n = n<<8 | uint64(c)
+	}
+	return n, data[size:], nil
+}
+
+func readMsgpack(data []byte) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, errors.New("unexpected end of data")
+	}
+	var c, rest = data[0], data[1:]
+	switch {
+	case c <= 0x7f:
+		return int64(c), rest, nil
+	case c >= 0xe0:
+		return int64(int8(c)), rest, nil
+	case c&0xf0 == 0x80:
+		return readMsgpackMap(rest, int(c&0x0f))
+	case c&0xf0 == 0x90:
+		return readMsgpackArray(rest, int(c&0x0f))
+	case c&0xe0 == 0xa0:
+		return readMsgpackBytes(rest, int(c&0x1f), true)
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, rest, nil
+	case 0xc2:
+		return false, rest, nil
+	case 0xc3:
+		return true, rest, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		var size = map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4, 0xd9: 1, 0xda: 2, 0xdb: 4}[c]
+		var n, rest, err = readMsgpackUint(rest, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackBytes(rest, int(n), c >= 0xd9)
+	case 0xca:
+		var n, rest, err = readMsgpackUint(rest, 4)
+		return float64(math.Float32frombits(uint32(n))), rest, err
+	case 0xcb:
+		var n, rest, err = readMsgpackUint(rest, 8)
+		return math.Float64frombits(n), rest, err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		var n, rest, err = readMsgpackUint(rest, 1<<(c-0xcc))
+		if err != nil {
+			return nil, nil, err
+		}
+		if n > math.MaxInt64 {
+			return n, rest, nil
+		}
+		return int64(n), rest, nil
+	case 0xd0:
+		var n, rest, err = readMsgpackUint(rest, 1)
+		return int64(int8(n)), rest, err
+	case 0xd1:
+		var n, rest, err = readMsgpackUint(rest, 2)
+		return int64(int16(n)), rest, err
+	case 0xd2:
+		var n, rest, err = readMsgpackUint(rest, 4)
+		return int64(int32(n)), rest, err
+	case 0xd3:
+		var n, rest, err = readMsgpackUint(rest, 8)
+		return int64(n), rest, err
+	case 0xdc, 0xdd:
+		var n, rest, err = readMsgpackUint(rest, 2*int(c-0xdb))
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackArray(rest, int(n))
+	case 0xde, 0xdf:
+		var n, rest, err = readMsgpackUint(rest, 2*int(c-0xdd))
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackMap(rest, int(n))
+	}
+	return nil, nil, errors.Errorf("unsupported format 0x%02x", c)
+}
+
+func readMsgpackBytes(data []byte, n int, text bool) (interface{}, []byte, error) {
+	if len(data) < n {
+		return nil, nil, errors.New("unexpected end of data")
+	}
+	if text {
+		return string(data[:n]), data[n:], nil
+	}
+	return append([]byte(nil), data[:n]...), data[n:], nil
+}
+
+func readMsgpackArray(data []byte, n int) (interface{}, []byte, error) {
+	// each element takes one byte at least, which rejects the forged length before allocating
+	if len(data) < n {
+		return nil, nil, errors.New("unexpected end of data")
+	}
+	var ret = make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		var e interface{}
+		var err error
+		if e, data, err = readMsgpack(data); err != nil {
+			return nil, nil, err
+		}
+		ret = append(ret, e)
+	}
+	return ret, data, nil
+}
+
+func readMsgpackMap(data []byte, n int) (interface{}, []byte, error) {
+	if len(data)/2 < n {
+		return nil, nil, errors.New("unexpected end of data")
+	}
+	var ret = make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		var k, e interface{}
+		var err error
+		if k, data, err = readMsgpack(data); err != nil {
+			return nil, nil, err
+		}
+		if e, data, err = readMsgpack(data); err != nil {
+			return nil, nil, err
+		}
+		ret[keyOf(k)] = e
+	}
+	return ret, data, nil
+}
@@ -0,0 +1,567 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// the field types of google.protobuf.FieldDescriptorProto.
+const (
+	protoDouble   = 1
+	protoFloat    = 2
+	protoInt64    = 3
+	protoUint64   = 4
+	protoInt32    = 5
+	protoFixed64  = 6
+	protoFixed32  = 7
+	protoBool     = 8
+	protoString   = 9
+	protoMessage  = 11
+	protoBytes    = 12
+	protoUint32   = 13
+	protoEnum     = 14
+	protoSfixed32 = 15
+	protoSfixed64 = 16
+	protoSint32   = 17
+	protoSint64   = 18
+
+	protoRepeated = 3
+)
+
+// protoDescriptors is the messages declared in a google.protobuf.FileDescriptorSet,
+// which is generated by `protoc --include_imports --descriptor_set_out=<file>`.
+type protoDescriptors struct {
+	messages map[string]*protoMessageDescriptor
+	enums    map[string]*protoEnumDescriptor
+}
+
+type protoMessageDescriptor struct {
+	name   string
+	fields []*protoFieldDescriptor
+}
+
+type protoFieldDescriptor struct {
+	name     string
+	jsonName string
+	number   uint64
+	label    uint64
+	typ      uint64
+	typeName string
+	message  *protoMessageDescriptor
+	enum     *protoEnumDescriptor
+}
+
+type protoEnumDescriptor struct {
+	numbers map[string]int64
+	names   map[int64]string
+}
+
+func loadProtoDescriptors(path string) (*protoDescriptors, error) {
+	var data, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read protobuf descriptor set %s", path)
+	}
+	var d = &protoDescriptors{
+		messages: make(map[string]*protoMessageDescriptor),
+		enums:    make(map[string]*protoEnumDescriptor),
+	}
+	// FileDescriptorSet.file = 1
+	err = walkFields(data, func(field uint64, _ uint64, bs []byte) error {
+		if field != 1 {
+			return nil
+		}
+		return d.parseFile(bs)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse protobuf descriptor set %s", path)
+	}
+	for _, m := range d.messages {
+		for _, f := range m.fields {
+			var name = strings.TrimPrefix(f.typeName, ".")
+			switch f.typ {
+			case protoMessage:
+				if f.message = d.messages[name]; f.message == nil {
+					return nil, errors.Errorf("message %s of field %s.%s is not found", name, m.name, f.name)
+				}
+			case protoEnum:
+				if f.enum = d.enums[name]; f.enum == nil {
+					return nil, errors.Errorf("enum %s of field %s.%s is not found", name, m.name, f.name)
+				}
+			}
+		}
+	}
+	return d, nil
+}
+
+// Message returns the message of the full name, e.g. octopus.BedroomLight.
+func (d *protoDescriptors) Message(name string) *protoMessageDescriptor {
+	return d.messages[strings.TrimPrefix(name, ".")]
+}
+
+// parseFile parses FileDescriptorProto: package = 2, message_type = 4, enum_type = 5.
+func (d *protoDescriptors) parseFile(data []byte) error {
+	var pkg string
+	var messages, enums [][]byte
+	var err = walkFields(data, func(field uint64, _ uint64, bs []byte) error {
+		switch field {
+		case 2:
+			pkg = string(bs)
+		case 4:
+			messages = append(messages, bs)
+		case 5:
+			enums = append(enums, bs)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, bs := range messages {
+		if err := d.parseMessage(pkg, bs); err != nil {
+			return err
+		}
+	}
+	for _, bs := range enums {
+		if err := d.parseEnum(pkg, bs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMessage parses DescriptorProto: name = 1, field = 2, nested_type = 3, enum_type = 4.
+func (d *protoDescriptors) parseMessage(scope string, data []byte) error {
+	var m = &protoMessageDescriptor{}
+	var nested, enums [][]byte
+	var err = walkFields(data, func(field uint64, _ uint64, bs []byte) error {
+		switch field {
+		case 1:
+			m.name = joinProtoName(scope, string(bs))
+		case 2:
+			var f, err = parseProtoField(bs)
+			if err != nil {
+				return err
+			}
+			m.fields = append(m.fields, f)
+		case 3:
+			nested = append(nested, bs)
+		case 4:
+			enums = append(enums, bs)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.messages[m.name] = m
+	for _, bs := range nested {
+		if err := d.parseMessage(m.name, bs); err != nil {
+			return err
+		}
+	}
+	for _, bs := range enums {
+		if err := d.parseEnum(m.name, bs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseProtoField parses FieldDescriptorProto: name = 1, number = 3, label = 4, type = 5, type_name = 6, json_name = 10.
+func parseProtoField(data []byte) (*protoFieldDescriptor, error) {
+	var f = &protoFieldDescriptor{}
+	var err = walkFields(data, func(field uint64, n uint64, bs []byte) error {
+		switch field {
+		case 1:
+			f.name = string(bs)
+		case 3:
+			f.number = n
+		case 4:
+			f.label = n
+		case 5:
+			f.typ = n
+		case 6:
+			f.typeName = string(bs)
+		case 10:
+			f.jsonName = string(bs)
+		}
+		return nil
+	})
+	if f.jsonName == "" {
+		f.jsonName = f.name
+	}
+	return f, err
+}
+
+// parseEnum parses EnumDescriptorProto: name = 1, value = 2 with EnumValueDescriptorProto: name = 1, number = 2.
+func (d *protoDescriptors) parseEnum(scope string, data []byte) error {
+	var name string
+	var e = &protoEnumDescriptor{
+		numbers: make(map[string]int64),
+		names:   make(map[int64]string),
+	}
+	var err = walkFields(data, func(field uint64, _ uint64, bs []byte) error {
+		switch field {
+		case 1:
+			name = joinProtoName(scope, string(bs))
+		case 2:
+			var valueName string
+			var number int64
+			if err := walkFields(bs, func(field uint64, n uint64, bs []byte) error {
+				switch field {
+				case 1:
+					valueName = string(bs)
+				case 2:
+					number = int64(int32(n))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			e.numbers[valueName] = number
+			e.names[number] = valueName
+		}
+		return nil
+	})
+	d.enums[name] = e
+	return err
+}
+
+func joinProtoName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+func (m *protoMessageDescriptor) field(name string) *protoFieldDescriptor {
+	for _, f := range m.fields {
+		if f.name == name || f.jsonName == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func (m *protoMessageDescriptor) fieldByNumber(number uint64) *protoFieldDescriptor {
+	for _, f := range m.fields {
+		if f.number == number {
+			return f
+		}
+	}
+	return nil
+}
+
+type protobufPayloadCodec struct {
+	message *protoMessageDescriptor
+}
+
+func (c protobufPayloadCodec) Encode(v interface{}) ([]byte, error) {
+	var g, err = genericOf(v)
+	if err != nil {
+		return nil, err
+	}
+	var m, ok = g.(map[string]interface{})
+	if !ok {
+		m = map[string]interface{}{"value": g}
+	}
+	return appendProtoMessage(nil, c.message, m)
+}
+
+func (c protobufPayloadCodec) Decode(data []byte) (interface{}, error) {
+	var v, err = readProtoMessage(data, c.message)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode protobuf message %s", c.message.name)
+	}
+	return v, nil
+}
+
+func appendProtoMessage(b []byte, m *protoMessageDescriptor, values map[string]interface{}) ([]byte, error) {
+	for _, k := range sortedKeys(values) {
+		var f = m.field(k)
+		if f == nil {
+			return nil, errors.Errorf("unknown field %s of message %s", k, m.name)
+		}
+		var v = values[k]
+		if v == nil {
+			continue
+		}
+
+		var err error
+		if f.label != protoRepeated {
+			if b, err = appendProtoField(b, f, v); err != nil {
+				return nil, errors.Wrapf(err, "failed to encode field %s of message %s", f.name, m.name)
+			}
+			continue
+		}
+		var items, ok = v.([]interface{})
+		if !ok {
+			return nil, errors.Errorf("repeated field %s of message %s requires array, but got %T", f.name, m.name, v)
+		}
+		for _, item := range items {
+			if b, err = appendProtoField(b, f, item); err != nil {
+				return nil, errors.Wrapf(err, "failed to encode field %s of message %s", f.name, m.name)
+			}
+		}
+	}
+	return b, nil
+}
+
+func appendProtoField(b []byte, f *protoFieldDescriptor, v interface{}) ([]byte, error) {
+	switch f.typ {
+	case protoDouble, protoFixed64, protoSfixed64:
+		var n, err = protoFixed64Of(f.typ, v)
+		if err != nil {
+			return nil, err
+		}
+		b = appendTag(b, f.number, wireFixed64)
+		b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint64(b[len(b)-8:], n)
+		return b, nil
+	case protoFloat, protoFixed32, protoSfixed32:
+		var n, err = protoFixed32Of(f.typ, v)
+		if err != nil {
+			return nil, err
+		}
+		b = appendTag(b, f.number, wireFixed32)
+		b = append(b, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[len(b)-4:], n)
+		return b, nil
+	case protoString, protoBytes:
+		var bs []byte
+		switch t := v.(type) {
+		case []byte:
+			bs = t
+		default:
+			bs = []byte(textOf(t))
+		}
+		return appendBytesField(b, f.number, bs), nil
+	case protoMessage:
+		var m, ok = v.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("message requires object, but got %T", v)
+		}
+		var bs, err = appendProtoMessage(nil, f.message, m)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytesField(b, f.number, bs), nil
+	}
+	var n, err = protoVarintOf(f, v)
+	if err != nil {
+		return nil, err
+	}
+	return appendVarintField(b, f.number, n), nil
+}
+
+func protoVarintOf(f *protoFieldDescriptor, v interface{}) (uint64, error) {
+	switch f.typ {
+	case protoBool:
+		switch t := v.(type) {
+		case bool:
+			if t {
+				return 1, nil
+			}
+			return 0, nil
+		case string:
+			var b, err = strconv.ParseBool(t)
+			if err != nil {
+				return 0, err
+			}
+			return protoVarintOf(f, b)
+		}
+		return 0, errors.Errorf("bool requires boolean, but got %T", v)
+	case protoEnum:
+		if s, ok := v.(string); ok {
+			var n, exist = f.enum.numbers[s]
+			if !exist {
+				return 0, errors.Errorf("unknown enum value %s", s)
+			}
+			return uint64(n), nil
+		}
+	}
+
+	var i, err = int64Of(v)
+	if err != nil {
+		return 0, err
+	}
+	switch f.typ {
+	case protoSint32, protoSint64:
+		return uint64(i<<1) ^ uint64(i>>63), nil
+	case protoInt32, protoEnum:
+		// the negative int32 is sign extended as int64
+		return uint64(int64(int32(i))), nil
+	case protoUint32:
+		return uint64(uint32(i)), nil
+	}
+	return uint64(i), nil
+}
+
+func protoFixed64Of(typ uint64, v interface{}) (uint64, error) {
+	if typ == protoDouble {
+		var f, err = float64Of(v)
+		return math.Float64bits(f), err
+	}
+	var i, err = int64Of(v)
+	return uint64(i), err
+}
+
+func protoFixed32Of(typ uint64, v interface{}) (uint32, error) {
+	if typ == protoFloat {
+		var f, err = float64Of(v)
+		return math.Float32bits(float32(f)), err
+	}
+	var i, err = int64Of(v)
+	return uint32(i), err
+}
+
+func int64Of(v interface{}) (int64, error) {
+	switch t := v.(type) {
+	case int64:
+		return t, nil
+	case uint64:
+		return int64(t), nil
+	case float64:
+		if t != math.Trunc(t) {
+			return 0, errors.Errorf("%v is not an integer", t)
+		}
+		return int64(t), nil
+	case bool:
+		if t {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return strconv.ParseInt(t, 10, 64)
+	}
+	return 0, errors.Errorf("integer requires number, but got %T", v)
+}
+
+func float64Of(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case float64:
+		return t, nil
+	case int64:
+		return float64(t), nil
+	case uint64:
+		return float64(t), nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(t), 64)
+	}
+	return 0, errors.Errorf("float requires number, but got %T", v)
+}
+
+func readProtoMessage(data []byte, m *protoMessageDescriptor) (map[string]interface{}, error) {
+	var ret = make(map[string]interface{})
+	var err = walkFields(data, func(number uint64, n uint64, bs []byte) error {
+		var f = m.fieldByNumber(number)
+		if f == nil {
+			return nil
+		}
+
+		var values []interface{}
+		if bs != nil && isPackableProtoType(f.typ) {
+			// the packed repeated scalars
+			var err error
+			if values, err = readPackedProto(f, bs); err != nil {
+				return err
+			}
+		} else {
+			var v, err = protoValueOf(f, n, bs)
+			if err != nil {
+				return err
+			}
+			values = []interface{}{v}
+		}
+		if len(values) == 0 {
+			// the empty packed field
+			return nil
+		}
+
+		if f.label != protoRepeated {
+			ret[f.jsonName] = values[len(values)-1]
+			return nil
+		}
+		var items, _ = ret[f.jsonName].([]interface{})
+		ret[f.jsonName] = append(items, values...)
+		return nil
+	})
+	return ret, err
+}
+
+func isPackableProtoType(typ uint64) bool {
+	switch typ {
+	case protoString, protoBytes, protoMessage:
+		return false
+	}
+	return true
+}
+
+func readPackedProto(f *protoFieldDescriptor, data []byte) ([]interface{}, error) {
+	var ret []interface{}
+	for len(data) != 0 {
+		var n uint64
+		switch f.typ {
+		case protoDouble, protoFixed64, protoSfixed64:
+			if len(data) < 8 {
+				return nil, errors.New("invalid packed fixed64")
+			}
+			n, data = binary.LittleEndian.Uint64(data), data[8:]
+		case protoFloat, protoFixed32, protoSfixed32:
+			if len(data) < 4 {
+				return nil, errors.New("invalid packed fixed32")
+			}
+			n, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default:
+			var l int
+			if n, l = binary.Uvarint(data); l <= 0 {
+				return nil, errors.New("invalid packed varint")
+			}
+			data = data[l:]
+		}
+		var v, err = protoValueOf(f, n, nil)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+func protoValueOf(f *protoFieldDescriptor, n uint64, bs []byte) (interface{}, error) {
+	switch f.typ {
+	case protoDouble:
+		return math.Float64frombits(n), nil
+	case protoFloat:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case protoInt64, protoSfixed64:
+		return int64(n), nil
+	case protoUint64, protoFixed64:
+		return n, nil
+	case protoInt32, protoSfixed32:
+		return int64(int32(n)), nil
+	case protoUint32, protoFixed32:
+		return int64(uint32(n)), nil
+	case protoSint32, protoSint64:
+		return int64(n>>1) ^ -int64(n&1), nil
+	case protoBool:
+		return n != 0, nil
+	case protoEnum:
+		if name, exist := f.enum.names[int64(int32(n))]; exist {
+			return name, nil
+		}
+		return int64(int32(n)), nil
+	case protoString:
+		return string(bs), nil
+	case protoBytes:
+		return append([]byte(nil), bs...), nil
+	case protoMessage:
+		return readProtoMessage(bs, f.message)
+	}
+	return nil, errors.Errorf("unsupported field type %d", f.typ)
+}
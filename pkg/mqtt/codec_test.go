@@ -0,0 +1,253 @@
+package mqtt
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// nestedValue covers the nested objects and arrays of the scalars.
+var nestedValue = map[string]interface{}{
+	"switch": true,
+	"action": map[string]interface{}{
+		"gear": "mid",
+	},
+	"parameter": []interface{}{
+		map[string]interface{}{"name": "power", "value": 70.5},
+		map[string]interface{}{"name": "luminance", "value": int64(-4900)},
+	},
+	"levels": []interface{}{int64(1), []interface{}{int64(2), nil}, "三"},
+}
+
+// testMessage is the protobuf message:
+//
+//	message Light {
+//	  message Parameter { double power = 1; int64 luminance = 2; }
+//	  bool switch = 1; double power = 2; int64 luminance = 3; sint64 delta = 4; uint64 total = 5;
+//	  string name = 6; repeated string tags = 7; Parameter parameter = 8; repeated int32 levels = 9; float ratio = 10;
+//	}
+var testMessage = &protoMessageDescriptor{
+	name: "octopus.Light",
+	fields: []*protoFieldDescriptor{
+		{name: "switch", jsonName: "switch", number: 1, typ: protoBool},
+		{name: "power", jsonName: "power", number: 2, typ: protoDouble},
+		{name: "luminance", jsonName: "luminance", number: 3, typ: protoInt64},
+		{name: "delta", jsonName: "delta", number: 4, typ: protoSint64},
+		{name: "total", jsonName: "total", number: 5, typ: protoUint64},
+		{name: "name", jsonName: "name", number: 6, typ: protoString},
+		{name: "tags", jsonName: "tags", number: 7, typ: protoString, label: protoRepeated},
+		{name: "parameter", jsonName: "parameter", number: 8, typ: protoMessage, message: &protoMessageDescriptor{
+			name: "octopus.Light.Parameter",
+			fields: []*protoFieldDescriptor{
+				{name: "power", jsonName: "power", number: 1, typ: protoDouble},
+				{name: "luminance", jsonName: "luminance", number: 2, typ: protoInt64},
+			},
+		}},
+		{name: "levels", jsonName: "levels", number: 9, typ: protoInt32, label: protoRepeated},
+		{name: "ratio", jsonName: "ratio", number: 10, typ: protoFloat},
+	},
+}
+
+// testValueMessage carries the scalar values by the field named value.
+var testValueMessage = &protoMessageDescriptor{
+	name: "octopus.Value",
+	fields: []*protoFieldDescriptor{
+		{name: "value", jsonName: "value", number: 1, typ: protoSint64},
+	},
+}
+
+// decodeSafely decodes the data and turns the panic into the failure of the test.
+func decodeSafely(t *testing.T, codec payloadCodec, data []byte) (v interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("panic on decoding %x: %v", data, r)
+		}
+	}()
+	return codec.Decode(data)
+}
+
+func TestPayloadCodecRoundTrip(t *testing.T) {
+	var testCases = []struct {
+		name  string
+		codec payloadCodec
+		value interface{}
+		// expected is the decoded value, which is the same as the value if nil
+		expected interface{}
+	}{
+		{name: "text string", codec: textPayloadCodec{}, value: "Rancher Octopus"},
+		{name: "text negative integer", codec: textPayloadCodec{}, value: int64(-245), expected: "-245"},
+		{name: "text large integer", codec: textPayloadCodec{}, value: uint64(math.MaxUint64), expected: "18446744073709551615"},
+		{name: "text float", codec: textPayloadCodec{}, value: 3.0, expected: "3"},
+		{name: "text nested", codec: textPayloadCodec{}, value: map[string]interface{}{"action": map[string]interface{}{"gear": "mid"}, "levels": []interface{}{int64(1), 2.5}}, expected: `{"action":{"gear":"mid"},"levels":[1,2.5]}`},
+
+		{name: "json negative integer", codec: jsonPayloadCodec{}, value: int64(math.MinInt64)},
+		{name: "json large integer", codec: jsonPayloadCodec{}, value: int64(math.MaxInt64)},
+		{name: "json large unsigned integer", codec: jsonPayloadCodec{}, value: uint64(math.MaxUint64)},
+		{name: "json float", codec: jsonPayloadCodec{}, value: -24.3},
+		{name: "json numeric text", codec: jsonPayloadCodec{}, value: "245", expected: int64(245)},
+		{name: "json nested", codec: jsonPayloadCodec{}, value: nestedValue},
+
+		{name: "cbor negative integer", codec: cborPayloadCodec{}, value: int64(math.MinInt64)},
+		{name: "cbor small negative integer", codec: cborPayloadCodec{}, value: int64(-24)},
+		{name: "cbor large integer", codec: cborPayloadCodec{}, value: uint64(math.MaxUint64)},
+		{name: "cbor float", codec: cborPayloadCodec{}, value: math.SmallestNonzeroFloat64},
+		{name: "cbor bytes", codec: cborPayloadCodec{}, value: []byte{0x00, 0xff}},
+		{name: "cbor long text", codec: cborPayloadCodec{}, value: string(make([]byte, 70000))},
+		{name: "cbor nested", codec: cborPayloadCodec{}, value: nestedValue},
+
+		{name: "msgpack negative integer", codec: msgpackPayloadCodec{}, value: int64(math.MinInt64)},
+		{name: "msgpack negative fixint", codec: msgpackPayloadCodec{}, value: int64(-32)},
+		{name: "msgpack negative int16", codec: msgpackPayloadCodec{}, value: int64(-300)},
+		{name: "msgpack large integer", codec: msgpackPayloadCodec{}, value: uint64(math.MaxUint64)},
+		{name: "msgpack uint32", codec: msgpackPayloadCodec{}, value: uint64(math.MaxUint32), expected: int64(math.MaxUint32)},
+		{name: "msgpack float", codec: msgpackPayloadCodec{}, value: math.MaxFloat64},
+		{name: "msgpack bytes", codec: msgpackPayloadCodec{}, value: []byte{0x00, 0xff}},
+		{name: "msgpack long array", codec: msgpackPayloadCodec{}, value: make([]interface{}, 20)},
+		{name: "msgpack nested", codec: msgpackPayloadCodec{}, value: nestedValue},
+
+		{name: "protobuf negative value", codec: protobufPayloadCodec{message: testValueMessage}, value: int64(math.MinInt64), expected: map[string]interface{}{"value": int64(math.MinInt64)}},
+		{name: "protobuf large value", codec: protobufPayloadCodec{message: testValueMessage}, value: int64(math.MaxInt64), expected: map[string]interface{}{"value": int64(math.MaxInt64)}},
+		{
+			name:  "protobuf nested",
+			codec: protobufPayloadCodec{message: testMessage},
+			value: map[string]interface{}{
+				"switch":    true,
+				"power":     -70.5,
+				"luminance": int64(math.MinInt64),
+				"delta":     int64(-1),
+				"total":     uint64(math.MaxUint64),
+				"name":      "living room",
+				"tags":      []interface{}{"light", ""},
+				"parameter": map[string]interface{}{"power": 3.0, "luminance": int64(245)},
+				"levels":    []interface{}{int64(-1), int64(math.MaxInt32)},
+				"ratio":     0.5,
+			},
+		},
+
+		{name: "base64 text", codec: base64PayloadCodec{wrapped: textPayloadCodec{}}, value: "P10Y0M0D"},
+		{name: "base64 msgpack nested", codec: base64PayloadCodec{wrapped: msgpackPayloadCodec{}}, value: nestedValue},
+		{name: "base64 cbor large integer", codec: base64PayloadCodec{wrapped: cborPayloadCodec{}}, value: uint64(math.MaxUint64)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data, err = tc.codec.Encode(tc.value)
+			if err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+			actual, err := decodeSafely(t, tc.codec, data)
+			if err != nil {
+				t.Fatalf("failed to decode %x: %v", data, err)
+			}
+			var expected = tc.expected
+			if expected == nil {
+				expected = tc.value
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("expected %#v, but got %#v", expected, actual)
+			}
+		})
+	}
+}
+
+func TestPayloadCodecInvalid(t *testing.T) {
+	var testCases = []struct {
+		name  string
+		codec payloadCodec
+		data  []byte
+	}{
+		{name: "json empty", codec: jsonPayloadCodec{}, data: []byte{}},
+		{name: "json invalid", codec: jsonPayloadCodec{}, data: []byte(`{"gear":mid}`)},
+		{name: "json trailing", codec: jsonPayloadCodec{}, data: []byte(`{} {}`)},
+
+		{name: "cbor empty", codec: cborPayloadCodec{}, data: []byte{}},
+		{name: "cbor trailing", codec: cborPayloadCodec{}, data: []byte{0x01, 0x02}},
+		{name: "cbor indefinite length", codec: cborPayloadCodec{}, data: []byte{0x9f, 0x01, 0xff}},
+		{name: "cbor negative overflow", codec: cborPayloadCodec{}, data: []byte{0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{name: "cbor huge array", codec: cborPayloadCodec{}, data: []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{name: "cbor huge map", codec: cborPayloadCodec{}, data: []byte{0xbb, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{name: "cbor huge text", codec: cborPayloadCodec{}, data: []byte{0x7b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+
+		{name: "msgpack empty", codec: msgpackPayloadCodec{}, data: []byte{}},
+		{name: "msgpack trailing", codec: msgpackPayloadCodec{}, data: []byte{0x01, 0x02}},
+		{name: "msgpack reserved", codec: msgpackPayloadCodec{}, data: []byte{0xc1}},
+		{name: "msgpack huge array", codec: msgpackPayloadCodec{}, data: []byte{0xdd, 0xff, 0xff, 0xff, 0xff}},
+		{name: "msgpack huge map", codec: msgpackPayloadCodec{}, data: []byte{0xdf, 0xff, 0xff, 0xff, 0xff}},
+		{name: "msgpack huge string", codec: msgpackPayloadCodec{}, data: []byte{0xdb, 0xff, 0xff, 0xff, 0xff}},
+
+		{name: "protobuf invalid tag", codec: protobufPayloadCodec{message: testMessage}, data: []byte{0xff}},
+		{name: "protobuf invalid wire type", codec: protobufPayloadCodec{message: testMessage}, data: []byte{0x0b}},
+		{name: "protobuf truncated varint", codec: protobufPayloadCodec{message: testMessage}, data: []byte{0x18, 0x80}},
+		{name: "protobuf truncated fixed64", codec: protobufPayloadCodec{message: testMessage}, data: []byte{0x11, 0x00}},
+		{name: "protobuf huge length", codec: protobufPayloadCodec{message: testMessage}, data: []byte{0x32, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}},
+		{name: "protobuf invalid packed", codec: protobufPayloadCodec{message: testMessage}, data: []byte{0x4a, 0x01, 0x80}},
+		{name: "protobuf invalid nested", codec: protobufPayloadCodec{message: testMessage}, data: []byte{0x42, 0x01, 0x09}},
+
+		{name: "base64 invalid", codec: base64PayloadCodec{wrapped: textPayloadCodec{}}, data: []byte("!!")},
+		{name: "base64 invalid wrapped", codec: base64PayloadCodec{wrapped: cborPayloadCodec{}}, data: []byte("/w==")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if v, err := decodeSafely(t, tc.codec, tc.data); err == nil {
+				t.Errorf("expected error of decoding %x, but got %#v", tc.data, v)
+			}
+		})
+	}
+}
+
+func TestPayloadCodecTruncated(t *testing.T) {
+	var testCases = []struct {
+		name  string
+		codec payloadCodec
+		value interface{}
+		// lenient accepts the prefixes which happen to be valid, e.g. the protobuf message ended at a field boundary
+		lenient bool
+	}{
+		{name: "json", codec: jsonPayloadCodec{}, value: nestedValue},
+		{name: "cbor", codec: cborPayloadCodec{}, value: nestedValue},
+		{name: "msgpack", codec: msgpackPayloadCodec{}, value: nestedValue},
+		{name: "base64 cbor", codec: base64PayloadCodec{wrapped: cborPayloadCodec{}}, value: nestedValue, lenient: true},
+		{
+			name:  "protobuf",
+			codec: protobufPayloadCodec{message: testMessage},
+			value: map[string]interface{}{
+				"luminance": int64(-1),
+				"tags":      []interface{}{"light"},
+				"parameter": map[string]interface{}{"power": 3.0},
+				"levels":    []interface{}{int64(-1)},
+			},
+			lenient: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data, err = tc.codec.Encode(tc.value)
+			if err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+			for i := 0; i < len(data); i++ {
+				if _, err := decodeSafely(t, tc.codec, data[:i]); err == nil && !tc.lenient {
+					t.Errorf("expected error of decoding the truncated %x", data[:i])
+				}
+			}
+		})
+	}
+}
+
+func TestProtobufPackedScalars(t *testing.T) {
+	// levels = [1, -1, 300] in the packed encoding, and the empty packed field is ignored
+	var data = []byte{0x4a, 0x0d, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0xac, 0x02, 0x18, 0x00, 0x1a, 0x00}
+	var actual, err = decodeSafely(t, protobufPayloadCodec{message: testMessage}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = map[string]interface{}{
+		"levels":    []interface{}{int64(1), int64(-1), int64(300)},
+		"luminance": int64(0),
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %#v, but got %#v", expected, actual)
+	}
+}
@@ -0,0 +1,129 @@
+package mqtt
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/transport"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/octopus-simulator/cmd/mqtt/options"
+	"github.com/rancher/octopus-simulator/pkg/util/certs"
+)
+
+// connection describes how the mockers connect to the broker.
+type connection struct {
+	brokerURL      string
+	clientIDPrefix string
+	keepAlive      time.Duration
+	// the backoff of reconnecting once the connection is lost
+	minReconnectDelay time.Duration
+	maxReconnectDelay time.Duration
+	dialer            client.Dialer
+	// the mockers announce themselves via Home Assistant MQTT discovery if not blank
+	discoveryPrefix string
+	// the devices answer the get requests if true
+	getRequests bool
+	topics      *topicNamespace
+	// the payload codecs of the devices, the devices absent use their default codecs
+	codecs      map[string]string
+	descriptors *protoDescriptors
+	// the payload styles of the devices, the devices absent use their default styles
+	styles map[string]string
+}
+
+// newConnection creates the connection to the broker URL,
+// the credentials are carried by the URL as gomqtt client expects.
+func newConnection(brokerURL string, opts *options.Options) (*connection, error) {
+	var u, err = url.Parse(brokerURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse broker URL %s", brokerURL)
+	}
+	if opts.Username != "" {
+		if opts.Password != "" {
+			u.User = url.UserPassword(opts.Username, opts.Password)
+		} else {
+			u.User = url.User(opts.Username)
+		}
+	}
+
+	topics, err := newTopicNamespace(opts.TopicPrefix, opts.TopicSite, opts.TopicTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	var descriptors *protoDescriptors
+	if opts.ProtobufDescriptorSet != "" {
+		if descriptors, err = loadProtoDescriptors(opts.ProtobufDescriptorSet); err != nil {
+			return nil, err
+		}
+	}
+
+	var conn = &connection{
+		brokerURL:         u.String(),
+		clientIDPrefix:    opts.ClientIDPrefix,
+		keepAlive:         opts.KeepAlive,
+		minReconnectDelay: opts.MinReconnectDelay,
+		maxReconnectDelay: opts.MaxReconnectDelay,
+		discoveryPrefix:   opts.DiscoveryPrefix,
+		getRequests:       opts.GetRequests,
+		topics:            topics,
+		codecs:            opts.PayloadCodecs,
+		descriptors:       descriptors,
+		styles:            opts.PayloadStyles,
+	}
+	if isSecureURL(brokerURL) {
+		var tlsConfig, err = certs.NewClientTLSConfig(opts.TLSCAFile, opts.TLSCertFile, opts.TLSKeyFile, opts.TLSInsecureSkipVerify)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create TLS configuration")
+		}
+		conn.dialer = transport.NewDialer(transport.DialConfig{
+			TLSConfig: tlsConfig,
+			Timeout:   10 * time.Second,
+		})
+	}
+	return conn, nil
+}
+
+// Config returns the client configuration of the mocker,
+// which registers the offline availability as the will message if the availability topic is not blank.
+// The session is kept by the broker, so that the messages in flight are resent after reconnecting.
+func (c *connection) Config(name, availabilityTopic string) *client.Config {
+	var config = client.NewConfigWithClientID(c.brokerURL, c.clientIDPrefix+name)
+	config.CleanSession = false
+	config.Dialer = c.dialer
+	if availabilityTopic != "" {
+		config.WillMessage = willMessage(availabilityTopic)
+	}
+	if c.keepAlive > 0 {
+		config.KeepAlive = c.keepAlive.String()
+	}
+	return config
+}
+
+// Codec returns the payload codec of the device, or the default codec if not configured.
+func (c *connection) Codec(name, defaultCodec string) (payloadCodec, error) {
+	var spec = defaultCodec
+	if s, exist := c.codecs[name]; exist {
+		spec = s
+	}
+	var codec, err = newPayloadCodec(spec, c.descriptors)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create payload codec of %s", name)
+	}
+	return codec, nil
+}
+
+// Style returns the payload style of the device, or the default style if not configured.
+func (c *connection) Style(name, defaultStyle string) (payloadStyle, error) {
+	var spec = defaultStyle
+	if s, exist := c.styles[name]; exist {
+		spec = s
+	}
+	var style, err = newPayloadStyle(spec)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create payload style of %s", name)
+	}
+	return style, nil
+}
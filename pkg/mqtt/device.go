@@ -0,0 +1,224 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/octopus-simulator/pkg/critical"
+	"github.com/rancher/octopus-simulator/pkg/log"
+)
+
+// deviceSpec describes a device which is rendered from its model in the configured payload style.
+type deviceSpec struct {
+	// name is the name of the mocker, e.g. kitchen-light
+	name string
+	// title is the name of the device in Home Assistant, e.g. Kitchen Light
+	title           string
+	area            string
+	device          string
+	defaultTemplate string
+	defaultStyle    string
+	defaultCodec    string
+	model           deviceModel
+}
+
+func mockDevice(conn *connection, spec deviceSpec, stop <-chan struct{}) (m mocker, err error) {
+	codec, err := conn.Codec(spec.name, spec.defaultCodec)
+	if err != nil {
+		return nil, err
+	}
+	style, err := conn.Style(spec.name, spec.defaultStyle)
+	if err != nil {
+		return nil, err
+	}
+
+	var ctx, ctxCancel = context.WithCancel(critical.Context(stop))
+	var topics = conn.topics.Device(spec.area, spec.device, spec.defaultTemplate)
+	var in = &device{
+		spec:      spec,
+		model:     spec.model,
+		published: make(map[string][]byte),
+		topics:    topics,
+		style:     style,
+		codec:     codec,
+		svc:       newMockerService(ctx, conn, spec.name, conn.Config(spec.name, topics.Availability())),
+		ctx:       ctx,
+		ctxCancel: ctxCancel,
+	}
+	defer func() {
+		if err != nil {
+			in.svc.Stop()
+			ctxCancel()
+		}
+	}()
+	err = in.init(conn)
+	return in, err
+}
+
+type device struct {
+	sync.Mutex
+	spec  deviceSpec
+	model deviceModel
+	// the payloads published last time, the states are published only if changed
+	published map[string][]byte
+
+	topics    *deviceTopics
+	style     payloadStyle
+	codec     payloadCodec
+	svc       *mockerService
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+}
+
+func (in *device) init(conn *connection) error {
+	var id = strings.ReplaceAll(in.spec.name, "-", "_")
+	var discovery = discoveryDevice{
+		Identifiers:  []string{"octopus_simulator_" + id},
+		Name:         in.spec.title,
+		Manufacturer: "Rancher Octopus Fake Device",
+		Model:        in.spec.name,
+	}
+	var entities = in.style.Entities(in.topics, in.model, id, in.spec.title)
+
+	// subscribes
+	var commands = in.style.Commands(in.topics, in.model)
+	var requests map[string]string
+	if conn.getRequests {
+		requests = in.style.Requests(in.topics, in.model)
+	}
+	go in.serve(commands, requests)
+
+	// publishes after each connecting, all states are republished in case the broker lost the retained messages
+	return in.svc.Start(subscriptionsOf(commands, requests), func() error {
+		in.Lock()
+		defer in.Unlock()
+
+		if err := publishAvailability(in.svc, in.topics.Availability(), onlineAvailability); err != nil {
+			return err
+		}
+		if err := publishDiscovery(in.svc, conn.discoveryPrefix, discovery, in.topics.Availability(), entities); err != nil {
+			return err
+		}
+		in.published = make(map[string][]byte)
+		return in.publishStates()
+	})
+}
+
+// serve applies the commands and answers the get requests until the context is done.
+func (in *device) serve(commands, requests map[string]string) {
+	for {
+		var msg *packet.Message
+		select {
+		case <-in.ctx.Done():
+			return
+		case msg = <-in.svc.messages:
+		}
+
+		in.Lock()
+		if p, exist := commands[msg.Topic]; exist {
+			if err := in.command(p, msg); err != nil {
+				log.Error(err, "failed to handle command", "topic", msg.Topic)
+			}
+		} else if status, exist := requests[msg.Topic]; exist {
+			if err := in.request(status, msg); err != nil {
+				log.Error(err, "failed to handle get request", "topic", msg.Topic)
+			}
+		}
+		in.Unlock()
+	}
+}
+
+// command writes the received data to the path of the model, and then publishes the changed states,
+// it is called with the lock held.
+func (in *device) command(p string, msg *packet.Message) error {
+	var value, err = in.codec.Decode(msg.Payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to decode received data")
+	}
+	patch, err := in.style.Patch(in.model, p, value)
+	if err != nil {
+		return errors.Wrap(err, "failed to convert received data")
+	}
+	if err := in.model.Apply(patch); err != nil {
+		return errors.Wrap(err, "failed to apply received data")
+	}
+	return in.publishStates()
+}
+
+// request replies the state of the status topic, or all states if the status topic is blank,
+// it is called with the lock held.
+func (in *device) request(status string, msg *packet.Message) error {
+	var states, err = in.style.States(in.topics, in.model)
+	if err != nil {
+		return errors.Wrap(err, "failed to render states")
+	}
+	if status != "" {
+		states = map[string]interface{}{status: states[status]}
+	}
+	return replyGetRequest(in.svc, in.codec, msg.Payload, states)
+}
+
+// publishStates renders the model and publishes the retained states which are changed since last time.
+func (in *device) publishStates() error {
+	var states, err = in.style.States(in.topics, in.model)
+	if err != nil {
+		return errors.Wrap(err, "failed to render states")
+	}
+	for topic, state := range states {
+		payload, err := in.codec.Encode(state)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode messages for topic %s", topic)
+		}
+		if published, exist := in.published[topic]; exist && bytes.Equal(published, payload) {
+			continue
+		}
+		if err := in.svc.Publish(topic, payload, packet.QOSAtLeastOnce, true); err != nil {
+			return errors.Wrapf(err, "failed to publish messages for topic %s", topic)
+		}
+		in.published[topic] = payload
+	}
+	return nil
+}
+
+func (in *device) Close() error {
+	var err = in.svc.Disconnect(in.topics.Availability())
+	if in.ctxCancel != nil {
+		in.ctxCancel()
+	}
+	return err
+}
+
+func (in *device) Kill() error {
+	return in.svc.Drop()
+}
+
+func (in *device) Mock(interval time.Duration) error {
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-in.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		// the states are republished once reconnected
+		if !in.svc.Connected() {
+			continue
+		}
+		in.Lock()
+		if in.model.Vary() {
+			if err := in.publishStates(); err != nil {
+				log.Error(err, "failed to publish states")
+			}
+		}
+		in.Unlock()
+	}
+}
@@ -0,0 +1,77 @@
+package mqtt
+
+import (
+	"path"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/octopus-simulator/pkg/converter"
+)
+
+// discoveryEntity is an entity announced via Home Assistant MQTT discovery,
+// its config is published to <prefix>/<component>/<object ID>/config.
+type discoveryEntity struct {
+	component string
+	objectID  string
+	config    discoveryConfig
+}
+
+// discoveryConfig is the discovery payload, the fields are shared by the light, binary_sensor, lock and sensor components.
+type discoveryConfig struct {
+	Name                string           `json:"name"`
+	UniqueID            string           `json:"unique_id"`
+	DeviceClass         string           `json:"device_class,omitempty"`
+	Schema              string           `json:"schema,omitempty"`
+	StateTopic          string           `json:"state_topic,omitempty"`
+	CommandTopic        string           `json:"command_topic,omitempty"`
+	ValueTemplate       string           `json:"value_template,omitempty"`
+	StateTemplate       string           `json:"state_template,omitempty"`
+	CommandOnTemplate   string           `json:"command_on_template,omitempty"`
+	CommandOffTemplate  string           `json:"command_off_template,omitempty"`
+	PayloadOn           string           `json:"payload_on,omitempty"`
+	PayloadOff          string           `json:"payload_off,omitempty"`
+	PayloadLock         string           `json:"payload_lock,omitempty"`
+	PayloadUnlock       string           `json:"payload_unlock,omitempty"`
+	StateLocked         string           `json:"state_locked,omitempty"`
+	StateUnlocked       string           `json:"state_unlocked,omitempty"`
+	UnitOfMeasurement   string           `json:"unit_of_measurement,omitempty"`
+	AvailabilityTopic   string           `json:"availability_topic,omitempty"`
+	PayloadAvailable    string           `json:"payload_available,omitempty"`
+	PayloadNotAvailable string           `json:"payload_not_available,omitempty"`
+	Device              *discoveryDevice `json:"device,omitempty"`
+}
+
+// discoveryDevice groups the entities of a mocker as a device in Home Assistant.
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// publishDiscovery publishes the retained discovery configs of the entities under the prefix,
+// the entities share the device and the availability topic, nothing is published if the prefix is blank.
+func publishDiscovery(svc *mockerService, prefix string, device discoveryDevice, availabilityTopic string, entities []discoveryEntity) error {
+	if prefix == "" {
+		return nil
+	}
+	for _, e := range entities {
+		var config = e.config
+		config.UniqueID = e.objectID
+		config.AvailabilityTopic = availabilityTopic
+		config.PayloadAvailable = onlineAvailability
+		config.PayloadNotAvailable = offlineAvailability
+		config.Device = &device
+
+		var topic = path.Join(prefix, e.component, e.objectID, "config")
+		var message, err = converter.MarshalJSON(config)
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal discovery config for topic %s", topic)
+		}
+		if err := svc.Publish(topic, message, packet.QOSAtLeastOnce, true); err != nil {
+			return errors.Wrapf(err, "failed to publish discovery config for topic %s", topic)
+		}
+	}
+	return nil
+}
@@ -2,88 +2,408 @@
 
 import (
 	"context"
+	"math/rand"
+	"sync"
 	"time"
 
-	"github.com/256dpi/gomqtt/client"
 	"github.com/256dpi/gomqtt/packet"
 	"github.com/pkg/errors"
 
 	"github.com/rancher/octopus-simulator/pkg/critical"
+	"github.com/rancher/octopus-simulator/pkg/log"
 )
 
-func mockKitchenDoor(address string, stop <-chan struct{}) (m mocker, err error) {
+// the states of the kitchen door.
+const (
+	openDoorState     = "open"
+	closedDoorState   = "closed"
+	lockedDoorState   = "locked"
+	unlockedDoorState = "unlocked"
+)
+
+// the events of the kitchen door.
+const (
+	openDoorEvent        = "open"
+	closeDoorEvent       = "close"
+	forcedEntryDoorEvent = "forced-entry"
+)
+
+// kitchenDoorSchedule describes how the kitchen door is opened and closed as time goes on.
+type kitchenDoorSchedule struct {
+	// the door stays open or closed for the dwell, or as it is if 0
+	openDwell   time.Duration
+	closedDwell time.Duration
+	// the door stays for a random duration up to twice the dwell if random
+	random bool
+	// the probability of forcing the locked door open, the opening is refused otherwise
+	forcedEntryRate float64
+}
+
+// dwell returns how long the door stays in the state, 0 means staying until the state is changed by the commands.
+func (s kitchenDoorSchedule) dwell(open bool) time.Duration {
+	var dwell = s.closedDwell
+	if open {
+		dwell = s.openDwell
+	}
+	if dwell > 0 && s.random {
+		dwell = time.Duration(rand.Int63n(int64(2*dwell))) + 1
+	}
+	return dwell
+}
+
+func mockKitchenDoor(conn *connection, schedule kitchenDoorSchedule, stop <-chan struct{}) (m mocker, err error) {
+	if schedule.openDwell < 0 || schedule.closedDwell < 0 {
+		return nil, errors.New("dwell of kitchen door must not be negative")
+	}
+	if schedule.forcedEntryRate < 0 || schedule.forcedEntryRate > 1 {
+		return nil, errors.Errorf("forced entry rate of kitchen door must be in [0, 1] but got %v", schedule.forcedEntryRate)
+	}
+	codec, err := conn.Codec("kitchen-door", textCodec)
+	if err != nil {
+		return nil, err
+	}
+
 	var ctx, ctxCancel = context.WithCancel(critical.Context(stop))
-	var cli = client.New()
+	var topics = conn.topics.Device("kitchen", "door", kindFirstTopicTemplate)
+	var in = &kitchenDoor{
+		open:      true,
+		schedule:  schedule,
+		changed:   make(chan struct{}, 1),
+		topics:    topics,
+		codec:     codec,
+		svc:       newMockerService(ctx, conn, "kitchen-door", conn.Config("kitchen-door", topics.Availability())),
+		ctx:       ctx,
+		ctxCancel: ctxCancel,
+	}
 	defer func() {
 		if err != nil {
-			_ = cli.Close()
+			in.svc.Stop()
+			ctxCancel()
 		}
 	}()
+	err = in.init(conn)
+	return in, err
+}
 
-	var in = &kitchenDoor{
-		cli:       cli,
-		ctx:       ctx,
-		ctxCancel: ctxCancel,
+var kitchenDoorDevice = discoveryDevice{
+	Identifiers:  []string{"octopus_simulator_kitchen_door"},
+	Name:         "Kitchen Door",
+	Manufacturer: "Rancher Octopus Fake Device",
+	Model:        "kitchen-door",
+}
+
+func kitchenDoorEntities(t *deviceTopics) []discoveryEntity {
+	return []discoveryEntity{
+		{
+			component: "binary_sensor",
+			objectID:  "octopus_simulator_kitchen_door",
+			config: discoveryConfig{
+				Name:        "Kitchen Door",
+				DeviceClass: "door",
+				StateTopic:  t.Topic(statusTopic, "state"),
+				PayloadOn:   openDoorState,
+				PayloadOff:  closedDoorState,
+			},
+		},
+		{
+			component: "lock",
+			objectID:  "octopus_simulator_kitchen_door_lock",
+			config: discoveryConfig{
+				Name:          "Kitchen Door Lock",
+				StateTopic:    t.Topic(statusTopic, "lock"),
+				CommandTopic:  t.Topic(setTopic, "lock"),
+				PayloadLock:   "lock",
+				PayloadUnlock: "unlock",
+				StateLocked:   lockedDoorState,
+				StateUnlocked: unlockedDoorState,
+			},
+		},
+		{
+			component: "sensor",
+			objectID:  "octopus_simulator_kitchen_door_width",
+			config: discoveryConfig{
+				Name:              "Kitchen Door Width",
+				StateTopic:        t.Topic(statusTopic, "width"),
+				UnitOfMeasurement: "m",
+			},
+		},
+		{
+			component: "sensor",
+			objectID:  "octopus_simulator_kitchen_door_height",
+			config: discoveryConfig{
+				Name:              "Kitchen Door Height",
+				StateTopic:        t.Topic(statusTopic, "height"),
+				UnitOfMeasurement: "m",
+			},
+		},
+		{
+			component: "sensor",
+			objectID:  "octopus_simulator_kitchen_door_production_material",
+			config: discoveryConfig{
+				Name:       "Kitchen Door Production Material",
+				StateTopic: t.Topic(statusTopic, "production_material"),
+			},
+		},
 	}
-	err = in.init(address)
-	return in, err
 }
 
+// kitchenDoorAttributes are the attributes of the kitchen door, which are published to their own topics.
+var kitchenDoorAttributes = []string{"state", "lock", "width", "height", "production_material"}
+
 type kitchenDoor struct {
-	cli       *client.Client
+	sync.Mutex
+	open     bool
+	locked   bool
+	schedule kitchenDoorSchedule
+	// signaled once the state is changed by the commands, so that the dwell is restarted
+	changed chan struct{}
+
+	topics    *deviceTopics
+	codec     payloadCodec
+	svc       *mockerService
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 }
 
-func (in *kitchenDoor) init(address string) error {
-	var cli = in.cli
+func (in *kitchenDoor) init(conn *connection) error {
+	// subscribes
+	var commands = map[string]string{
+		in.topics.Topic(setTopic, "state"): "state",
+		in.topics.Topic(setTopic, "lock"):  "lock",
+	}
+	var requests map[string]string
+	if conn.getRequests {
+		requests = in.topics.Requests(kitchenDoorAttributes...)
+	}
+	go in.serve(commands, requests)
+
+	// publishes after each connecting
+	return in.svc.Start(subscriptionsOf(commands, requests), func() error {
+		in.Lock()
+		defer in.Unlock()
+
+		if err := publishAvailability(in.svc, in.topics.Availability(), onlineAvailability); err != nil {
+			return err
+		}
+		if err := publishDiscovery(in.svc, conn.discoveryPrefix, kitchenDoorDevice, in.topics.Availability(), kitchenDoorEntities(in.topics)); err != nil {
+			return err
+		}
+		for topic, message := range in.states() {
+			if err := in.publishState(topic, message); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// states returns the states of the kitchen door, the keys are the topics,
+// it is called with the lock held.
+func (in *kitchenDoor) states() map[string]interface{} {
+	var state, lock = closedDoorState, unlockedDoorState
+	if in.open {
+		state = openDoorState
+	}
+	if in.locked {
+		lock = lockedDoorState
+	}
+	return map[string]interface{}{
+		in.topics.Topic(statusTopic, "state"):               state,
+		in.topics.Topic(statusTopic, "lock"):                lock,
+		in.topics.Topic(statusTopic, "width"):               "1.2",
+		in.topics.Topic(statusTopic, "height"):              "1.8",
+		in.topics.Topic(statusTopic, "production_material"): "wood",
+	}
+}
+
+// serve applies the commands and answers the get requests until the context is done.
+func (in *kitchenDoor) serve(commands, requests map[string]string) {
+	for {
+		var msg *packet.Message
+		select {
+		case <-in.ctx.Done():
+			return
+		case msg = <-in.svc.messages:
+		}
 
-	// connects
-	var cf, err = cli.Connect(client.NewConfig(address))
+		in.Lock()
+		if attribute, exist := commands[msg.Topic]; exist {
+			if err := in.command(attribute, msg); err != nil {
+				log.Error(err, "failed to handle command", "topic", msg.Topic)
+			}
+		} else if status, exist := requests[msg.Topic]; exist {
+			var states = in.states()
+			if status != "" {
+				states = map[string]interface{}{status: states[status]}
+			}
+			if err := replyGetRequest(in.svc, in.codec, msg.Payload, states); err != nil {
+				log.Error(err, "failed to handle get request", "topic", msg.Topic)
+			}
+		}
+		in.Unlock()
+	}
+}
+
+// command opens or closes the door via the state attribute, and locks or unlocks it via the lock attribute,
+// the locked door refuses to open, and the open door refuses to lock. It is called with the lock held.
+func (in *kitchenDoor) command(attribute string, msg *packet.Message) error {
+	var value, err = in.codec.Decode(msg.Payload)
 	if err != nil {
-		return errors.Wrap(err, "failed to connect broker")
-	}
-	if err := cf.Wait(10 * time.Second); err != nil {
-		return errors.Wrap(err, "timeout to connect broker")
-	}
-
-	// publishes
-	var initPublishMessages = map[string]string{
-		"cattle.io/octopus/home/status/kitchen/door/state":               "open",
-		"cattle.io/octopus/home/status/kitchen/door/width":               "1.2",
-		"cattle.io/octopus/home/status/kitchen/door/height":              "1.8",
-		"cattle.io/octopus/home/status/kitchen/door/production_material": "wood",
-	}
-	for topic, message := range initPublishMessages {
-		var gf, err = cli.Publish(
-			topic,
-			[]byte(message),
-			packet.QOSAtLeastOnce,
-			true,
-		)
-		if err != nil {
-			return errors.Wrapf(err, "failed to init messages for topic %s", topic)
+		return errors.Wrap(err, "failed to decode received data")
+	}
+	var text = textOf(value)
+
+	switch attribute {
+	case "state":
+		switch text {
+		case openDoorState:
+			if in.open {
+				return nil
+			}
+			if in.locked {
+				return errors.New("refused to open the locked door")
+			}
+			in.restartDwell()
+			return in.transit(true, openDoorEvent)
+		case closedDoorState:
+			if !in.open {
+				return nil
+			}
+			in.restartDwell()
+			return in.transit(false, closeDoorEvent)
+		}
+		return errors.Errorf("unknown state %s, select from [%s, %s]", text, openDoorState, closedDoorState)
+	case "lock":
+		var locked bool
+		switch text {
+		case "lock":
+			locked = true
+		case "unlock":
+		default:
+			return errors.Errorf("unknown lock command %s, select from [lock, unlock]", text)
+		}
+		if in.locked == locked {
+			return nil
 		}
-		if err := gf.Wait(10 * time.Second); err != nil {
-			return errors.Wrapf(err, "timeout to init messages for topic %s", topic)
+		if locked && in.open {
+			return errors.New("refused to lock the open door")
 		}
+		in.locked = locked
+		var topic = in.topics.Topic(statusTopic, "lock")
+		return in.publishState(topic, in.states()[topic])
 	}
 	return nil
 }
 
-func (in *kitchenDoor) Close() error {
-	if in.cli != nil {
-		if err := in.cli.Close(); err != nil {
-			return err
-		}
+// restartDwell makes Mock restart the dwell of the new state.
+func (in *kitchenDoor) restartDwell() {
+	select {
+	case in.changed <- struct{}{}:
+	default:
 	}
+}
+
+// transit opens or closes the door, and then publishes the state and the event,
+// it is called with the lock held.
+func (in *kitchenDoor) transit(open bool, event string) error {
+	in.open = open
+	var topic = in.topics.Topic(statusTopic, "state")
+	if err := in.publishState(topic, in.states()[topic]); err != nil {
+		return err
+	}
+	return in.publishEvent(event)
+}
+
+// publishState publishes the retained state of the topic.
+func (in *kitchenDoor) publishState(topic string, state interface{}) error {
+	var payload, err = in.codec.Encode(state)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode messages for topic %s", topic)
+	}
+	if err := in.svc.Publish(topic, payload, packet.QOSAtLeastOnce, true); err != nil {
+		return errors.Wrapf(err, "failed to publish messages for topic %s", topic)
+	}
+	return nil
+}
+
+// publishEvent publishes the event with the timestamp without retaining,
+// e.g. {"event":"forced-entry","timestamp":"2020-07-08T13:24:00.123Z"}.
+func (in *kitchenDoor) publishEvent(event string) error {
+	var topic = in.topics.Topic(statusTopic, "event")
+	var payload, err = in.codec.Encode(map[string]interface{}{
+		"event":     event,
+		"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode messages for topic %s", topic)
+	}
+	if err := in.svc.Publish(topic, payload, packet.QOSAtLeastOnce, false); err != nil {
+		return errors.Wrapf(err, "failed to publish messages for topic %s", topic)
+	}
+	return nil
+}
+
+func (in *kitchenDoor) Close() error {
+	var err = in.svc.Disconnect(in.topics.Availability())
 	if in.ctxCancel != nil {
 		in.ctxCancel()
 	}
-	return nil
+	return err
 }
 
+func (in *kitchenDoor) Kill() error {
+	return in.svc.Drop()
+}
+
+// Mock opens and closes the door following the schedule rather than the interval,
+// the locked door is forced open with the forced entry rate, or refuses to open.
 func (in *kitchenDoor) Mock(interval time.Duration) error {
-	<-in.ctx.Done()
+	for {
+		in.Lock()
+		var dwell = in.schedule.dwell(in.open)
+		in.Unlock()
+
+		var timeout <-chan time.Time
+		if dwell > 0 {
+			timeout = time.After(dwell)
+		}
+		select {
+		case <-in.ctx.Done():
+			return nil
+		case <-in.changed:
+			continue
+		case <-timeout:
+		}
+
+		// the states are republished once reconnected
+		if !in.svc.Connected() {
+			continue
+		}
+		in.Lock()
+		if err := in.cycle(); err != nil {
+			log.Error(err, "failed to publish states")
+		}
+		in.Unlock()
+	}
+}
+
+// cycle closes the open door, or opens the closed door, it is called with the lock held.
+func (in *kitchenDoor) cycle() error {
+	switch {
+	case in.open:
+		return in.transit(false, closeDoorEvent)
+	case !in.locked:
+		return in.transit(true, openDoorEvent)
+	case in.schedule.forcedEntryRate > 0 && rand.Float64() < in.schedule.forcedEntryRate:
+		// the lock is broken by the forced entry, so the door is unlocked as well as open
+		log.Info("Forced the locked kitchen door open")
+		in.locked = false
+		var topic = in.topics.Topic(statusTopic, "lock")
+		if err := in.publishState(topic, in.states()[topic]); err != nil {
+			return err
+		}
+		return in.transit(true, forcedEntryDoorEvent)
+	}
+	log.Info("Refused to open the locked kitchen door")
 	return nil
 }
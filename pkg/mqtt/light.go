@@ -0,0 +1,183 @@
+package mqtt
+
+import (
+	"math/rand"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/octopus-simulator/pkg/converter"
+)
+
+func mockKitchenLight(conn *connection, stop <-chan struct{}) (mocker, error) {
+	return mockDevice(conn, kitchenLightSpec(), stop)
+}
+
+func kitchenLightSpec() deviceSpec {
+	return deviceSpec{
+		name:            "kitchen-light",
+		title:           "Kitchen Light",
+		area:            "kitchen",
+		device:          "light",
+		defaultTemplate: kindFirstTopicTemplate,
+		defaultStyle:    legacyStyle,
+		defaultCodec:    textCodec,
+		model:           newLightModel(kitchenLightAttributes, 3.0, 245, "2020-07-08T13:24:00.00Z"),
+	}
+}
+
+func mockLivingRoomLight(conn *connection, stop <-chan struct{}) (mocker, error) {
+	return mockDevice(conn, livingRoomLightSpec(), stop)
+}
+
+func livingRoomLightSpec() deviceSpec {
+	return deviceSpec{
+		name:            "livingroom-light",
+		title:           "Living Room Light",
+		area:            "livingroom",
+		device:          "light",
+		defaultTemplate: deviceFirstTopicTemplate,
+		defaultStyle:    legacyStyle,
+		defaultCodec:    textCodec,
+		model:           newLightModel(livingRoomLightAttributes, 70.0, 4900, "2020-07-09T13:00:00.00Z"),
+	}
+}
+
+func mockBedroomLight(conn *connection, stop <-chan struct{}) (mocker, error) {
+	return mockDevice(conn, bedroomLightSpec(), stop)
+}
+
+func bedroomLightSpec() deviceSpec {
+	return deviceSpec{
+		name:            "bedroom-light",
+		title:           "Bedroom Light",
+		area:            "bedroom",
+		device:          "light",
+		defaultTemplate: deviceFirstTopicTemplate,
+		defaultStyle:    legacyStyle,
+		defaultCodec:    jsonCodec,
+		model:           newLightModel(lightAttributes, 24.3, 1800, "2020-07-20T13:24:00.00Z"),
+	}
+}
+
+var lightAttributes = []deviceAttribute{
+	{path: "switch", name: "switch", writable: true, component: "light"},
+	{path: "action.gear", name: "gear", writable: true, component: "sensor"},
+	{path: "parameter.power", name: "parameter_power", unit: "W", component: "sensor", deviceClass: "power"},
+	{path: "parameter.luminance", name: "parameter_luminance", unit: "lm", component: "sensor"},
+	{path: "production.manufacturer", name: "manufacturer"},
+	{path: "production.date", name: "production_date"},
+	{path: "production.serviceLife", name: "service_life"},
+}
+
+// kitchenLightAttributes publishes each attribute to its own topic in the legacy style,
+// the gear is published to the get topic and controlled via the control topic.
+var kitchenLightAttributes = withLegacyLayouts(lightAttributes, map[string]legacyLayout{
+	"switch":                  {level: "switch"},
+	"action.gear":             {level: "gear", statusKind: getTopic, commandKind: controlTopic},
+	"parameter.power":         {level: "parameter_power", format: "%.1f"},
+	"parameter.luminance":     {level: "parameter_luminance"},
+	"production.manufacturer": {level: "manufacturer"},
+	"production.date":         {level: "production_date"},
+	"production.serviceLife":  {level: "service_life"},
+})
+
+// livingRoomLightAttributes publishes the parameters as the attribute array with the units in the values,
+// and the production as the JSON object in the legacy style.
+var livingRoomLightAttributes = withLegacyLayouts(lightAttributes, map[string]legacyLayout{
+	"switch":                  {level: "switch"},
+	"action.gear":             {level: "gear"},
+	"parameter.power":         {level: "parameter", shape: attributeListStyle, format: "%.1f", suffix: "w"},
+	"parameter.luminance":     {level: "parameter", shape: attributeListStyle, suffix: "lm"},
+	"production.manufacturer": {level: "production", shape: nestedJSONStyle},
+	"production.date":         {level: "production", shape: nestedJSONStyle},
+	"production.serviceLife":  {level: "production", shape: nestedJSONStyle},
+})
+
+type lightAction struct {
+	Gear string `json:"gear"`
+}
+
+type lightParameter struct {
+	Power     float64 `json:"power"`
+	Luminance int     `json:"luminance"`
+}
+
+type lightProduction struct {
+	Manufacturer string `json:"manufacturer"`
+	Date         string `json:"date"`
+	ServiceLife  string `json:"serviceLife"`
+}
+
+// lightModel is the light shared by the kitchen, the living room and the bedroom,
+// the luminance changes with the gear while the light is on.
+type lightModel struct {
+	Switch     bool            `json:"switch"`
+	Action     lightAction     `json:"action"`
+	Parameter  lightParameter  `json:"parameter"`
+	Production lightProduction `json:"production"`
+
+	// the minimal luminance of the low gear, the mid and high gears raise it by 100 and 200
+	baseLuminance int
+	attributes    []deviceAttribute
+}
+
+func newLightModel(attributes []deviceAttribute, power float64, luminance int, date string) *lightModel {
+	return &lightModel{
+		Switch: false,
+		Action: lightAction{
+			Gear: "low",
+		},
+		Parameter: lightParameter{
+			Power:     power,
+			Luminance: luminance,
+		},
+		Production: lightProduction{
+			Manufacturer: "Rancher Octopus Fake Device",
+			Date:         date,
+			ServiceLife:  "P10Y0M0D",
+		},
+		baseLuminance: luminance,
+		attributes:    attributes,
+	}
+}
+
+func (in *lightModel) Attributes() []deviceAttribute {
+	return in.attributes
+}
+
+func (in *lightModel) Document() interface{} {
+	return in
+}
+
+func (in *lightModel) Apply(patch map[string]interface{}) error {
+	var data, err = marshalValue(patch)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal patch")
+	}
+	var light = *in
+	if err := converter.UnmarshalJSON(data, &light); err != nil {
+		return errors.Wrap(err, "failed to unmarshal patch")
+	}
+	switch light.Action.Gear {
+	case "low", "mid", "high":
+	default:
+		return errors.Errorf("unknown gear %s, select from [low, mid, high]", light.Action.Gear)
+	}
+	*in = light
+	return nil
+}
+
+func (in *lightModel) Vary() bool {
+	if !in.Switch {
+		return false
+	}
+	switch in.Action.Gear {
+	case "mid":
+		in.Parameter.Luminance = rand.Intn(100) + in.baseLuminance + 100
+	case "high":
+		in.Parameter.Luminance = rand.Intn(150) + in.baseLuminance + 200
+	default:
+		in.Parameter.Luminance = rand.Intn(50) + in.baseLuminance
+	}
+	return true
+}
@@ -1,119 +1,130 @@
 package mqtt
 
 import (
-	"fmt"
 	"io"
-	"os"
 	"sync"
 	"time"
 
-	"github.com/256dpi/gomqtt/broker"
-	"github.com/256dpi/gomqtt/packet"
-	"github.com/256dpi/gomqtt/transport"
 	"github.com/pkg/errors"
 
 	"github.com/rancher/octopus-simulator/cmd/mqtt/options"
 	"github.com/rancher/octopus-simulator/pkg/log"
-	"github.com/rancher/octopus-simulator/pkg/util/log/logflag"
 	"github.com/rancher/octopus-simulator/pkg/util/signals"
 )
 
 func Run(opts *options.Options) error {
-	var sAddress = "tcp://0.0.0.0:1883"
-	if podIP := os.Getenv("POD_IP"); podIP != "" {
-		sAddress = fmt.Sprintf("tcp://%s:1883", podIP)
+	// checks the device names before any mocker connects, otherwise a typo starts the devices on the broker and then tears them down
+	var names = deviceNames(opts)
+	for name := range opts.PayloadCodecs {
+		if _, exist := names[name]; !exist {
+			return errors.Errorf("failed to configure payload codec of unknown device %s", name)
+		}
+	}
+	for name := range opts.PayloadStyles {
+		if !names[name] {
+			return errors.Errorf("failed to configure payload style of unknown light %s", name)
+		}
+	}
+
+	var brokerURL = opts.Broker
+	if brokerURL == "" {
+		if opts.GenerateCerts != "" {
+			if err := generateCerts(opts); err != nil {
+				return err
+			}
+		}
+		var brk, err = newMemoryBroker(opts)
+		if err != nil {
+			return errors.Wrap(err, "failed to start MQTT memory broker")
+		}
+		brk.Start()
+		defer brk.Close()
+		brokerURL = brk.MockerURL()
+		log.Info("Connecting mockers to " + brokerURL)
+	} else {
+		log.Info("Attaching to broker " + brokerURL)
 	}
-	var brk, err = newMemoryBroker(sAddress)
+
+	var conn, err = newConnection(brokerURL, opts)
 	if err != nil {
-		return errors.Wrap(err, "failed to start MQTT memory broker")
+		return err
 	}
-	brk.Start()
-	defer brk.Close()
-	log.Info("Listening on " + sAddress)
 
-	var mockers = make(mockers, 0, 4)
+	var mockers = make(mockers, 4)
 	defer mockers.Close()
 	var stop = signals.SetupSignalHandler()
 
-	kitchenDoorMocker, err := mockKitchenDoor(sAddress, stop)
+	kitchenDoorMocker, err := mockKitchenDoor(conn, kitchenDoorSchedule{
+		openDwell:       opts.KitchenDoorOpenDwell,
+		closedDwell:     opts.KitchenDoorClosedDwell,
+		random:          opts.KitchenDoorRandomDwell,
+		forcedEntryRate: opts.KitchenDoorForcedEntryRate,
+	}, stop)
 	if err != nil {
 		return errors.Wrap(err, "failed to mock kitchen door")
 	}
-	mockers = append(mockers, kitchenDoorMocker)
+	mockers["kitchen-door"] = kitchenDoorMocker
 
-	bedroomLightMocker, err := mockBedroomLight(sAddress, stop)
+	bedroomLightMocker, err := mockBedroomLight(conn, stop)
 	if err != nil {
 		return errors.Wrap(err, "failed to mock bedroom light")
 	}
-	mockers = append(mockers, bedroomLightMocker)
+	mockers["bedroom-light"] = bedroomLightMocker
 
-	kitchenLightMocker, err := mockKitchenLight(sAddress, stop)
+	kitchenLightMocker, err := mockKitchenLight(conn, stop)
 	if err != nil {
 		return errors.Wrap(err, "failed to mock kitchen light")
 	}
-	mockers = append(mockers, kitchenLightMocker)
+	mockers["kitchen-light"] = kitchenLightMocker
 
-	livingRoomLightMocker, err := mockLivingRoomLight(sAddress, stop)
+	livingRoomLightMocker, err := mockLivingRoomLight(conn, stop)
 	if err != nil {
 		return errors.Wrap(err, "failed to mock living room light")
 	}
-	mockers = append(mockers, livingRoomLightMocker)
-
-	return mockers.Mock(time.Duration(opts.Interval) * time.Second)
-}
-
-type memoryBroker struct {
-	server  transport.Server
-	backend *broker.MemoryBackend
-}
+	mockers["livingroom-light"] = livingRoomLightMocker
 
-func (b *memoryBroker) Start() {
-	var engine = broker.NewEngine(b.backend)
-	engine.Accept(b.server)
-}
-
-func (b *memoryBroker) Close() {
-	if b.backend != nil {
-		b.backend.Close(5 * time.Second)
+	if opts.Sparkplug {
+		sparkplugNodeMocker, err := mockSparkplugNode(conn, opts.SparkplugGroupID, opts.SparkplugEdgeNodeID, stop)
+		if err != nil {
+			return errors.Wrap(err, "failed to mock sparkplug edge node")
+		}
+		mockers["sparkplug-node"] = sparkplugNodeMocker
 	}
-	if b.server != nil {
-		_ = b.server.Close()
+
+	if opts.AdminAddress != "" {
+		var admin, err = serveAdmin(opts.AdminAddress, mockers)
+		if err != nil {
+			return err
+		}
+		defer admin.Close()
 	}
+
+	return mockers.Mock(time.Duration(opts.Interval) * time.Second)
 }
 
-func newMemoryBroker(address string) (*memoryBroker, error) {
-	var server, err = transport.Launch(address)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to launch broker")
+// deviceNames returns the names of the mocked devices, which are mapped to whether the device is a light.
+func deviceNames(opts *options.Options) map[string]bool {
+	var names = map[string]bool{
+		"kitchen-door":             false,
+		kitchenLightSpec().name:    true,
+		livingRoomLightSpec().name: true,
+		bedroomLightSpec().name:    true,
 	}
-
-	var backend = broker.NewMemoryBackend()
-	if logflag.GetLogVerbosity() > 4 {
-		backend.Logger = func(e broker.LogEvent, c *broker.Client, pkt packet.Generic, msg *packet.Message, err error) {
-			if err != nil {
-				log.Error(err, fmt.Sprintf("[%s]", e))
-			} else if msg != nil {
-				log.Info(fmt.Sprintf("[%s] %s", e, msg.String()))
-			} else if pkt != nil {
-				log.Info(fmt.Sprintf("[%s] %s", e, pkt.String()))
-			} else {
-				log.Info(fmt.Sprintf("%s", e))
-			}
-		}
+	if opts.Sparkplug {
+		names["sparkplug-node"] = false
 	}
-
-	return &memoryBroker{
-		server:  server,
-		backend: backend,
-	}, nil
+	return names
 }
 
 type mocker interface {
 	io.Closer
 	Mock(interval time.Duration) error
+	// Kill drops the connection without DISCONNECT, so that the broker delivers the will message.
+	Kill() error
 }
 
-type mockers []mocker
+// mockers maps the device names to the mockers.
+type mockers map[string]mocker
 
 func (in mockers) Close() error {
 	for _, mocker := range in {
@@ -127,13 +138,13 @@ func (in mockers) Close() error {
 func (in mockers) Mock(interval time.Duration) error {
 	var wg sync.WaitGroup
 	defer wg.Wait()
-	for _, mocker := range in {
-		if mocker != nil {
+	for _, m := range in {
+		if m != nil {
 			wg.Add(1)
-			go func() {
+			go func(m mocker) {
 				defer wg.Done()
-				_ = mocker.Mock(interval)
-			}()
+				_ = m.Mock(interval)
+			}(m)
 		}
 	}
 	return nil
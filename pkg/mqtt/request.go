@@ -0,0 +1,63 @@
+package mqtt
+
+import (
+	"bytes"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/octopus-simulator/pkg/converter"
+)
+
+// getRequest is the optional JSON envelope of the get request, which asks the device to reply to the response topic,
+// e.g. {"response_topic":"adaptor/replies","correlation_id":"42"}.
+type getRequest struct {
+	ResponseTopic string      `json:"response_topic"`
+	CorrelationID interface{} `json:"correlation_id"`
+}
+
+// parseGetRequest returns the envelope of the get request,
+// the response topic is blank if the payload is not such an envelope, e.g. the blank payload.
+func parseGetRequest(payload []byte) getRequest {
+	var req getRequest
+	if bytes.HasPrefix(bytes.TrimSpace(payload), []byte("{")) {
+		_ = converter.UnmarshalJSON(payload, &req)
+	}
+	return req
+}
+
+// replyGetRequest replies the current states to the get request, the states are keyed by their status topics.
+// If the request carries the response topic, the JSON response keeping the correlation ID is published to it,
+// e.g. {"correlation_id":"42","states":{"cattle.io/octopus/home/status/kitchen/light/switch":"false"}},
+// otherwise the states are republished to their status topics in the codec of the device without retaining,
+// so that the retained states are not changed.
+func replyGetRequest(svc *mockerService, codec payloadCodec, payload []byte, states map[string]interface{}) error {
+	var req = parseGetRequest(payload)
+	if req.ResponseTopic != "" {
+		var resp = map[string]interface{}{
+			"states": states,
+		}
+		if req.CorrelationID != nil {
+			resp["correlation_id"] = req.CorrelationID
+		}
+		var data, err = marshalValue(resp)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal get response")
+		}
+		if err := svc.Publish(req.ResponseTopic, data, packet.QOSAtLeastOnce, false); err != nil {
+			return errors.Wrapf(err, "failed to publish get response for topic %s", req.ResponseTopic)
+		}
+		return nil
+	}
+
+	for topic, state := range states {
+		var data, err = codec.Encode(state)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode messages for topic %s", topic)
+		}
+		if err := svc.Publish(topic, data, packet.QOSAtLeastOnce, false); err != nil {
+			return errors.Wrapf(err, "failed to reply messages for topic %s", topic)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/transport"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/octopus-simulator/pkg/log"
+)
+
+// mockerService keeps the mocker connected to the broker, it reconnects with the backoff once the connection is lost,
+// resubscribes the subscriptions, and then calls the online handler to republish the states.
+type mockerService struct {
+	name    string
+	config  *client.Config
+	dialer  *mockerDialer
+	service *client.Service
+	ctx     context.Context
+
+	connected int32
+	// increased once the connection is lost
+	generation int32
+	stopped    int32
+	// signaled once connected, carries whether the session is resumed
+	onlines chan bool
+	// the received messages, which are dropped once the context is done
+	messages chan *packet.Message
+	// offline is called before reconnecting, it can change the config for the next connection, e.g. the will message
+	offline func(config *client.Config)
+}
+
+func newMockerService(ctx context.Context, conn *connection, name string, config *client.Config) *mockerService {
+	var dialer = &mockerDialer{dialer: config.Dialer}
+	config.Dialer = dialer
+	// the client stops processing without reporting the error if a subscription is failed, so the codes are checked by Start
+	config.ValidateSubs = false
+
+	var s = &mockerService{
+		name:     name,
+		config:   config,
+		dialer:   dialer,
+		service:  client.NewService(),
+		ctx:      ctx,
+		onlines:  make(chan bool, 1),
+		messages: make(chan *packet.Message, 16),
+	}
+	s.service.MinReconnectDelay = conn.minReconnectDelay
+	s.service.MaxReconnectDelay = conn.maxReconnectDelay
+	s.service.ConnectTimeout = 10 * time.Second
+	s.service.ResubscribeTimeout = 10 * time.Second
+	s.service.DisconnectTimeout = time.Second
+
+	// the callbacks must not wait for the futures, which are completed by the service after the callbacks return
+	s.service.OnlineCallback = func(resumed bool) {
+		atomic.StoreInt32(&s.connected, 1)
+		select {
+		case s.onlines <- resumed:
+		default:
+		}
+	}
+	s.service.OfflineCallback = func() {
+		atomic.StoreInt32(&s.connected, 0)
+		atomic.AddInt32(&s.generation, 1)
+		if atomic.LoadInt32(&s.stopped) == 1 {
+			return
+		}
+		log.Info(fmt.Sprintf("Lost the connection of %s, reconnecting", s.name))
+		if s.offline != nil {
+			s.offline(s.config)
+		}
+	}
+	// the errors are expected while the broker is unavailable, so they are logged without the stack
+	s.service.ErrorCallback = func(err error) {
+		log.Info(fmt.Sprintf("Connection error of %s: %v", s.name, err))
+	}
+	s.service.MessageCallback = func(msg *packet.Message) error {
+		select {
+		case s.messages <- msg:
+		case <-s.ctx.Done():
+		}
+		return nil
+	}
+	return s
+}
+
+// Start connects the broker, subscribes the topics and calls the online handler,
+// the handler is called again after each reconnecting until the context is done.
+func (s *mockerService) Start(subscriptions []packet.Subscription, online func() error) error {
+	s.service.Start(s.config)
+
+	select {
+	case <-s.onlines:
+	case <-time.After(10 * time.Second):
+		return errors.New("timeout to connect broker")
+	}
+
+	// drops the connection if the subscriptions are failed, and then they are resubscribed by the service after reconnecting
+	if len(subscriptions) != 0 {
+		var sf = s.service.SubscribeMultiple(subscriptions)
+		var err = sf.Wait(10 * time.Second)
+		if err == nil {
+			for i, code := range sf.ReturnCodes() {
+				if code == packet.QOSFailure && i < len(subscriptions) {
+					err = errors.Errorf("rejected topic %s", subscriptions[i].Topic)
+					break
+				}
+			}
+		}
+		if err != nil {
+			log.Info(fmt.Sprintf("Failed to subscribe topics of %s, resubscribing after reconnecting: %v", s.name, err))
+			_ = s.Drop()
+		}
+	}
+
+	// publishes, and retries once reconnected if the connection is lost during publishing
+	for {
+		var lost, err = s.callOnline(online)
+		if err != nil {
+			return err
+		}
+		if !lost {
+			break
+		}
+		select {
+		case <-s.onlines:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-s.onlines:
+			}
+			log.Info(fmt.Sprintf("Reconnected %s to the broker", s.name))
+			if _, err := s.callOnline(online); err != nil {
+				log.Error(err, "failed to republish after reconnecting", "mocker", s.name)
+			}
+		}
+	}()
+	return nil
+}
+
+// subscriptionsOf returns the QoS 1 subscriptions of the topics keyed by the maps in order.
+func subscriptionsOf(topics ...map[string]string) []packet.Subscription {
+	var subscriptions []packet.Subscription
+	for _, m := range topics {
+		for topic := range m {
+			subscriptions = append(subscriptions, packet.Subscription{Topic: topic, QOS: packet.QOSAtLeastOnce})
+		}
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].Topic < subscriptions[j].Topic
+	})
+	return subscriptions
+}
+
+// callOnline calls the online handler, returns true if the connection is lost during the handler,
+// as the messages in flight may not be completed then, the handler is expected to be called again once reconnected.
+func (s *mockerService) callOnline(online func() error) (bool, error) {
+	var generation = atomic.LoadInt32(&s.generation)
+	var err = online()
+	if err != nil && atomic.LoadInt32(&s.generation) != generation {
+		log.Info(fmt.Sprintf("Lost the connection of %s during publishing, retrying after reconnecting: %v", s.name, err))
+		return true, nil
+	}
+	return false, err
+}
+
+// Connected returns true if the connection is established.
+func (s *mockerService) Connected() bool {
+	return atomic.LoadInt32(&s.connected) == 1
+}
+
+// Publish publishes the message and waits for the completion.
+func (s *mockerService) Publish(topic string, payload []byte, qos packet.QOS, retain bool) error {
+	return s.service.Publish(topic, payload, qos, retain).Wait(10 * time.Second)
+}
+
+// Disconnect publishes the offline availability if the availability topic is not blank, and then disconnects gracefully,
+// the broker discards the will message in this case.
+func (s *mockerService) Disconnect(availabilityTopic string) error {
+	var err error
+	if availabilityTopic != "" && s.Connected() {
+		err = publishAvailability(s, availabilityTopic, offlineAvailability)
+	}
+	s.Stop()
+	return err
+}
+
+// Stop stops the service without publishing anything.
+func (s *mockerService) Stop() {
+	atomic.StoreInt32(&s.stopped, 1)
+	s.service.Stop(true)
+}
+
+// Drop closes the connection abruptly without DISCONNECT, the service reconnects later.
+func (s *mockerService) Drop() error {
+	return s.dialer.Drop()
+}
+
+// mockerDialer remembers the last connection, so that it can be dropped abruptly.
+type mockerDialer struct {
+	dialer client.Dialer
+
+	conn     transport.Conn
+	connLock sync.Mutex
+}
+
+func (d *mockerDialer) Dial(url string) (transport.Conn, error) {
+	var conn transport.Conn
+	var err error
+	if d.dialer != nil {
+		conn, err = d.dialer.Dial(url)
+	} else {
+		conn, err = transport.Dial(url)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d.connLock.Lock()
+	defer d.connLock.Unlock()
+	d.conn = conn
+	return conn, nil
+}
+
+func (d *mockerDialer) Drop() error {
+	d.connLock.Lock()
+	defer d.connLock.Unlock()
+
+	if d.conn == nil {
+		return errors.New("not connected")
+	}
+	var err = d.conn.Close()
+	d.conn = nil
+	return err
+}
@@ -0,0 +1,401 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/octopus-simulator/pkg/critical"
+	"github.com/rancher/octopus-simulator/pkg/log"
+)
+
+const (
+	sparkplugNamespace     = "spBv1.0"
+	sparkplugRebirthMetric = "Node Control/Rebirth"
+	sparkplugBdSeqMetric   = "bdSeq"
+)
+
+func mockSparkplugNode(conn *connection, groupID, edgeNodeID string, stop <-chan struct{}) (m mocker, err error) {
+	var ctx, ctxCancel = context.WithCancel(critical.Context(stop))
+	var in = &sparkplugNode{
+		groupID:    groupID,
+		edgeNodeID: edgeNodeID,
+		startedAt:  time.Now(),
+		metrics: []*sparkplugDefinition{
+			{name: sparkplugRebirthMetric, alias: 1, dataType: sparkplugBoolean, writable: true, value: false},
+			{name: "Properties/Hardware Make", alias: 2, dataType: sparkplugString, value: "Rancher Octopus Fake Device"},
+			{name: "Uptime", alias: 3, dataType: sparkplugInt64, value: int64(0)},
+		},
+		devices: []*sparkplugDevice{
+			{
+				id: "boiler",
+				metrics: []*sparkplugDefinition{
+					{name: "Temperature", alias: 10, dataType: sparkplugDouble, value: 65.0},
+					{name: "Pressure", alias: 11, dataType: sparkplugDouble, value: 1.5},
+					{name: "Setpoint", alias: 12, dataType: sparkplugDouble, writable: true, value: 70.0},
+					{name: "Enabled", alias: 13, dataType: sparkplugBoolean, writable: true, value: true},
+				},
+			},
+			{
+				id: "pump",
+				metrics: []*sparkplugDefinition{
+					{name: "Running", alias: 20, dataType: sparkplugBoolean, writable: true, value: false},
+					{name: "Speed", alias: 21, dataType: sparkplugInt32, writable: true, value: int32(1450)},
+					{name: "Flow", alias: 22, dataType: sparkplugFloat, value: float32(0)},
+				},
+			},
+		},
+		ctx:       ctx,
+		ctxCancel: ctxCancel,
+	}
+
+	// NDEATH is registered as the will message, the bdSeq is increased for each new session
+	var config = conn.Config("sparkplug-"+edgeNodeID, "")
+	// the edge node requires the clean session, the state is rebuilt by the births instead
+	config.CleanSession = true
+	config.WillMessage = &packet.Message{
+		Topic:   in.topic("NDEATH", ""),
+		Payload: in.death(),
+		QOS:     packet.QOSAtLeastOnce,
+	}
+	in.svc = newMockerService(ctx, conn, "sparkplug-node", config)
+	in.svc.offline = func(config *client.Config) {
+		atomic.AddUint64(&in.bdSeq, 1)
+		config.WillMessage.Payload = in.death()
+	}
+	defer func() {
+		if err != nil {
+			in.svc.Stop()
+			ctxCancel()
+		}
+	}()
+	err = in.init(conn)
+	return in, err
+}
+
+// sparkplugDefinition is a metric declared in the birth certificate.
+type sparkplugDefinition struct {
+	name     string
+	alias    uint64
+	dataType uint32
+	writable bool
+	value    interface{}
+}
+
+func (d *sparkplugDefinition) Metric(timestamp uint64, birth bool) sparkplugMetric {
+	var m = sparkplugMetric{
+		Alias:     d.alias,
+		Timestamp: timestamp,
+		DataType:  d.dataType,
+		Value:     d.value,
+	}
+	// the data messages refer to the metrics by alias only
+	if birth {
+		m.Name = d.name
+	}
+	return m
+}
+
+type sparkplugDevice struct {
+	id      string
+	metrics []*sparkplugDefinition
+}
+
+// sparkplugNode is an edge node with the devices attached, it publishes:
+//
+//	NBIRTH/DBIRTH: the metric definitions with names and aliases, after connecting or a rebirth request.
+//	NDATA/DDATA:   the changed metrics by aliases, periodically or after a write.
+//	NDEATH:        the bdSeq of the session, as the will message or before disconnecting.
+//
+// and handles the writes from NCMD/DCMD, the seq is increased by each message except NDEATH and wraps at 256.
+type sparkplugNode struct {
+	sync.Mutex
+	// bdSeq is accessed atomically, as it is increased by the service before reconnecting
+	bdSeq      uint64
+	groupID    string
+	edgeNodeID string
+	startedAt  time.Time
+	seq        uint64
+	metrics    []*sparkplugDefinition
+	devices    []*sparkplugDevice
+
+	svc       *mockerService
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+}
+
+func (in *sparkplugNode) init(conn *connection) error {
+	// subscribes before the births, so that the commands following the births are not missed
+	go in.serve()
+	var subscriptions = []packet.Subscription{
+		{Topic: in.topic("NCMD", ""), QOS: packet.QOSAtLeastOnce},
+		{Topic: in.topic("DCMD", "+"), QOS: packet.QOSAtLeastOnce},
+	}
+
+	// publishes the births after each connecting
+	return in.svc.Start(subscriptions, func() error {
+		in.Lock()
+		defer in.Unlock()
+		return in.birth()
+	})
+}
+
+func (in *sparkplugNode) topic(messageType, deviceID string) string {
+	var topic = strings.Join([]string{sparkplugNamespace, in.groupID, messageType, in.edgeNodeID}, "/")
+	if deviceID != "" {
+		topic += "/" + deviceID
+	}
+	return topic
+}
+
+// death returns the NDEATH payload, which carries the bdSeq without seq.
+func (in *sparkplugNode) death() []byte {
+	var payload = sparkplugPayload{
+		Timestamp: sparkplugTimestamp(),
+		Metrics: []sparkplugMetric{
+			{Name: sparkplugBdSeqMetric, DataType: sparkplugUInt64, Value: atomic.LoadUint64(&in.bdSeq)},
+		},
+	}
+	return payload.Marshal()
+}
+
+// birth publishes NBIRTH with the seq reset, and then DBIRTH of each device, it is called with the lock held.
+func (in *sparkplugNode) birth() error {
+	in.seq = 0
+	var now = sparkplugTimestamp()
+	var metrics = []sparkplugMetric{
+		{Name: sparkplugBdSeqMetric, Timestamp: now, DataType: sparkplugUInt64, Value: atomic.LoadUint64(&in.bdSeq)},
+	}
+	for _, d := range in.metrics {
+		metrics = append(metrics, d.Metric(now, true))
+	}
+	if err := in.publish("NBIRTH", "", metrics); err != nil {
+		return err
+	}
+
+	for _, dev := range in.devices {
+		var metrics = make([]sparkplugMetric, 0, len(dev.metrics))
+		for _, d := range dev.metrics {
+			metrics = append(metrics, d.Metric(now, true))
+		}
+		if err := in.publish("DBIRTH", dev.id, metrics); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publish sends the metrics with the next seq, it is called with the lock held.
+func (in *sparkplugNode) publish(messageType, deviceID string, metrics []sparkplugMetric) error {
+	var seq = in.seq
+	in.seq = (in.seq + 1) % 256
+	var payload = sparkplugPayload{
+		Timestamp: sparkplugTimestamp(),
+		Metrics:   metrics,
+		Seq:       &seq,
+	}
+
+	var topic = in.topic(messageType, deviceID)
+	if err := in.svc.Publish(topic, payload.Marshal(), packet.QOSAtMostOnce, false); err != nil {
+		return errors.Wrapf(err, "failed to publish messages for topic %s", topic)
+	}
+	return nil
+}
+
+// serve handles the commands until the context is done.
+func (in *sparkplugNode) serve() {
+	for {
+		var msg *packet.Message
+		select {
+		case <-in.ctx.Done():
+			return
+		case msg = <-in.svc.messages:
+		}
+
+		in.Lock()
+		if err := in.command(msg); err != nil {
+			log.Error(err, "failed to handle sparkplug command", "topic", msg.Topic)
+		}
+		in.Unlock()
+	}
+}
+
+// command applies the writes of NCMD/DCMD, and then publishes the written metrics as NDATA/DDATA,
+// writing true to the rebirth metric of the node republishes all births instead.
+func (in *sparkplugNode) command(msg *packet.Message) error {
+	var levels = strings.Split(msg.Topic, "/")
+	if len(levels) < 4 {
+		return errors.Errorf("invalid topic %s", msg.Topic)
+	}
+	var messageType, deviceID = levels[2], ""
+	if len(levels) > 4 {
+		deviceID = levels[4]
+	}
+
+	var payload sparkplugPayload
+	if err := payload.Unmarshal(msg.Payload); err != nil {
+		return errors.Wrap(err, "failed to unmarshal payload")
+	}
+
+	var definitions = in.metrics
+	var dataType = "NDATA"
+	if messageType == "DCMD" {
+		var dev = in.device(deviceID)
+		if dev == nil {
+			return errors.Errorf("device %s is not found", deviceID)
+		}
+		definitions = dev.metrics
+		dataType = "DDATA"
+	}
+
+	var now = sparkplugTimestamp()
+	var written []sparkplugMetric
+	for _, m := range payload.Metrics {
+		var d = findSparkplugDefinition(definitions, m)
+		if d == nil {
+			log.Info(fmt.Sprintf("Ignored unknown metric %q(alias %d) of %s", m.Name, m.Alias, msg.Topic))
+			continue
+		}
+		if !d.writable {
+			log.Info(fmt.Sprintf("Refused to write read-only metric %s of %s", d.name, msg.Topic))
+			continue
+		}
+		var value, err = sparkplugValue(d.dataType, m.Value)
+		if err != nil {
+			log.Error(err, "failed to write sparkplug metric", "metric", d.name)
+			continue
+		}
+
+		if d.name == sparkplugRebirthMetric {
+			if value == true {
+				log.Info(fmt.Sprintf("Rebirthing sparkplug edge node %s", in.edgeNodeID))
+				return in.birth()
+			}
+			continue
+		}
+		d.value = value
+		log.Info(fmt.Sprintf("Wrote metric %s of %s to %v", d.name, msg.Topic, value))
+		written = append(written, d.Metric(now, false))
+	}
+	if len(written) == 0 {
+		return nil
+	}
+	return in.publish(dataType, deviceID, written)
+}
+
+func (in *sparkplugNode) device(id string) *sparkplugDevice {
+	for _, dev := range in.devices {
+		if dev.id == id {
+			return dev
+		}
+	}
+	return nil
+}
+
+// findSparkplugDefinition looks up the definition by the name, or by the alias if the name is absent.
+func findSparkplugDefinition(definitions []*sparkplugDefinition, m sparkplugMetric) *sparkplugDefinition {
+	for _, d := range definitions {
+		if m.Name != "" {
+			if d.name == m.Name {
+				return d
+			}
+		} else if d.alias == m.Alias {
+			return d
+		}
+	}
+	return nil
+}
+
+func (in *sparkplugNode) Close() error {
+	if in.svc.Connected() {
+		in.Lock()
+		// the devices and the node die gracefully, the broker discards the will message then
+		for _, dev := range in.devices {
+			if err := in.publish("DDEATH", dev.id, nil); err != nil {
+				log.Error(err, "failed to publish sparkplug device death", "device", dev.id)
+			}
+		}
+		var topic = in.topic("NDEATH", "")
+		if err := in.svc.Publish(topic, in.death(), packet.QOSAtLeastOnce, false); err != nil {
+			log.Error(err, "failed to publish sparkplug node death", "topic", topic)
+		}
+		in.Unlock()
+	}
+	in.svc.Stop()
+	if in.ctxCancel != nil {
+		in.ctxCancel()
+	}
+	return nil
+}
+
+func (in *sparkplugNode) Kill() error {
+	return in.svc.Drop()
+}
+
+func (in *sparkplugNode) Mock(interval time.Duration) error {
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-in.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		// the births are republished once reconnected
+		if !in.svc.Connected() {
+			continue
+		}
+		in.Lock()
+		if err := in.change(); err != nil {
+			log.Error(err, "failed to publish sparkplug data")
+		}
+		in.Unlock()
+	}
+}
+
+// change updates the measured metrics and publishes them, it is called with the lock held.
+func (in *sparkplugNode) change() error {
+	var now = sparkplugTimestamp()
+
+	var uptime = in.metrics[2]
+	uptime.value = int64(time.Since(in.startedAt) / time.Second)
+	if err := in.publish("NDATA", "", []sparkplugMetric{uptime.Metric(now, false)}); err != nil {
+		return err
+	}
+
+	var boiler = in.devices[0].metrics
+	var temperature, pressure, setpoint, enabled = boiler[0], boiler[1], boiler[2], boiler[3]
+	var target = 20.0
+	if enabled.value == true {
+		target = setpoint.value.(float64)
+	}
+	temperature.value = temperature.value.(float64) + (target-temperature.value.(float64))/10 + rand.Float64() - 0.5
+	pressure.value = 1.5 + rand.Float64()/10
+	if err := in.publish("DDATA", "boiler", []sparkplugMetric{temperature.Metric(now, false), pressure.Metric(now, false)}); err != nil {
+		return err
+	}
+
+	var pump = in.devices[1].metrics
+	var running, speed, flow = pump[0], pump[1], pump[2]
+	if running.value == true {
+		flow.value = float32(speed.value.(int32))/100 + rand.Float32() - 0.5
+	} else {
+		flow.value = float32(0)
+	}
+	return in.publish("DDATA", "pump", []sparkplugMetric{flow.Metric(now, false)})
+}
+
+// sparkplugTimestamp returns the milliseconds since epoch in UTC.
+func sparkplugTimestamp() uint64 {
+	return uint64(time.Now().UnixNano() / int64(time.Millisecond))
+}
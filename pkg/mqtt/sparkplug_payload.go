@@ -0,0 +1,287 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// the data types of Sparkplug B metrics used by the mockers.
+const (
+	sparkplugInt32   uint32 = 3
+	sparkplugInt64   uint32 = 4
+	sparkplugUInt64  uint32 = 8
+	sparkplugFloat   uint32 = 9
+	sparkplugDouble  uint32 = 10
+	sparkplugBoolean uint32 = 11
+	sparkplugString  uint32 = 12
+)
+
+// the protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// sparkplugPayload is the subset of the Sparkplug B protobuf payload used by the mockers:
+//
+//	message Payload {
+//	  optional uint64 timestamp = 1;
+//	  repeated Metric metrics   = 2;
+//	  optional uint64 seq       = 3;
+//	}
+//
+// the protobuf is encoded by hand as there is no protobuf runtime in the vendor.
+type sparkplugPayload struct {
+	Timestamp uint64
+	Metrics   []sparkplugMetric
+	// seq is absent in NDEATH
+	Seq *uint64
+}
+
+// sparkplugMetric is the subset of the Sparkplug B metric:
+//
+//	message Metric {
+//	  optional string name      = 1;
+//	  optional uint64 alias     = 2;
+//	  optional uint64 timestamp = 3;
+//	  optional uint32 datatype  = 4;
+//	  optional bool   is_null   = 7;
+//	  oneof value {
+//	    uint32 int_value     = 10;
+//	    uint64 long_value    = 11;
+//	    float  float_value   = 12;
+//	    double double_value  = 13;
+//	    bool   boolean_value = 14;
+//	    string string_value  = 15;
+//	  }
+//	}
+//
+// the value is one of int32, int64, uint64, float32, float64, bool and string when encoding,
+// and one of uint32, uint64, float32, float64, bool and string as on the wire when decoding,
+// which is converted by the data type via sparkplugValue.
+type sparkplugMetric struct {
+	Name      string
+	Alias     uint64
+	Timestamp uint64
+	DataType  uint32
+	Value     interface{}
+}
+
+func (in *sparkplugPayload) Marshal() []byte {
+	var b []byte
+	b = appendVarintField(b, 1, in.Timestamp)
+	for i := range in.Metrics {
+		b = appendBytesField(b, 2, in.Metrics[i].marshal())
+	}
+	if in.Seq != nil {
+		b = appendVarintField(b, 3, *in.Seq)
+	}
+	return b
+}
+
+func (in *sparkplugMetric) marshal() []byte {
+	var b []byte
+	if in.Name != "" {
+		b = appendBytesField(b, 1, []byte(in.Name))
+	}
+	if in.Alias != 0 {
+		b = appendVarintField(b, 2, in.Alias)
+	}
+	if in.Timestamp != 0 {
+		b = appendVarintField(b, 3, in.Timestamp)
+	}
+	b = appendVarintField(b, 4, uint64(in.DataType))
+	switch v := in.Value.(type) {
+	case nil:
+		b = appendVarintField(b, 7, 1)
+	case int32:
+		b = appendVarintField(b, 10, uint64(uint32(v)))
+	case uint32:
+		b = appendVarintField(b, 10, uint64(v))
+	case int64:
+		b = appendVarintField(b, 11, uint64(v))
+	case uint64:
+		b = appendVarintField(b, 11, v)
+	case float32:
+		b = appendTag(b, 12, wireFixed32)
+		b = append(b, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[len(b)-4:], math.Float32bits(v))
+	case float64:
+		b = appendTag(b, 13, wireFixed64)
+		b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint64(b[len(b)-8:], math.Float64bits(v))
+	case bool:
+		var n uint64
+		if v {
+			n = 1
+		}
+		b = appendVarintField(b, 14, n)
+	case string:
+		b = appendBytesField(b, 15, []byte(v))
+	}
+	return b
+}
+
+func (in *sparkplugPayload) Unmarshal(data []byte) error {
+	return walkFields(data, func(field uint64, n uint64, bs []byte) error {
+		switch field {
+		case 1:
+			in.Timestamp = n
+		case 2:
+			var m sparkplugMetric
+			if err := m.unmarshal(bs); err != nil {
+				return err
+			}
+			in.Metrics = append(in.Metrics, m)
+		case 3:
+			var seq = n
+			in.Seq = &seq
+		}
+		return nil
+	})
+}
+
+func (in *sparkplugMetric) unmarshal(data []byte) error {
+	return walkFields(data, func(field uint64, n uint64, bs []byte) error {
+		switch field {
+		case 1:
+			in.Name = string(bs)
+		case 2:
+			in.Alias = n
+		case 3:
+			in.Timestamp = n
+		case 4:
+			in.DataType = uint32(n)
+		case 10:
+			in.Value = uint32(n)
+		case 11:
+			in.Value = n
+		case 12:
+			in.Value = math.Float32frombits(uint32(n))
+		case 13:
+			in.Value = math.Float64frombits(n)
+		case 14:
+			in.Value = n != 0
+		case 15:
+			in.Value = string(bs)
+		}
+		return nil
+	})
+}
+
+// sparkplugValue converts the decoded value into the Go type of the data type.
+func sparkplugValue(dataType uint32, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case uint32:
+		switch dataType {
+		case sparkplugInt32:
+			return int32(v), nil
+		case sparkplugInt64:
+			return int64(int32(v)), nil
+		case sparkplugUInt64:
+			return uint64(v), nil
+		}
+	case uint64:
+		switch dataType {
+		case sparkplugInt32:
+			return int32(v), nil
+		case sparkplugInt64:
+			return int64(v), nil
+		case sparkplugUInt64:
+			return v, nil
+		}
+	case float32:
+		switch dataType {
+		case sparkplugFloat:
+			return v, nil
+		case sparkplugDouble:
+			return float64(v), nil
+		}
+	case float64:
+		switch dataType {
+		case sparkplugFloat:
+			return float32(v), nil
+		case sparkplugDouble:
+			return v, nil
+		}
+	case bool:
+		if dataType == sparkplugBoolean {
+			return v, nil
+		}
+	case string:
+		if dataType == sparkplugString {
+			return v, nil
+		}
+	}
+	return nil, errors.Errorf("cannot convert %T value to data type %d", value, dataType)
+}
+
+func appendTag(b []byte, field uint64, wireType uint64) []byte {
+	return appendVarint(b, field<<3|wireType)
+}
+
+func appendVarint(b []byte, n uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], n)]...)
+}
+
+func appendVarintField(b []byte, field uint64, n uint64) []byte {
+	return appendVarint(appendTag(b, field, wireVarint), n)
+}
+
+func appendBytesField(b []byte, field uint64, bs []byte) []byte {
+	b = appendVarint(appendTag(b, field, wireBytes), uint64(len(bs)))
+	return append(b, bs...)
+}
+
+// walkFields iterates the fields of a protobuf message,
+// the number is given for varint and fixed fields, and the bytes are given for length-delimited fields.
+func walkFields(data []byte, fn func(field uint64, n uint64, bs []byte) error) error {
+	for len(data) != 0 {
+		var tag, l = binary.Uvarint(data)
+		if l <= 0 {
+			return errors.New("invalid protobuf tag")
+		}
+		data = data[l:]
+
+		var n uint64
+		var bs []byte
+		switch tag & 7 {
+		case wireVarint:
+			n, l = binary.Uvarint(data)
+			if l <= 0 {
+				return errors.New("invalid protobuf varint")
+			}
+			data = data[l:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errors.New("invalid protobuf fixed64")
+			}
+			n = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errors.New("invalid protobuf fixed32")
+			}
+			n = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		case wireBytes:
+			var size, l = binary.Uvarint(data)
+			if l <= 0 || uint64(len(data)-l) < size {
+				return errors.New("invalid protobuf length")
+			}
+			bs = data[l : l+int(size)]
+			data = data[l+int(size):]
+		default:
+			return errors.Errorf("unsupported protobuf wire type %d", tag&7)
+		}
+		if err := fn(tag>>3, n, bs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
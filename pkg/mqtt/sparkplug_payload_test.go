@@ -0,0 +1,150 @@
+package mqtt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSparkplugPayloadRoundTrip(t *testing.T) {
+	var seq = func(n uint64) *uint64 { return &n }
+
+	var testCases = []struct {
+		name    string
+		payload sparkplugPayload
+	}{
+		{
+			name: "NBIRTH with names and aliases",
+			payload: sparkplugPayload{
+				Timestamp: 1594213440000,
+				Seq:       seq(0),
+				Metrics: []sparkplugMetric{
+					{Name: sparkplugBdSeqMetric, Timestamp: 1594213440000, DataType: sparkplugUInt64, Value: uint64(3)},
+					{Name: sparkplugRebirthMetric, Alias: 1, Timestamp: 1594213440000, DataType: sparkplugBoolean, Value: false},
+					{Name: "Properties/Hardware Make", Alias: 2, Timestamp: 1594213440000, DataType: sparkplugString, Value: "Rancher Octopus Fake Device"},
+					{Name: "Uptime", Alias: 3, Timestamp: 1594213440000, DataType: sparkplugInt64, Value: int64(-42)},
+				},
+			},
+		},
+		{
+			name: "DDATA by alias",
+			payload: sparkplugPayload{
+				Timestamp: 1594213440000,
+				Seq:       seq(255),
+				Metrics: []sparkplugMetric{
+					{Alias: 10, Timestamp: 1594213440000, DataType: sparkplugDouble, Value: 65.5},
+					{Alias: 21, Timestamp: 1594213440000, DataType: sparkplugInt32, Value: int32(1450)},
+					{Alias: 22, Timestamp: 1594213440000, DataType: sparkplugFloat, Value: float32(14.25)},
+				},
+			},
+		},
+		{
+			name: "NCMD with negative Int32 and Double",
+			payload: sparkplugPayload{
+				Timestamp: 1594213440000,
+				Metrics: []sparkplugMetric{
+					{Name: "Speed", DataType: sparkplugInt32, Value: int32(-1450)},
+					{Name: "Setpoint", DataType: sparkplugDouble, Value: -70.5},
+					{Name: sparkplugRebirthMetric, DataType: sparkplugBoolean, Value: true},
+				},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var actual sparkplugPayload
+			if err := actual.Unmarshal(tc.payload.Marshal()); err != nil {
+				t.Fatal(err)
+			}
+			// the values are decoded as on the wire, and then converted by the data type
+			for i := range actual.Metrics {
+				var m = &actual.Metrics[i]
+				var value, err = sparkplugValue(m.DataType, m.Value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				m.Value = value
+			}
+			if !reflect.DeepEqual(actual, tc.payload) {
+				t.Errorf("expected %+v, but got %+v", tc.payload, actual)
+			}
+		})
+	}
+}
+
+func TestSparkplugMetricWire(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		metric   sparkplugMetric
+		expected []byte
+	}{
+		{
+			// the int32 is carried by the uint32 int_value in two's complement, rather than the sign-extended varint
+			name:     "negative Int32",
+			metric:   sparkplugMetric{Name: "a", Alias: 1, DataType: sparkplugInt32, Value: int32(-1)},
+			expected: []byte{0x0a, 0x01, 'a', 0x10, 0x01, 0x20, 0x03, 0x50, 0xff, 0xff, 0xff, 0xff, 0x0f},
+		},
+		{
+			name:     "Float as fixed32",
+			metric:   sparkplugMetric{Alias: 22, DataType: sparkplugFloat, Value: float32(1)},
+			expected: []byte{0x10, 0x16, 0x20, 0x09, 0x65, 0x00, 0x00, 0x80, 0x3f},
+		},
+		{
+			name:     "Double as fixed64",
+			metric:   sparkplugMetric{Alias: 10, DataType: sparkplugDouble, Value: float64(1)},
+			expected: []byte{0x10, 0x0a, 0x20, 0x0a, 0x69, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf0, 0x3f},
+		},
+		{
+			name:     "null",
+			metric:   sparkplugMetric{Alias: 3, DataType: sparkplugInt64},
+			expected: []byte{0x10, 0x03, 0x20, 0x04, 0x38, 0x01},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := tc.metric.marshal(); !bytes.Equal(actual, tc.expected) {
+				t.Errorf("expected % x, but got % x", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSparkplugPayloadInvalid(t *testing.T) {
+	var payload = sparkplugPayload{
+		Timestamp: 1594213440000,
+		Metrics:   []sparkplugMetric{{Name: "Setpoint", DataType: sparkplugDouble, Value: 70.0}},
+	}
+	var data = payload.Marshal()
+	// the payload cut right after the timestamp field is still valid
+	var boundary = len(appendVarintField(nil, 1, payload.Timestamp))
+	for i := 1; i < len(data); i++ {
+		if i == boundary {
+			continue
+		}
+		var actual sparkplugPayload
+		if err := actual.Unmarshal(data[:i]); err == nil {
+			t.Errorf("expected error of the payload truncated to %d bytes", i)
+		}
+	}
+
+	var actual sparkplugPayload
+	if err := actual.Unmarshal([]byte{0x0b}); err == nil {
+		t.Error("expected error of the unsupported wire type")
+	}
+
+	for _, tc := range []struct {
+		dataType uint32
+		value    interface{}
+	}{
+		{dataType: sparkplugInt32, value: true},
+		{dataType: sparkplugBoolean, value: uint32(1)},
+		{dataType: sparkplugDouble, value: "70"},
+		{dataType: sparkplugString, value: uint64(1)},
+	} {
+		if _, err := sparkplugValue(tc.dataType, tc.value); err == nil {
+			t.Errorf("expected error of converting %T value to data type %d", tc.value, tc.dataType)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package mqtt
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/packet"
+
+	"github.com/rancher/octopus-simulator/cmd/mqtt/options"
+)
+
+// sparkplugHarness observes the messages of the edge node on the memory broker.
+type sparkplugHarness struct {
+	node     *sparkplugNode
+	messages chan *packet.Message
+	close    func()
+}
+
+func newSparkplugHarness(t *testing.T) *sparkplugHarness {
+	var l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var address = fmt.Sprintf("tcp://%s", l.Addr())
+	_ = l.Close()
+
+	var opts = options.NewOptions()
+	opts.Listen = []string{address}
+	brk, err := newMemoryBroker(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	brk.Start()
+
+	// subscribes before the node connects, so that the births are observed
+	var h = &sparkplugHarness{messages: make(chan *packet.Message, 16)}
+	var observer = client.New()
+	observer.Callback = func(msg *packet.Message, err error) error {
+		if msg != nil {
+			h.messages <- msg
+		}
+		return nil
+	}
+	cf, err := observer.Connect(client.NewConfigWithClientID(address, "observer"))
+	if err == nil {
+		err = cf.Wait(5 * time.Second)
+	}
+	if err != nil {
+		brk.Close()
+		t.Fatal(err)
+	}
+	sf, err := observer.Subscribe(sparkplugNamespace+"/test/#", packet.QOSAtMostOnce)
+	if err == nil {
+		err = sf.Wait(5 * time.Second)
+	}
+	if err != nil {
+		_ = observer.Close()
+		brk.Close()
+		t.Fatal(err)
+	}
+
+	conn, err := newConnection(address, opts)
+	if err != nil {
+		_ = observer.Close()
+		brk.Close()
+		t.Fatal(err)
+	}
+	var stop = make(chan struct{})
+	m, err := mockSparkplugNode(conn, "test", "node", stop)
+	if err != nil {
+		_ = observer.Close()
+		brk.Close()
+		t.Fatal(err)
+	}
+	h.node = m.(*sparkplugNode)
+	h.close = func() {
+		_ = m.Close()
+		close(stop)
+		_ = observer.Disconnect()
+		brk.Close()
+	}
+	return h
+}
+
+// expect receives the next message, and verifies its topic and seq.
+func (h *sparkplugHarness) expect(t *testing.T, topic string, seq uint64) sparkplugPayload {
+	var payload sparkplugPayload
+	select {
+	case msg := <-h.messages:
+		if msg.Topic != topic {
+			t.Fatalf("expected topic %s, but got %s", topic, msg.Topic)
+		}
+		if err := payload.Unmarshal(msg.Payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Seq == nil || *payload.Seq != seq {
+			t.Fatalf("expected seq %d of %s, but got %v", seq, topic, payload.Seq)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected message of topic %s, but got nothing", topic)
+	}
+	return payload
+}
+
+// command handles the metrics as if they are received from the topic.
+func (h *sparkplugHarness) command(t *testing.T, topic string, metrics ...sparkplugMetric) {
+	var payload = sparkplugPayload{Timestamp: sparkplugTimestamp(), Metrics: metrics}
+	h.node.Lock()
+	defer h.node.Unlock()
+	if err := h.node.command(&packet.Message{Topic: topic, Payload: payload.Marshal()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSparkplugCommand(t *testing.T) {
+	var h = newSparkplugHarness(t)
+	defer h.close()
+
+	var births = h.expect(t, "spBv1.0/test/NBIRTH/node", 0)
+	if m := births.Metrics[1]; m.Name != sparkplugRebirthMetric || m.Alias != 1 {
+		t.Errorf("expected rebirth metric with alias 1, but got %+v", m)
+	}
+	h.expect(t, "spBv1.0/test/DBIRTH/node/boiler", 1)
+	h.expect(t, "spBv1.0/test/DBIRTH/node/pump", 2)
+
+	// the read-only and unknown metrics are ignored, the written metrics are published by alias with the next seq
+	h.command(t, "spBv1.0/test/DCMD/node/pump",
+		sparkplugMetric{Name: "Speed", DataType: sparkplugInt32, Value: int32(-1450)},
+		sparkplugMetric{Name: "Flow", DataType: sparkplugFloat, Value: float32(1)},
+		sparkplugMetric{Alias: 99, DataType: sparkplugBoolean, Value: true},
+	)
+	var data = h.expect(t, "spBv1.0/test/DDATA/node/pump", 3)
+	if len(data.Metrics) != 1 {
+		t.Fatalf("expected the written metric only, but got %+v", data.Metrics)
+	}
+	var m = data.Metrics[0]
+	var value, err = sparkplugValue(m.DataType, m.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "" || m.Alias != 21 || value != int32(-1450) {
+		t.Errorf("expected Speed by alias 21 of -1450, but got %+v", m)
+	}
+
+	// the command without writable metric publishes nothing
+	h.command(t, "spBv1.0/test/DCMD/node/boiler", sparkplugMetric{Alias: 10, DataType: sparkplugDouble, Value: 100.0})
+
+	h.command(t, "spBv1.0/test/DCMD/node/boiler", sparkplugMetric{Alias: 12, DataType: sparkplugDouble, Value: -70.5})
+	data = h.expect(t, "spBv1.0/test/DDATA/node/boiler", 4)
+	if m := data.Metrics[0]; m.Alias != 12 || m.Value != -70.5 {
+		t.Errorf("expected Setpoint by alias 12 of -70.5, but got %+v", m)
+	}
+
+	// the rebirth resets the seq
+	h.command(t, "spBv1.0/test/NCMD/node", sparkplugMetric{Name: sparkplugRebirthMetric, DataType: sparkplugBoolean, Value: true})
+	h.expect(t, "spBv1.0/test/NBIRTH/node", 0)
+	h.expect(t, "spBv1.0/test/DBIRTH/node/boiler", 1)
+	h.expect(t, "spBv1.0/test/DBIRTH/node/pump", 2)
+}
@@ -0,0 +1,478 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// the payload styles of the device topics.
+const (
+	// flatStyle publishes each attribute to its own topic,
+	// e.g. .../parameter_luminance -> 245
+	flatStyle = "flat"
+	// nestedJSONStyle publishes each top-level field to its own topic, the groups are JSON objects,
+	// e.g. .../parameter -> {"luminance":245,"power":3}
+	nestedJSONStyle = "nested-json"
+	// attributeListStyle publishes each top-level field to its own topic, the groups are arrays of the named attributes,
+	// e.g. .../parameter -> [{"name":"power","value":3,"unit":"W"},{"name":"luminance","value":245,"unit":"lm"}]
+	attributeListStyle = "attribute-list"
+	// documentStyle publishes the whole device to a single topic,
+	// e.g. ... -> {"switch":true,"parameter":{"power":3,"luminance":245},...}
+	documentStyle = "document"
+	// legacyStyle publishes the text payloads laid out by the attributes, which keeps the surface of the hand-written devices,
+	// e.g. .../parameter -> [{"name":"power","value":"70.0w"},{"name":"luminance","value":"4900lm"}],
+	// the attributes without the layout are carried by the whole document as the document style.
+	legacyStyle = "legacy"
+)
+
+// deviceAttribute describes an attribute of the device model.
+type deviceAttribute struct {
+	// path locates the attribute in the document, e.g. parameter.luminance
+	path string
+	// name is the topic level of the attribute in the flat style, e.g. parameter_luminance
+	name string
+	// unit is the unit of measurement, e.g. lm
+	unit     string
+	writable bool
+	// component is the Home Assistant component of the attribute, e.g. sensor, the attribute is not announced if blank
+	component   string
+	deviceClass string
+	// legacy lays out the attribute in the legacy style
+	legacy legacyLayout
+}
+
+// legacyLayout describes the topic and the text payload of the attribute in the legacy style.
+type legacyLayout struct {
+	// level is the topic level, e.g. parameter, the attribute is carried by the whole document if blank
+	level string
+	// shape combines the attributes sharing the level, select from nested-json and attribute-list,
+	// the attribute is published as it is if blank
+	shape string
+	// statusKind and commandKind are the kinds of the state topic and the command topic, status and set by default
+	statusKind  string
+	commandKind string
+	// format is the fmt verb of the numeric value, e.g. %.1f, the value is formatted as text if blank
+	format string
+	// suffix follows the formatted value, e.g. w
+	suffix string
+}
+
+// withLegacyLayouts returns the copy of the attributes laid out by the layouts keyed by the paths.
+func withLegacyLayouts(attributes []deviceAttribute, layouts map[string]legacyLayout) []deviceAttribute {
+	var ret = make([]deviceAttribute, 0, len(attributes))
+	for _, a := range attributes {
+		a.legacy = layouts[a.path]
+		ret = append(ret, a)
+	}
+	return ret
+}
+
+// group returns the top-level field of the attribute and the key inside it,
+// the group is blank if the attribute is a top-level field.
+func (a deviceAttribute) group() (string, string) {
+	var i = strings.Index(a.path, ".")
+	if i < 0 {
+		return "", a.path
+	}
+	return a.path[:i], a.path[i+1:]
+}
+
+// deviceModel is the state of a device, which can be rendered in any payload style.
+type deviceModel interface {
+	// Attributes returns the attributes in the order of rendering.
+	Attributes() []deviceAttribute
+	// Document returns the whole state, which is published as it is by the document style.
+	Document() interface{}
+	// Apply merges the partial document of the writable attributes into the state.
+	Apply(patch map[string]interface{}) error
+	// Vary changes the state as time goes on, returns false if nothing is changed.
+	Vary() bool
+}
+
+type payloadStyle string
+
+func newPayloadStyle(spec string) (payloadStyle, error) {
+	switch spec {
+	case flatStyle, nestedJSONStyle, attributeListStyle, documentStyle, legacyStyle:
+		return payloadStyle(spec), nil
+	}
+	return "", errors.Errorf("unknown payload style %s, select from [%s, %s, %s, %s, %s]",
+		spec, flatStyle, nestedJSONStyle, attributeListStyle, documentStyle, legacyStyle)
+}
+
+// attributeTopic locates the attribute in the topics of the style.
+type attributeTopic struct {
+	// level is the topic level, blank for the whole device
+	level       string
+	statusKind  string
+	commandKind string
+	// p is the path carried by the topic, blank for the whole document
+	p string
+	// shape combines the attributes sharing the topic, the value located by the path is carried as it is if blank
+	shape string
+}
+
+// topicOf locates the attribute in the topics.
+func (s payloadStyle) topicOf(a deviceAttribute) attributeTopic {
+	var group, key = a.group()
+	var ret = attributeTopic{
+		statusKind:  statusTopic,
+		commandKind: setTopic,
+	}
+	switch {
+	case s == documentStyle:
+	case s == flatStyle:
+		ret.level, ret.p = a.name, a.path
+	case s == legacyStyle:
+		var l = a.legacy
+		if l.statusKind != "" {
+			ret.statusKind = l.statusKind
+		}
+		if l.commandKind != "" {
+			ret.commandKind = l.commandKind
+		}
+		switch {
+		case l.level == "":
+		case l.shape == "":
+			ret.level, ret.p = l.level, a.path
+		default:
+			ret.level, ret.p, ret.shape = l.level, group, l.shape
+		}
+	case group == "":
+		ret.level, ret.p = key, key
+	default:
+		ret.level, ret.p, ret.shape = group, group, string(s)
+	}
+	return ret
+}
+
+// States renders the state of the model, the keys are the topics.
+func (s payloadStyle) States(t *deviceTopics, m deviceModel) (map[string]interface{}, error) {
+	var doc, err = documentOf(m)
+	if err != nil {
+		return nil, err
+	}
+	var states = make(map[string]interface{})
+	// the attributes of the legacy groups are rendered after all attributes are collected
+	var groups = make(map[string][]deviceAttribute)
+	for _, a := range m.Attributes() {
+		var at = s.topicOf(a)
+		var topic = t.Topic(at.statusKind, at.level)
+		switch {
+		case at.p == "":
+			states[topic] = m.Document()
+		case at.shape == "":
+			var v = lookupPath(doc, at.p)
+			if s == legacyStyle {
+				v = a.legacy.text(v)
+			}
+			states[topic] = v
+		case s == legacyStyle:
+			groups[topic] = append(groups[topic], a)
+		case at.shape == attributeListStyle:
+			var _, key = a.group()
+			var attribute = map[string]interface{}{
+				"name":  key,
+				"value": lookupPath(doc, a.path),
+			}
+			if a.unit != "" {
+				attribute["unit"] = a.unit
+			}
+			var list, _ = states[topic].([]interface{})
+			states[topic] = append(list, attribute)
+		default:
+			states[topic] = lookupPath(doc, at.p)
+		}
+	}
+	for topic, attributes := range groups {
+		var text, err = legacyGroupText(doc, attributes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to render states for topic %s", topic)
+		}
+		states[topic] = text
+	}
+	return states, nil
+}
+
+// Commands returns the topics to receive the commands, which are mapped to the paths they write.
+func (s payloadStyle) Commands(t *deviceTopics, m deviceModel) map[string]string {
+	var commands = make(map[string]string)
+	for _, a := range m.Attributes() {
+		if !a.writable {
+			continue
+		}
+		var at = s.topicOf(a)
+		commands[t.Topic(at.commandKind, at.level)] = at.p
+	}
+	return commands
+}
+
+// Requests returns the topics to receive the get requests, which are mapped to the status topics they read,
+// the get topic of the whole device reads all states and is mapped to blank.
+func (s payloadStyle) Requests(t *deviceTopics, m deviceModel) map[string]string {
+	var statuses = make(map[string]string)
+	for _, a := range m.Attributes() {
+		var at = s.topicOf(a)
+		statuses[at.level] = t.Topic(at.statusKind, at.level)
+	}
+	return t.RequestsOf(statuses)
+}
+
+// Patch converts the command value written to the path into the partial document of the writable attributes,
+// the groups accept both the JSON objects and the attribute arrays.
+func (s payloadStyle) Patch(m deviceModel, p string, value interface{}) (map[string]interface{}, error) {
+	if str, ok := value.(string); ok {
+		value = inferValue(str)
+	}
+
+	var candidate = make(map[string]interface{})
+	switch {
+	case p == "":
+		var doc, ok = value.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("expected JSON object but got %T", value)
+		}
+		candidate = doc
+	case isAttributePath(m, p):
+		if wrapper, ok := value.(map[string]interface{}); ok {
+			if v, exist := wrapper["value"]; exist {
+				value = v
+			}
+		}
+		setPath(candidate, p, value)
+	default:
+		var group, err = groupOf(value)
+		if err != nil {
+			return nil, err
+		}
+		candidate[p] = group
+	}
+
+	var patch = make(map[string]interface{})
+	for _, a := range m.Attributes() {
+		if !a.writable {
+			continue
+		}
+		var v = lookupPath(candidate, a.path)
+		if v == nil {
+			continue
+		}
+		if str, ok := v.(string); ok {
+			v = inferValue(str)
+		}
+		setPath(patch, a.path, v)
+	}
+	if len(patch) == 0 {
+		return nil, errors.New("no writable attribute is found")
+	}
+	return patch, nil
+}
+
+// Entities returns the Home Assistant discovery entities of the attributes.
+func (s payloadStyle) Entities(t *deviceTopics, m deviceModel, id, title string) []discoveryEntity {
+	var entities []discoveryEntity
+	var indexes = make(map[string]int)
+	for _, a := range m.Attributes() {
+		var at = s.topicOf(a)
+		var _, key = a.group()
+		var stateTopic = t.Topic(at.statusKind, at.level)
+
+		// value renders the expression of the state, command renders the command payload of the JSON literal
+		var value = "value_json." + a.path
+		var command = func(v string) string {
+			for _, k := range reverse(strings.Split(a.path, ".")) {
+				v = fmt.Sprintf(`{"%s":%s}`, k, v)
+			}
+			return v
+		}
+		switch {
+		case at.p == "":
+		case at.shape == "":
+			value = "value"
+			command = func(v string) string { return v }
+		case at.shape == nestedJSONStyle:
+			value = "value_json." + key
+			command = func(v string) string { return fmt.Sprintf(`{"%s":%s}`, key, v) }
+		case at.shape == attributeListStyle:
+			value = fmt.Sprintf("value_json[%d].value", indexes[stateTopic])
+			command = func(v string) string { return fmt.Sprintf(`[{"name":"%s","value":%s}]`, key, v) }
+			indexes[stateTopic]++
+		}
+		if s == legacyStyle && a.legacy.suffix != "" {
+			value = fmt.Sprintf("%s | replace('%s', '')", value, a.legacy.suffix)
+		}
+		if a.component == "" {
+			continue
+		}
+
+		var objectID = "octopus_simulator_" + id
+		var config = discoveryConfig{
+			Name:              title,
+			DeviceClass:       a.deviceClass,
+			StateTopic:        stateTopic,
+			UnitOfMeasurement: a.unit,
+		}
+		switch a.component {
+		case "light":
+			var on = value
+			if on == "value" {
+				on = "value == 'true'"
+			}
+			config.Schema = "template"
+			config.CommandTopic = t.Topic(at.commandKind, at.level)
+			config.StateTemplate = fmt.Sprintf("{{ 'on' if %s else 'off' }}", on)
+			config.CommandOnTemplate = command("true")
+			config.CommandOffTemplate = command("false")
+		default:
+			objectID += "_" + strings.ToLower(key)
+			config.Name += " " + strings.Title(key)
+			if value != "value" {
+				config.ValueTemplate = fmt.Sprintf("{{ %s }}", value)
+			}
+		}
+		entities = append(entities, discoveryEntity{
+			component: a.component,
+			objectID:  objectID,
+			config:    config,
+		})
+	}
+	return entities
+}
+
+// text formats the value laid out by the legacy style.
+func (l legacyLayout) text(v interface{}) string {
+	if l.format != "" {
+		// the whole numbers are modeled as integers
+		switch t := v.(type) {
+		case int64:
+			v = float64(t)
+		case uint64:
+			v = float64(t)
+		}
+		return fmt.Sprintf(l.format, v) + l.suffix
+	}
+	return textOf(v) + l.suffix
+}
+
+// legacyGroupText renders the attributes sharing the topic in the legacy style,
+// the JSON object keeps the order of the attributes, e.g. {"manufacturer":"Rancher Octopus Fake Device","date":...},
+// and the attribute array carries the text values, e.g. [{"name":"power","value":"70.0w"},...].
+func legacyGroupText(doc map[string]interface{}, attributes []deviceAttribute) (string, error) {
+	if attributes[0].legacy.shape == attributeListStyle {
+		var list = make([]interface{}, 0, len(attributes))
+		for _, a := range attributes {
+			var _, key = a.group()
+			list = append(list, map[string]interface{}{
+				"name":  key,
+				"value": a.legacy.text(lookupPath(doc, a.path)),
+			})
+		}
+		var data, err = marshalValue(list)
+		return string(data), err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i, a := range attributes {
+		var _, key = a.group()
+		var k, err = marshalValue(key)
+		if err != nil {
+			return "", err
+		}
+		v, err := marshalValue(lookupPath(doc, a.path))
+		if err != nil {
+			return "", err
+		}
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.Write(k)
+		buf.WriteString(":")
+		buf.Write(v)
+	}
+	buf.WriteString("}")
+	return buf.String(), nil
+}
+
+// documentOf converts the document of the model into the generic model.
+func documentOf(m deviceModel) (map[string]interface{}, error) {
+	var g, err = genericOf(m.Document())
+	if err != nil {
+		return nil, err
+	}
+	var doc, ok = g.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("expected JSON object document but got %T", g)
+	}
+	return doc, nil
+}
+
+func isAttributePath(m deviceModel, p string) bool {
+	for _, a := range m.Attributes() {
+		if a.path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// groupOf converts the attribute array into the JSON object, e.g. [{"name":"gear","value":"mid"}] results in {"gear":"mid"}.
+func groupOf(value interface{}) (map[string]interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, nil
+	case []interface{}:
+		var ret = make(map[string]interface{}, len(v))
+		for _, e := range v {
+			var attribute, ok = e.(map[string]interface{})
+			if !ok {
+				return nil, errors.Errorf("expected attribute object but got %T", e)
+			}
+			var name, _ = attribute["name"].(string)
+			if name == "" {
+				return nil, errors.New("attribute name is required")
+			}
+			ret[name] = attribute["value"]
+		}
+		return ret, nil
+	}
+	return nil, errors.Errorf("expected JSON object or attribute array but got %T", value)
+}
+
+// lookupPath returns the value located by the dotted path, or nil if not found.
+func lookupPath(doc map[string]interface{}, p string) interface{} {
+	var v interface{} = doc
+	for _, k := range strings.Split(p, ".") {
+		var m, ok = v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// setPath sets the value located by the dotted path, the absent objects are created.
+func setPath(doc map[string]interface{}, p string, value interface{}) {
+	var keys = strings.Split(p, ".")
+	for _, k := range keys[:len(keys)-1] {
+		var m, ok = doc[k].(map[string]interface{})
+		if !ok {
+			m = make(map[string]interface{})
+			doc[k] = m
+		}
+		doc = m
+	}
+	doc[keys[len(keys)-1]] = value
+}
+
+func reverse(s []string) []string {
+	var ret = make([]string, 0, len(s))
+	for i := len(s) - 1; i >= 0; i-- {
+		ret = append(ret, s[i])
+	}
+	return ret
+}
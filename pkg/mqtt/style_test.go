@@ -0,0 +1,386 @@
+package mqtt
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// renderSpec renders the states, commands and get requests of the device in its default layout.
+func renderSpec(t *testing.T, spec deviceSpec) (map[string]string, map[string]string, map[string]string) {
+	var ns, err = newTopicNamespace("cattle.io/octopus", "home", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var topics = ns.Device(spec.area, spec.device, spec.defaultTemplate)
+	style, err := newPayloadStyle(spec.defaultStyle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := newPayloadCodec(spec.defaultCodec, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states, err := style.States(topics, spec.model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payloads = make(map[string]string, len(states))
+	for topic, state := range states {
+		var data, err = codec.Encode(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloads[topic] = string(data)
+	}
+	return payloads, style.Commands(topics, spec.model), style.Requests(topics, spec.model)
+}
+
+func TestLegacyStyleGoldenTopics(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		spec     deviceSpec
+		states   map[string]string
+		commands map[string]string
+		requests map[string]string
+	}{
+		{
+			name: "kitchen light",
+			spec: kitchenLightSpec(),
+			states: map[string]string{
+				"cattle.io/octopus/home/status/kitchen/light/switch":              "false",
+				"cattle.io/octopus/home/get/kitchen/light/gear":                   "low",
+				"cattle.io/octopus/home/status/kitchen/light/parameter_power":     "3.0",
+				"cattle.io/octopus/home/status/kitchen/light/parameter_luminance": "245",
+				"cattle.io/octopus/home/status/kitchen/light/manufacturer":        "Rancher Octopus Fake Device",
+				"cattle.io/octopus/home/status/kitchen/light/production_date":     "2020-07-08T13:24:00.00Z",
+				"cattle.io/octopus/home/status/kitchen/light/service_life":        "P10Y0M0D",
+			},
+			commands: map[string]string{
+				"cattle.io/octopus/home/set/kitchen/light/switch":   "switch",
+				"cattle.io/octopus/home/control/kitchen/light/gear": "action.gear",
+			},
+			requests: map[string]string{
+				"cattle.io/octopus/home/get/kitchen/light/switch":              "cattle.io/octopus/home/status/kitchen/light/switch",
+				"cattle.io/octopus/home/get/kitchen/light/parameter_power":     "cattle.io/octopus/home/status/kitchen/light/parameter_power",
+				"cattle.io/octopus/home/get/kitchen/light/parameter_luminance": "cattle.io/octopus/home/status/kitchen/light/parameter_luminance",
+				"cattle.io/octopus/home/get/kitchen/light/manufacturer":        "cattle.io/octopus/home/status/kitchen/light/manufacturer",
+				"cattle.io/octopus/home/get/kitchen/light/production_date":     "cattle.io/octopus/home/status/kitchen/light/production_date",
+				"cattle.io/octopus/home/get/kitchen/light/service_life":        "cattle.io/octopus/home/status/kitchen/light/service_life",
+				"cattle.io/octopus/home/get/kitchen/light":                     "",
+			},
+		},
+		{
+			name: "living room light",
+			spec: livingRoomLightSpec(),
+			states: map[string]string{
+				"cattle.io/octopus/home/livingroom/light/switch":     "false",
+				"cattle.io/octopus/home/livingroom/light/gear":       "low",
+				"cattle.io/octopus/home/livingroom/light/parameter":  `[{"name":"power","value":"70.0w"},{"name":"luminance","value":"4900lm"}]`,
+				"cattle.io/octopus/home/livingroom/light/production": `{"manufacturer":"Rancher Octopus Fake Device","date":"2020-07-09T13:00:00.00Z","serviceLife":"P10Y0M0D"}`,
+			},
+			commands: map[string]string{
+				"cattle.io/octopus/home/livingroom/light/switch/set": "switch",
+				"cattle.io/octopus/home/livingroom/light/gear/set":   "action.gear",
+			},
+			requests: map[string]string{
+				"cattle.io/octopus/home/livingroom/light/switch/get":     "cattle.io/octopus/home/livingroom/light/switch",
+				"cattle.io/octopus/home/livingroom/light/gear/get":       "cattle.io/octopus/home/livingroom/light/gear",
+				"cattle.io/octopus/home/livingroom/light/parameter/get":  "cattle.io/octopus/home/livingroom/light/parameter",
+				"cattle.io/octopus/home/livingroom/light/production/get": "cattle.io/octopus/home/livingroom/light/production",
+				"cattle.io/octopus/home/livingroom/light/get":            "",
+			},
+		},
+		{
+			name: "bedroom light",
+			spec: bedroomLightSpec(),
+			states: map[string]string{
+				"cattle.io/octopus/home/bedroom/light": `{"switch":false,"action":{"gear":"low"},"parameter":{"power":24.3,"luminance":1800},"production":{"manufacturer":"Rancher Octopus Fake Device","date":"2020-07-20T13:24:00.00Z","serviceLife":"P10Y0M0D"}}`,
+			},
+			commands: map[string]string{
+				"cattle.io/octopus/home/bedroom/light/set": "",
+			},
+			requests: map[string]string{
+				"cattle.io/octopus/home/bedroom/light/get": "cattle.io/octopus/home/bedroom/light",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var states, commands, requests = renderSpec(t, tc.spec)
+			if !reflect.DeepEqual(states, tc.states) {
+				t.Errorf("expected states %v, but got %v", tc.states, states)
+			}
+			if !reflect.DeepEqual(commands, tc.commands) {
+				t.Errorf("expected commands %v, but got %v", tc.commands, commands)
+			}
+			if !reflect.DeepEqual(requests, tc.requests) {
+				t.Errorf("expected get requests %v, but got %v", tc.requests, requests)
+			}
+		})
+	}
+}
+
+func TestPayloadStyleStates(t *testing.T) {
+	var testCases = []struct {
+		style    string
+		states   map[string]string
+		commands map[string]string
+	}{
+		{
+			style: flatStyle,
+			states: map[string]string{
+				"cattle.io/octopus/home/status/kitchen/light/switch":              "false",
+				"cattle.io/octopus/home/status/kitchen/light/gear":                "low",
+				"cattle.io/octopus/home/status/kitchen/light/parameter_power":     "3",
+				"cattle.io/octopus/home/status/kitchen/light/parameter_luminance": "245",
+				"cattle.io/octopus/home/status/kitchen/light/manufacturer":        "Rancher Octopus Fake Device",
+				"cattle.io/octopus/home/status/kitchen/light/production_date":     "2020-07-08T13:24:00.00Z",
+				"cattle.io/octopus/home/status/kitchen/light/service_life":        "P10Y0M0D",
+			},
+			commands: map[string]string{
+				"cattle.io/octopus/home/set/kitchen/light/switch": "switch",
+				"cattle.io/octopus/home/set/kitchen/light/gear":   "action.gear",
+			},
+		},
+		{
+			style: nestedJSONStyle,
+			states: map[string]string{
+				"cattle.io/octopus/home/status/kitchen/light/switch":     "false",
+				"cattle.io/octopus/home/status/kitchen/light/action":     `{"gear":"low"}`,
+				"cattle.io/octopus/home/status/kitchen/light/parameter":  `{"luminance":245,"power":3}`,
+				"cattle.io/octopus/home/status/kitchen/light/production": `{"date":"2020-07-08T13:24:00.00Z","manufacturer":"Rancher Octopus Fake Device","serviceLife":"P10Y0M0D"}`,
+			},
+			commands: map[string]string{
+				"cattle.io/octopus/home/set/kitchen/light/switch": "switch",
+				"cattle.io/octopus/home/set/kitchen/light/action": "action",
+			},
+		},
+		{
+			style: attributeListStyle,
+			states: map[string]string{
+				"cattle.io/octopus/home/status/kitchen/light/switch":     "false",
+				"cattle.io/octopus/home/status/kitchen/light/action":     `[{"name":"gear","value":"low"}]`,
+				"cattle.io/octopus/home/status/kitchen/light/parameter":  `[{"name":"power","unit":"W","value":3},{"name":"luminance","unit":"lm","value":245}]`,
+				"cattle.io/octopus/home/status/kitchen/light/production": `[{"name":"manufacturer","value":"Rancher Octopus Fake Device"},{"name":"date","value":"2020-07-08T13:24:00.00Z"},{"name":"serviceLife","value":"P10Y0M0D"}]`,
+			},
+			commands: map[string]string{
+				"cattle.io/octopus/home/set/kitchen/light/switch": "switch",
+				"cattle.io/octopus/home/set/kitchen/light/action": "action",
+			},
+		},
+		{
+			style: documentStyle,
+			states: map[string]string{
+				"cattle.io/octopus/home/status/kitchen/light": `{"switch":false,"action":{"gear":"low"},"parameter":{"power":3,"luminance":245},"production":{"manufacturer":"Rancher Octopus Fake Device","date":"2020-07-08T13:24:00.00Z","serviceLife":"P10Y0M0D"}}`,
+			},
+			commands: map[string]string{
+				"cattle.io/octopus/home/set/kitchen/light": "",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.style, func(t *testing.T) {
+			var spec = kitchenLightSpec()
+			spec.defaultStyle = tc.style
+			var states, commands, _ = renderSpec(t, spec)
+			if !reflect.DeepEqual(states, tc.states) {
+				t.Errorf("expected states %v, but got %v", tc.states, states)
+			}
+			if !reflect.DeepEqual(commands, tc.commands) {
+				t.Errorf("expected commands %v, but got %v", tc.commands, commands)
+			}
+		})
+	}
+}
+
+func TestPayloadStylePatch(t *testing.T) {
+	var testCases = []struct {
+		name      string
+		style     string
+		p         string
+		value     interface{}
+		expected  map[string]interface{}
+		expectErr bool
+	}{
+		{
+			name:     "flat attribute",
+			style:    flatStyle,
+			p:        "switch",
+			value:    "true",
+			expected: map[string]interface{}{"switch": true},
+		},
+		{
+			name:     "flat attribute wrapped as the named value",
+			style:    flatStyle,
+			p:        "action.gear",
+			value:    map[string]interface{}{"name": "gear", "value": "mid"},
+			expected: map[string]interface{}{"action": map[string]interface{}{"gear": "mid"}},
+		},
+		{
+			name:     "nested object",
+			style:    nestedJSONStyle,
+			p:        "action",
+			value:    `{"gear":"high"}`,
+			expected: map[string]interface{}{"action": map[string]interface{}{"gear": "high"}},
+		},
+		{
+			name:     "attribute array",
+			style:    attributeListStyle,
+			p:        "action",
+			value:    `[{"name":"gear","value":"mid"}]`,
+			expected: map[string]interface{}{"action": map[string]interface{}{"gear": "mid"}},
+		},
+		{
+			name:      "attribute array without name",
+			style:     attributeListStyle,
+			p:         "action",
+			value:     `[{"value":"mid"}]`,
+			expectErr: true,
+		},
+		{
+			name:     "document drops the read-only attributes",
+			style:    documentStyle,
+			value:    `{"switch":true,"parameter":{"power":1}}`,
+			expected: map[string]interface{}{"switch": true},
+		},
+		{
+			name:      "document of read-only attributes",
+			style:     documentStyle,
+			value:     `{"parameter":{"power":1}}`,
+			expectErr: true,
+		},
+		{
+			name:      "document of scalar",
+			style:     documentStyle,
+			value:     "true",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var actual, err = payloadStyle(tc.style).Patch(newLightModel(lightAttributes, 3.0, 245, ""), tc.p, tc.value)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("expected error, but got %v", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("expected patch %v, but got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestPayloadStyleEntities(t *testing.T) {
+	var ns, err = newTopicNamespace("cattle.io/octopus", "home", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testCases = []struct {
+		name     string
+		spec     deviceSpec
+		style    string
+		expected map[string]discoveryConfig
+	}{
+		{
+			name:  "legacy kitchen light",
+			spec:  kitchenLightSpec(),
+			style: legacyStyle,
+			expected: map[string]discoveryConfig{
+				"octopus_simulator_kitchen_light_gear": {
+					Name:       "Kitchen Light Gear",
+					StateTopic: "cattle.io/octopus/home/get/kitchen/light/gear",
+				},
+				"octopus_simulator_kitchen_light_power": {
+					Name:              "Kitchen Light Power",
+					DeviceClass:       "power",
+					StateTopic:        "cattle.io/octopus/home/status/kitchen/light/parameter_power",
+					UnitOfMeasurement: "W",
+				},
+			},
+		},
+		{
+			name:  "legacy living room light",
+			spec:  livingRoomLightSpec(),
+			style: legacyStyle,
+			expected: map[string]discoveryConfig{
+				"octopus_simulator_livingroom_light": {
+					Name:               "Living Room Light",
+					Schema:             "template",
+					StateTopic:         "cattle.io/octopus/home/livingroom/light/switch",
+					CommandTopic:       "cattle.io/octopus/home/livingroom/light/switch/set",
+					StateTemplate:      "{{ 'on' if value == 'true' else 'off' }}",
+					CommandOnTemplate:  "true",
+					CommandOffTemplate: "false",
+				},
+				"octopus_simulator_livingroom_light_luminance": {
+					Name:              "Living Room Light Luminance",
+					StateTopic:        "cattle.io/octopus/home/livingroom/light/parameter",
+					ValueTemplate:     "{{ value_json[1].value | replace('lm', '') }}",
+					UnitOfMeasurement: "lm",
+				},
+			},
+		},
+		{
+			name:  "attribute list",
+			spec:  livingRoomLightSpec(),
+			style: attributeListStyle,
+			expected: map[string]discoveryConfig{
+				"octopus_simulator_livingroom_light_power": {
+					Name:              "Living Room Light Power",
+					DeviceClass:       "power",
+					StateTopic:        "cattle.io/octopus/home/livingroom/light/parameter",
+					ValueTemplate:     "{{ value_json[0].value }}",
+					UnitOfMeasurement: "W",
+				},
+			},
+		},
+		{
+			name:  "document",
+			spec:  bedroomLightSpec(),
+			style: documentStyle,
+			expected: map[string]discoveryConfig{
+				"octopus_simulator_bedroom_light": {
+					Name:               "Bedroom Light",
+					Schema:             "template",
+					StateTopic:         "cattle.io/octopus/home/bedroom/light",
+					CommandTopic:       "cattle.io/octopus/home/bedroom/light/set",
+					StateTemplate:      "{{ 'on' if value_json.switch else 'off' }}",
+					CommandOnTemplate:  `{"switch":true}`,
+					CommandOffTemplate: `{"switch":false}`,
+				},
+				"octopus_simulator_bedroom_light_gear": {
+					Name:          "Bedroom Light Gear",
+					StateTopic:    "cattle.io/octopus/home/bedroom/light",
+					ValueTemplate: "{{ value_json.action.gear }}",
+				},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var topics = ns.Device(tc.spec.area, tc.spec.device, tc.spec.defaultTemplate)
+			var id = strings.ReplaceAll(tc.spec.name, "-", "_")
+			var entities = make(map[string]discoveryConfig)
+			for _, e := range payloadStyle(tc.style).Entities(topics, tc.spec.model, id, tc.spec.title) {
+				entities[e.objectID] = e.config
+			}
+			for id, expected := range tc.expected {
+				if actual, exist := entities[id]; !exist || !reflect.DeepEqual(actual, expected) {
+					t.Errorf("expected entity %s %+v, but got %+v", id, expected, actual)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package mqtt
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// the kinds of the device topics.
+const (
+	statusTopic  = "status"
+	getTopic     = "get"
+	setTopic     = "set"
+	controlTopic = "control"
+)
+
+// the default topic templates of the devices, which reproduce the topics under cattle.io/octopus/home:
+// the kitchen devices put the kind ahead of the area, and the others put the get and set kinds at the end.
+const (
+	kindFirstTopicTemplate   = `{{.Prefix}}/{{.Site}}/{{.Kind}}/{{.Area}}/{{.Device}}/{{.Attribute}}`
+	deviceFirstTopicTemplate = `{{.Prefix}}/{{.Site}}/{{.Area}}/{{.Device}}/{{.Attribute}}{{if ne .Kind "status"}}/{{.Kind}}{{end}}`
+)
+
+var repeatedSlashes = regexp.MustCompile(`/{2,}`)
+
+// topicData is the variables of the topic template.
+type topicData struct {
+	// Prefix is the namespace of the simulator instance, e.g. cattle.io/octopus
+	Prefix string
+	// Site is the site of the devices, e.g. home
+	Site string
+	// Area is where the device locates, e.g. kitchen
+	Area string
+	// Device is the kind of the device, e.g. light
+	Device string
+	// Kind is one of status, get, set and control
+	Kind string
+	// Attribute is the attribute of the device, e.g. switch, or blank if the topic carries the whole device
+	Attribute string
+}
+
+// topicNamespace renders the topics of all devices.
+type topicNamespace struct {
+	prefix string
+	site   string
+	// overrides the default templates of the devices if not nil
+	template *template.Template
+}
+
+func newTopicNamespace(prefix, site, text string) (*topicNamespace, error) {
+	var n = &topicNamespace{
+		prefix: prefix,
+		site:   site,
+	}
+	if text != "" {
+		var t, err = parseTopicTemplate(text)
+		if err != nil {
+			return nil, err
+		}
+		n.template = t
+	}
+	return n, nil
+}
+
+// Device returns the topics of the device, which are rendered by the configured template,
+// or the default template of the device if not configured.
+func (n *topicNamespace) Device(area, device, defaultTemplate string) *deviceTopics {
+	var t = n.template
+	if t == nil {
+		t = template.Must(parseTopicTemplate(defaultTemplate))
+	}
+	return &deviceTopics{
+		template: t,
+		data: topicData{
+			Prefix: n.prefix,
+			Site:   n.site,
+			Area:   area,
+			Device: device,
+		},
+	}
+}
+
+// parseTopicTemplate parses the template and renders it once to reject the unknown variables,
+// and rejects the template rendering the set or control topics the same as the status topics,
+// otherwise the devices subscribe their own retained states as commands.
+func parseTopicTemplate(text string) (*template.Template, error) {
+	var t, err = template.New("topic").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse topic template %s", text)
+	}
+	if err := t.Execute(&bytes.Buffer{}, topicData{}); err != nil {
+		return nil, errors.Wrapf(err, "failed to render topic template %s", text)
+	}
+
+	var topics = &deviceTopics{
+		template: t,
+		data:     topicData{Prefix: "prefix", Site: "site", Area: "area", Device: "device"},
+	}
+	for _, kind := range []string{setTopic, controlTopic} {
+		if topics.Topic(kind, "attribute") == topics.Topic(statusTopic, "attribute") {
+			return nil, errors.Errorf("topic template %s renders the %s topics the same as the status topics", text, kind)
+		}
+	}
+	return t, nil
+}
+
+type deviceTopics struct {
+	template *template.Template
+	data     topicData
+}
+
+// Topic renders the topic of the attribute, the blank levels are squashed,
+// e.g. the blank attribute results in cattle.io/octopus/home/bedroom/light rather than cattle.io/octopus/home/bedroom/light/.
+func (t *deviceTopics) Topic(kind, attribute string) string {
+	var data = t.data
+	data.Kind = kind
+	data.Attribute = attribute
+
+	var buf bytes.Buffer
+	// the template has been verified by parseTopicTemplate
+	_ = t.template.Execute(&buf, data)
+	return strings.Trim(repeatedSlashes.ReplaceAllString(buf.String(), "/"), "/")
+}
+
+// Availability returns the topic of the online/offline availability.
+func (t *deviceTopics) Availability() string {
+	return t.Topic(statusTopic, "availability")
+}
+
+// Requests returns the get topics of the attributes mapped to their status topics,
+// and the get topic of the whole device mapped to blank, which reads all states.
+func (t *deviceTopics) Requests(attributes ...string) map[string]string {
+	var statuses = make(map[string]string, len(attributes))
+	for _, attribute := range attributes {
+		statuses[attribute] = t.Topic(statusTopic, attribute)
+	}
+	return t.RequestsOf(statuses)
+}
+
+// RequestsOf is the same as Requests, but the status topics are keyed by the attributes,
+// e.g. the kitchen light publishes its gear to the get topic.
+// The get topics rendered the same as the status topics are skipped, otherwise the device would answer its own states.
+func (t *deviceTopics) RequestsOf(statuses map[string]string) map[string]string {
+	var requests = make(map[string]string)
+	for attribute, status := range statuses {
+		if get := t.Topic(getTopic, attribute); get != status {
+			requests[get] = status
+		}
+	}
+	if get := t.Topic(getTopic, ""); get != t.Topic(statusTopic, "") {
+		if _, exist := requests[get]; !exist {
+			requests[get] = ""
+		}
+	}
+	return requests
+}
@@ -0,0 +1,139 @@
+package mqtt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTopicTemplate(t *testing.T) {
+	var testCases = []struct {
+		name            string
+		prefix, site    string
+		template        string
+		defaultTemplate string
+		kind, attribute string
+		expected        string
+	}{
+		{
+			name:            "kind first status",
+			prefix:          "cattle.io/octopus",
+			site:            "home",
+			defaultTemplate: kindFirstTopicTemplate,
+			kind:            statusTopic,
+			attribute:       "switch",
+			expected:        "cattle.io/octopus/home/status/kitchen/light/switch",
+		},
+		{
+			name:            "kind first device",
+			prefix:          "cattle.io/octopus",
+			site:            "home",
+			defaultTemplate: kindFirstTopicTemplate,
+			kind:            getTopic,
+			expected:        "cattle.io/octopus/home/get/kitchen/light",
+		},
+		{
+			name:            "device first status",
+			prefix:          "cattle.io/octopus",
+			site:            "home",
+			defaultTemplate: deviceFirstTopicTemplate,
+			kind:            statusTopic,
+			attribute:       "parameter",
+			expected:        "cattle.io/octopus/home/kitchen/light/parameter",
+		},
+		{
+			name:            "device first set",
+			prefix:          "cattle.io/octopus",
+			site:            "home",
+			defaultTemplate: deviceFirstTopicTemplate,
+			kind:            setTopic,
+			attribute:       "switch",
+			expected:        "cattle.io/octopus/home/kitchen/light/switch/set",
+		},
+		{
+			name:            "device first document",
+			prefix:          "cattle.io/octopus",
+			site:            "home",
+			defaultTemplate: deviceFirstTopicTemplate,
+			kind:            statusTopic,
+			expected:        "cattle.io/octopus/home/kitchen/light",
+		},
+		{
+			name:            "configured template overrides the default",
+			prefix:          "acme",
+			site:            "plant1",
+			template:        "{{.Prefix}}/{{.Site}}/{{.Area}}/{{.Device}}/{{.Attribute}}/{{.Kind}}",
+			defaultTemplate: kindFirstTopicTemplate,
+			kind:            controlTopic,
+			attribute:       "gear",
+			expected:        "acme/plant1/kitchen/light/gear/control",
+		},
+		{
+			name:            "blank levels are squashed",
+			template:        "/{{.Prefix}}/{{.Site}}/{{.Kind}}/{{.Area}}/{{.Device}}/{{.Attribute}}/",
+			defaultTemplate: kindFirstTopicTemplate,
+			kind:            statusTopic,
+			expected:        "status/kitchen/light",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var ns, err = newTopicNamespace(tc.prefix, tc.site, tc.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var actual = ns.Device("kitchen", "light", tc.defaultTemplate).Topic(tc.kind, tc.attribute)
+			if actual != tc.expected {
+				t.Errorf("expected %s, but got %s", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestTopicTemplateInvalid(t *testing.T) {
+	for _, text := range []string{
+		"{{.Prefix}/{{.Site}}",
+		"{{.Prefix}}/{{.Zone}}",
+		"{{.Prefix}}/{{template \"absent\"}}",
+		// the set topics are the same as the status topics
+		"{{.Prefix}}/{{.Site}}/{{.Area}}/{{.Device}}/{{.Attribute}}",
+		"{{.Prefix}}/{{.Site}}/{{.Area}}/{{.Device}}/{{.Attribute}}{{if eq .Kind \"get\"}}/get{{end}}",
+	} {
+		if _, err := newTopicNamespace("cattle.io/octopus", "home", text); err == nil {
+			t.Errorf("expected error of template %s", text)
+		}
+	}
+}
+
+func TestTopicRequests(t *testing.T) {
+	var ns, err = newTopicNamespace("cattle.io/octopus", "home", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kitchen = ns.Device("kitchen", "door", kindFirstTopicTemplate)
+	var expected = map[string]string{
+		"cattle.io/octopus/home/get/kitchen/door/state": "cattle.io/octopus/home/status/kitchen/door/state",
+		"cattle.io/octopus/home/get/kitchen/door":       "",
+	}
+	if actual := kitchen.Requests("state"); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, but got %v", expected, actual)
+	}
+
+	// the get topic rendered the same as the status topic is skipped
+	expected = map[string]string{
+		"cattle.io/octopus/home/get/kitchen/door": "",
+	}
+	if actual := kitchen.RequestsOf(map[string]string{"state": "cattle.io/octopus/home/get/kitchen/door/state"}); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, but got %v", expected, actual)
+	}
+
+	// the template without the get kind renders the get topics the same as the status topics
+	flat, err := newTopicNamespace("cattle.io/octopus", "home", "{{.Prefix}}/{{.Site}}/{{.Area}}/{{.Device}}/{{.Attribute}}{{if eq .Kind \"set\" \"control\"}}/{{.Kind}}{{end}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := flat.Device("kitchen", "door", kindFirstTopicTemplate).Requests("state"); len(actual) != 0 {
+		t.Errorf("expected no get request, but got %v", actual)
+	}
+}
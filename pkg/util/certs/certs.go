@@ -0,0 +1,177 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// validity of the throwaway certificates
+const validity = 365 * 24 * time.Hour
+
+// Bundle is a certificate with its private key.
+type Bundle struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// NewCA creates a self-signed certificate authority for tests.
+func NewCA(commonName string) (*Bundle, error) {
+	var template = newTemplate(commonName)
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	return create(template, nil)
+}
+
+// IssueServer issues a server certificate for the hosts, which can be DNS names or IP addresses.
+func (in *Bundle) IssueServer(commonName string, hosts []string) (*Bundle, error) {
+	var template = newTemplate(commonName)
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	return create(template, in)
+}
+
+// IssueClient issues a client certificate with the extra extensions, e.g. the role of Modbus security.
+func (in *Bundle) IssueClient(commonName string, extensions ...pkix.Extension) (*Bundle, error) {
+	var template = newTemplate(commonName)
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	template.ExtraExtensions = extensions
+	return create(template, in)
+}
+
+// Write stores the certificate as <name>.pem and the private key as <name>-key.pem under the directory.
+func (in *Bundle) Write(dir, name string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create directory %s", dir)
+	}
+	var certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: in.Cert.Raw})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write certificate %s", name)
+	}
+	var keyDER, err = x509.MarshalPKCS8PrivateKey(in.Key)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal private key %s", name)
+	}
+	var keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600); err != nil {
+		return errors.Wrapf(err, "failed to write private key %s", name)
+	}
+	return nil
+}
+
+// Hosts returns the default hosts of the server certificate,
+// including localhost, the hostname and the POD_IP if it is set.
+func Hosts() []string {
+	var hosts = []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname)
+	}
+	if podIP := os.Getenv("POD_IP"); podIP != "" {
+		hosts = append(hosts, podIP)
+	}
+	return hosts
+}
+
+func newTemplate(commonName string) *x509.Certificate {
+	var now = time.Now()
+	return &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{"Rancher Octopus Simulator"},
+		},
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(validity),
+	}
+}
+
+// create signs the template by the parent, or by itself if the parent is nil.
+func create(template *x509.Certificate, parent *Bundle) (*Bundle, error) {
+	var key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate private key")
+	}
+	template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate serial number")
+	}
+
+	var parentCert, parentKey = template, crypto.Signer(key)
+	if parent != nil {
+		parentCert, parentKey = parent.Cert, parent.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, key.Public(), parentKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create certificate %s", template.Subject.CommonName)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse certificate %s", template.Subject.CommonName)
+	}
+	return &Bundle{Cert: cert, Key: key}, nil
+}
+
+// Generate creates a throwaway CA and the certificates signed by it into the directory,
+// ca.pem, server.pem for the hosts, client.pem, and client-<name>.pem carrying the extensions for each of the extra clients.
+func Generate(dir string, hosts []string, clients map[string][]pkix.Extension) error {
+	var ca, err = NewCA("octopus-simulator-ca")
+	if err != nil {
+		return err
+	}
+	if err := ca.Write(dir, "ca"); err != nil {
+		return err
+	}
+
+	server, err := ca.IssueServer("octopus-simulator", hosts)
+	if err != nil {
+		return err
+	}
+	if err := server.Write(dir, "server"); err != nil {
+		return err
+	}
+
+	client, err := ca.IssueClient("octopus-simulator-client")
+	if err != nil {
+		return err
+	}
+	if err := client.Write(dir, "client"); err != nil {
+		return err
+	}
+
+	var names = make([]string, 0, len(clients))
+	for name := range clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var client, err = ca.IssueClient("octopus-simulator-"+name, clients[name]...)
+		if err != nil {
+			return err
+		}
+		if err := client.Write(dir, "client-"+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// NewClientTLSConfig creates the TLS configuration of client,
+// the CA verifies the server certificate, and the certificate with key is presented if the server requires.
+func NewClientTLSConfig(caFile, certFile, keyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	var config = &tls.Config{
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if caFile != "" {
+		var pool, err = loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		var cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	var caPEM, err = ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read CA %s", caFile)
+	}
+	var pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.Errorf("failed to parse CA %s", caFile)
+	}
+	return pool, nil
+}